@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ribasushi/DAGger/internal/chunkstability"
+)
+
+func main() {
+
+	cs, fnArgs := chunkstability.NewFromArgs(os.Args)
+
+	if err := cs.Analyze(fnArgs, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -80,5 +80,7 @@ func main() {
 		}
 	}
 
-	dgr.OutputSummary()
+	if err := dgr.OutputSummary(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ribasushi/DAGger/internal/undagger"
+	"github.com/ribasushi/DAGger/internal/util/stream"
+)
+
+func main() {
+
+	udg := undagger.NewFromArgs(os.Args)
+
+	if !udg.IsVerifying() && stream.IsTTY(os.Stdout) {
+		log.Fatal("Streaming to a TTY is not supported")
+	}
+
+	if s, err := os.Stdout.Stat(); err != nil {
+		log.Printf("Failed to stat() stdOUT: %s", err)
+	} else {
+		for _, opt := range stream.WriteOptimizations {
+			if err := opt.Action(os.Stdout, s); err != nil && err != os.ErrInvalid {
+				log.Printf("Failed to apply write optimization hint '%s' to stdOUT: %s\n", opt.Name, err)
+			}
+		}
+	}
+
+	if err := udg.ProcessReader(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,280 @@
+// Package dagger exposes the stream-dagger chunking and DAG-forming pipeline
+// as a regular importable library.
+//
+// Every instance returned by New is fully independent: one can run as many
+// of them concurrently within the same process as desired. Note however that
+// the rusage-derived statistics (cpu time, memory, faults) are process-wide,
+// and will reflect the work of all concurrently running instances.
+package dagger
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	dgrinternal "github.com/ribasushi/DAGger/internal/dagger"
+)
+
+// Names of the emitters understood by Config.Emitters
+const (
+	EmitterStatsText          = "stats-text"
+	EmitterStatsJsonl         = "stats-jsonl"
+	EmitterStatsOpenMetrics   = "stats-openmetrics"
+	EmitterRootsJsonl         = "roots-jsonl"
+	EmitterChunksJsonl        = "chunks-jsonl"
+	EmitterCarV0Fifos         = "car-v0-fifos-xargs"
+	EmitterCarV0PinlessStream = "car-v0-pinless-stream"
+	EmitterCarV1File          = "car-v1-file"
+	EmitterCarV2File          = "car-v2-file"
+	EmitterCarSplitManifest   = "car-split-manifest-jsonl"
+	EmitterProgressJsonl      = "progress-jsonl"
+	EmitterProgressText       = "progress-text"
+	EmitterRecipeJsonl        = "recipe-jsonl"
+)
+
+type (
+	Dagger             = dgrinternal.Dagger
+	IngestionEvent     = dgrinternal.IngestionEvent
+	IngestionEventType = dgrinternal.IngestionEventType
+)
+
+const (
+	ErrorString   = dgrinternal.ErrorString
+	NewChunkJsonl = dgrinternal.NewChunkJsonl
+	NewRootJsonl  = dgrinternal.NewRootJsonl
+)
+
+// Stage describes a single chunker, collector or node-encoder together with
+// its options. Each option is either a `name=value` pair or a bare `flag`, as
+// listed in the output of `stream-dagger --help-all`.
+type Stage struct {
+	Name    string
+	Options []string
+}
+
+func (s Stage) String() string {
+	return strings.Join(append([]string{s.Name}, s.Options...), "_")
+}
+
+// Config is the typed equivalent of the stream-dagger command line. Zero
+// values select the same defaults as the CLI does.
+type Config struct {
+	Chunkers    []Stage
+	Collectors  []Stage
+	NodeEncoder Stage
+
+	Hash          string
+	HashBits      int
+	CidMultibase  string
+	InlineMaxSize int // always passed on, unless one of the 3 options below is set and this is 0
+
+	// A complete go-ipfs/js-ipfs add command serving as a basis config
+	IpfsAddCompatibleCommand string
+
+	// A .json, .toml or .yaml file, and/or the name of a profile within it or
+	// of a built-in one, supplying whatever is left unset above
+	ConfigFile string
+	Profile    string
+
+	Multipart      bool
+	MultipartPaths bool // implies Multipart
+	SkipNulInputs  bool
+
+	// "tar" processes every regular member of a tar archive as a substream,
+	// optionally assembled into a single TarDirectoryRoot. Empty means "stream"
+	InputFormat      string
+	TarDirectoryRoot bool
+
+	// One of "gzip", "zstd", "xz" or "auto" to decompress
+	// the input before any other processing. Empty means "none"
+	Decompress string
+
+	// Chunk and collect up to this many Multipart substreams concurrently.
+	// Roots are still emitted in input order. 0 or 1 disables
+	MultipartParallel int
+
+	AsyncHashers       int // 0 selects the default, a negative value disables async hashing
+	RingBufferSize     int
+	RingBufferSyncSize int
+	RingBufferMinRead  int
+	StatsActive        uint
+
+	// How often EmitterProgressJsonl and EmitterProgressText report, rounded
+	// down to milliseconds. 0 selects the default of one second
+	ProgressInterval time.Duration
+
+	// Approximate memory cap for tracking the distinct blocks of a run, beyond
+	// which they are spilled to temporary files. 0 leaves it unbounded
+	SeenBlocksMaxMemory int64
+
+	// Required when EmitterCarSplitManifest is active: the maximum size of each
+	// .car file, and a printf-style template with a single integer verb naming
+	// them, e.g. "out_%04d.car"
+	CarSplitMaxBytes     int64
+	CarSplitPathTemplate string
+
+	// An index of the blocks written by a .car emitter in previous runs: such
+	// blocks are not written again, making the .car output incremental
+	DedupIndex string
+
+	// Atomically (re)write the EmitterStatsOpenMetrics summary to this file
+	// once OutputSummary is called, e.g. for the node_exporter textfile collector
+	StatsOpenMetricsFile string
+
+	// Atomically (re)write the EmitterRecipeJsonl document to this file at the
+	// end of a successful run. With RecipeCarBlock it is also written into the
+	// EmitterCarV1File or EmitterCarV2File output, as the last root
+	RecipeFile     string
+	RecipeCarBlock bool
+
+	// Emitter name => target. Any emitter not listed here is inactive.
+	Emitters map[string]io.Writer
+}
+
+// New validates the supplied Config and returns a ready to use Dagger. All
+// configuration problems are returned at once as a single error.
+func New(cfg Config) (*Dagger, error) {
+	argv, err := cfg.argv()
+	if err != nil {
+		return nil, err
+	}
+	return dgrinternal.NewFromArgvNoExit(argv, cfg.Emitters)
+}
+
+func (cfg Config) argv() ([]string, error) {
+
+	argv := []string{"dagger"}
+
+	addOpt := func(name string, val interface{}) {
+		argv = append(argv, fmt.Sprintf("--%s=%v", name, val))
+	}
+
+	for _, chain := range []struct {
+		optName string
+		stages  []Stage
+	}{
+		{"chunkers", cfg.Chunkers},
+		{"collectors", cfg.Collectors},
+	} {
+		if len(chain.stages) == 0 {
+			continue
+		}
+		specs := make([]string, len(chain.stages))
+		for i, s := range chain.stages {
+			if err := s.validate(); err != nil {
+				return nil, err
+			}
+			specs[i] = s.String()
+		}
+		addOpt(chain.optName, strings.Join(specs, "__"))
+	}
+
+	if cfg.NodeEncoder.Name != "" {
+		if err := cfg.NodeEncoder.validate(); err != nil {
+			return nil, err
+		}
+		addOpt("node-encoder", cfg.NodeEncoder.String())
+	}
+
+	if cfg.IpfsAddCompatibleCommand != "" {
+		addOpt("ipfs-add-compatible-command", cfg.IpfsAddCompatibleCommand)
+	}
+	if cfg.ConfigFile != "" {
+		addOpt("config", cfg.ConfigFile)
+	}
+	if cfg.Profile != "" {
+		addOpt("profile", cfg.Profile)
+	}
+	if (cfg.IpfsAddCompatibleCommand == "" && cfg.ConfigFile == "" && cfg.Profile == "") || cfg.InlineMaxSize != 0 {
+		addOpt("inline-max-size", cfg.InlineMaxSize)
+	}
+
+	if cfg.Hash != "" {
+		addOpt("hash", cfg.Hash)
+	}
+	if cfg.HashBits != 0 {
+		addOpt("hash-bits", cfg.HashBits)
+	}
+	if cfg.CidMultibase != "" {
+		addOpt("cid-multibase", cfg.CidMultibase)
+	}
+
+	if cfg.Multipart {
+		argv = append(argv, "--multipart")
+	}
+	if cfg.MultipartPaths {
+		argv = append(argv, "--multipart-paths")
+	}
+	if cfg.SkipNulInputs {
+		argv = append(argv, "--skip-nul-inputs")
+	}
+	if cfg.InputFormat != "" {
+		addOpt("input-format", cfg.InputFormat)
+	}
+	if cfg.TarDirectoryRoot {
+		argv = append(argv, "--tar-directory-root")
+	}
+	if cfg.Decompress != "" {
+		addOpt("decompress", cfg.Decompress)
+	}
+
+	if cfg.AsyncHashers < 0 {
+		addOpt("async-hashers", 0)
+	} else if cfg.AsyncHashers > 0 {
+		addOpt("async-hashers", cfg.AsyncHashers)
+	}
+	if cfg.RingBufferSize != 0 {
+		addOpt("ring-buffer-size", cfg.RingBufferSize)
+	}
+	if cfg.RingBufferSyncSize != 0 {
+		addOpt("ring-buffer-sync-size", cfg.RingBufferSyncSize)
+	}
+	if cfg.RingBufferMinRead != 0 {
+		addOpt("ring-buffer-min-sysread", cfg.RingBufferMinRead)
+	}
+	if cfg.StatsActive != 0 {
+		addOpt("stats-active", cfg.StatsActive)
+	}
+	if cfg.ProgressInterval != 0 {
+		addOpt("progress-interval", cfg.ProgressInterval.Milliseconds())
+	}
+	if cfg.MultipartParallel != 0 {
+		addOpt("multipart-parallel", cfg.MultipartParallel)
+	}
+	if cfg.SeenBlocksMaxMemory != 0 {
+		addOpt("seen-blocks-max-memory", cfg.SeenBlocksMaxMemory)
+	}
+	if cfg.CarSplitMaxBytes != 0 {
+		addOpt("car-split-max-bytes", cfg.CarSplitMaxBytes)
+	}
+	if cfg.CarSplitPathTemplate != "" {
+		addOpt("car-split-path-template", cfg.CarSplitPathTemplate)
+	}
+	if cfg.DedupIndex != "" {
+		addOpt("dedup-index", cfg.DedupIndex)
+	}
+	if cfg.StatsOpenMetricsFile != "" {
+		addOpt("stats-openmetrics-file", cfg.StatsOpenMetricsFile)
+	}
+	if cfg.RecipeFile != "" {
+		addOpt("recipe-file", cfg.RecipeFile)
+	}
+	if cfg.RecipeCarBlock {
+		argv = append(argv, "--recipe-car-block")
+	}
+
+	return argv, nil
+}
+
+func (s Stage) validate() error {
+	if s.Name == "" || strings.Contains(s.Name, "_") {
+		return fmt.Errorf("invalid stage name '%s'", s.Name)
+	}
+	for _, o := range s.Options {
+		if o == "" || strings.Contains(o, "_") {
+			return fmt.Errorf("invalid option '%s' for stage '%s': options may not be empty nor contain '_'", o, s.Name)
+		}
+	}
+	return nil
+}
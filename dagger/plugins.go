@@ -0,0 +1,64 @@
+package dagger
+
+import (
+	dgrinternal "github.com/ribasushi/DAGger/internal/dagger"
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
+	dgrcollector "github.com/ribasushi/DAGger/internal/dagger/collector"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+	"github.com/ribasushi/DAGger/internal/zcpstring"
+)
+
+// Everything a third-party chunker, collector or node encoder needs to
+// implement the respective initializer and interface. The actual chunker
+// interface lives in github.com/ribasushi/DAGger/chunker
+//
+// Under --multipart-parallel every initializer is invoked once per worker, so
+// an instance is never used concurrently. The BlockMaker and the callbacks
+// within the configs are shared between workers, and are safe to call from
+// multiple goroutines
+type (
+	ChunkerInitializer = dgrchunker.Initializer
+	ChunkerConfig      = dgrchunker.DaggerConfig
+	ChunkerConstants   = dgrchunker.InstanceConstants
+
+	Collector            = dgrcollector.Collector
+	CollectorInitializer = dgrcollector.Initializer
+	CollectorConfig      = dgrcollector.DaggerConfig
+
+	NodeEncoder            = dgrencoder.NodeEncoder
+	NodeEncoderInitializer = dgrencoder.Initializer
+	NodeEncoderConfig      = dgrencoder.DaggerConfig
+	NodeOrigin             = dgrencoder.NodeOrigin
+
+	BlockHeader = dgrblock.Header
+	BlockMaker  = dgrblock.Maker
+	DataSource  = dgrblock.DataSource
+	ZcpString   = zcpstring.ZcpString
+)
+
+const (
+	CodecRaw = dgrblock.CodecRaw
+	CodecPB  = dgrblock.CodecPB
+)
+
+// RegisterChunker makes a chunker available under the given name to every
+// subsequently created Dagger. The initializer is never invoked with nil args:
+// the supplied helpText is displayed instead.
+func RegisterChunker(name string, init ChunkerInitializer, helpText string) error {
+	return dgrinternal.RegisterChunker(name, init, helpText)
+}
+
+// RegisterCollector makes a collector available under the given name to every
+// subsequently created Dagger. The initializer is never invoked with nil args:
+// the supplied helpText is displayed instead.
+func RegisterCollector(name string, init CollectorInitializer, helpText string) error {
+	return dgrinternal.RegisterCollector(name, init, helpText)
+}
+
+// RegisterNodeEncoder makes a node encoder available under the given name to
+// every subsequently created Dagger. The initializer is never invoked with nil
+// args: the supplied helpText is displayed instead.
+func RegisterNodeEncoder(name string, init NodeEncoderInitializer, helpText string) error {
+	return dgrinternal.RegisterNodeEncoder(name, init, helpText)
+}
@@ -4,6 +4,7 @@ go 1.11
 
 require (
 	github.com/BurntSushi/rure-go v0.0.0-20200220204551-0338b655c065
+	github.com/BurntSushi/toml v0.4.1
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/ipfs/go-qringbuf v0.0.0-20200519114740-ddee1a6d5e5d
 	github.com/klauspost/compress v1.10.8
@@ -17,4 +18,5 @@ require (
 	github.com/ulikunitz/xz v0.5.7
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	golang.org/x/sys v0.0.0-20220704084225-05e143d24a9e
+	gopkg.in/yaml.v2 v2.4.0
 )
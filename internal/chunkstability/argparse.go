@@ -0,0 +1,150 @@
+package chunkstability
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+)
+
+type config struct {
+	optSet *getopt.Set
+
+	Chunkers []string `getopt:"--chunkers=ch1_o1.1_..._o1.N__ch2_... A chunker chain as understood by 'stream-dagger --chunkers' (see 'stream-dagger --help-all'). Repeat the option to compare several chains, each is reported on a separate line"`
+	Edits    string   `getopt:"--edits=op:offset:length,...       When given a single file: derive the second version by applying the comma-separated edits, each one of 'insert', 'delete' or 'overwrite'. Offsets refer to the original file and must be ascending and non-overlapping"`
+	EditSeed int64    `getopt:"--edit-seed=integer                Seed of the pseudo-random content used by 'insert' and 'overwrite' edits. Default: [1]"`
+	Help     bool     `getopt:"-h --help                          Display help"`
+
+	edits []edit
+}
+
+const (
+	editInsert    = "insert"
+	editDelete    = "delete"
+	editOverwrite = "overwrite"
+)
+
+type edit struct {
+	op     string
+	offset int64
+	length int64
+}
+
+func NewFromArgs(argv []string) (cs *Analyzer, fnArgs []string) {
+
+	cs = &Analyzer{
+		cfg: config{
+			optSet:   getopt.New(),
+			EditSeed: 1,
+		},
+	}
+
+	cfg := &cs.cfg
+
+	if err := options.RegisterSet("", cfg, cfg.optSet); err != nil {
+		log.Fatalf("option set registration failed: %s", err)
+	}
+	cfg.optSet.SetParameters("{{original-file}} [{{modified-file}}]\n")
+
+	var argParseErrors []string
+	if err := cfg.optSet.Getopt(argv, nil); err != nil {
+		argParseErrors = append(argParseErrors, err.Error())
+	}
+
+	if cfg.Help {
+		cfg.usageAndExit(nil)
+	}
+
+	if len(cfg.Chunkers) == 0 {
+		argParseErrors = append(argParseErrors, "you must supply at least one --chunkers chain")
+	}
+
+	fnArgs = cfg.optSet.Args()
+	if len(fnArgs) == 1 && cfg.Edits == "" {
+		argParseErrors = append(argParseErrors, "a single file argument requires --edits")
+	} else if len(fnArgs) == 2 && cfg.Edits != "" {
+		argParseErrors = append(argParseErrors, "--edits can not be combined with a second file argument")
+	} else if len(fnArgs) < 1 || len(fnArgs) > 2 {
+		argParseErrors = append(argParseErrors, "you must supply either one file and --edits, or two files as arguments")
+	}
+
+	if cfg.Edits != "" {
+		argParseErrors = append(argParseErrors, cfg.parseEdits()...)
+	}
+
+	if len(argParseErrors) > 0 {
+		cfg.usageAndExit(argParseErrors)
+	}
+
+	return
+}
+
+func (cfg *config) parseEdits() (argErrs []string) {
+
+	var prevEnd int64
+	for _, spec := range strings.Split(cfg.Edits, ",") {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			argErrs = append(argErrs, fmt.Sprintf("edit '%s' is not of the form op:offset:length", spec))
+			continue
+		}
+
+		e := edit{op: parts[0]}
+		if e.op != editInsert && e.op != editDelete && e.op != editOverwrite {
+			argErrs = append(argErrs, fmt.Sprintf(
+				"edit '%s' has an unknown op '%s', expected one of '%s', '%s' or '%s'",
+				spec, e.op, editInsert, editDelete, editOverwrite,
+			))
+			continue
+		}
+
+		var err error
+		if e.offset, err = strconv.ParseInt(parts[1], 10, 64); err != nil || e.offset < 0 {
+			argErrs = append(argErrs, fmt.Sprintf("edit '%s' has an invalid offset '%s'", spec, parts[1]))
+			continue
+		}
+		if e.length, err = strconv.ParseInt(parts[2], 10, 64); err != nil || e.length < 1 {
+			argErrs = append(argErrs, fmt.Sprintf("edit '%s' has an invalid length '%s'", spec, parts[2]))
+			continue
+		}
+
+		if e.offset < prevEnd {
+			argErrs = append(argErrs, fmt.Sprintf("edit '%s' is out of order or overlaps the previous edit", spec))
+			continue
+		}
+		prevEnd = e.offset
+		if e.op != editInsert {
+			prevEnd += e.length
+		}
+
+		cfg.edits = append(cfg.edits, e)
+	}
+
+	return
+}
+
+func (cfg *config) usageAndExit(errorStrings []string) {
+
+	if len(errorStrings) > 0 {
+		fmt.Fprint(os.Stderr, "\nFatal error parsing arguments:\n\n")
+	}
+
+	cfg.optSet.PrintUsage(os.Stderr)
+
+	if len(errorStrings) > 0 {
+		sort.Strings(errorStrings)
+		fmt.Fprintf(
+			os.Stderr,
+			"\nFatal error parsing arguments:\n\t%s\n\n",
+			strings.Join(errorStrings, "\n\t"),
+		)
+		os.Exit(2)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,246 @@
+package chunkstability
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ribasushi/DAGger/dagger"
+)
+
+type Analyzer struct {
+	cfg config
+}
+
+type chainResult struct {
+	EventType       string       `json:"event"`
+	Chunkers        string       `json:"chunkers"`
+	Original        versionStats `json:"original"`
+	Modified        versionStats `json:"modified"`
+	IdenticalChunks int64        `json:"identicalChunks"`
+	IdenticalBytes  int64        `json:"identicalBytes"`
+	IdenticalRatio  float64      `json:"identicalBytesRatio"` // of the modified version
+}
+
+type versionStats struct {
+	Chunks int64            `json:"chunks"`
+	Bytes  int64            `json:"bytes"`
+	Sizes  sizeDistribution `json:"chunkSizes"`
+}
+
+// same percentiles as the stream-dagger stats
+type sizeDistribution struct {
+	Min int     `json:"min"`
+	P3  int     `json:"p3"`
+	P10 int     `json:"p10"`
+	P25 int     `json:"p25"`
+	P50 int     `json:"p50"`
+	P95 int     `json:"p95"`
+	Max int     `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// the subset of a chunks-jsonl line we are interested in
+type chunkEvent struct {
+	Length   int64  `json:"length"`
+	Minihash string `json:"minihash"`
+}
+
+// Analyze emits a JSONL line for every requested chunker chain, comparing the
+// chunks of the two versions of the input
+func (cs *Analyzer) Analyze(fnArgs []string, out io.Writer) error {
+
+	for _, chain := range cs.cfg.Chunkers {
+		res := chainResult{
+			EventType: "chunkerStability",
+			Chunkers:  chain,
+		}
+
+		originalChunks := make(map[string]struct{}, 1<<16)
+		if err := cs.chunkVersion(fnArgs, 0, chain, &res.Original, func(ce chunkEvent) {
+			originalChunks[ce.Minihash] = struct{}{}
+		}); err != nil {
+			return err
+		}
+
+		if err := cs.chunkVersion(fnArgs, 1, chain, &res.Modified, func(ce chunkEvent) {
+			if _, seen := originalChunks[ce.Minihash]; seen {
+				res.IdenticalChunks++
+				res.IdenticalBytes += ce.Length
+			}
+		}); err != nil {
+			return err
+		}
+
+		if res.Modified.Bytes > 0 {
+			res.IdenticalRatio = float64(res.IdenticalBytes) / float64(res.Modified.Bytes)
+		}
+
+		jsonl, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("encoding result failed: %s", err)
+		}
+		if _, err := fmt.Fprintf(out, "%s\n", jsonl); err != nil {
+			return fmt.Errorf("emitting result failed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (cs *Analyzer) chunkVersion(fnArgs []string, version int, chain string, vs *versionStats, cb func(chunkEvent)) error {
+
+	dgr, err := dagger.New(dagger.Config{
+		Chunkers: parseChain(chain),
+		Hash:     "blake3",
+		Emitters: map[string]io.Writer{
+			dagger.EmitterChunksJsonl: ioutil.Discard,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("chunker chain '%s': %s", chain, err)
+	}
+	defer dgr.Destroy()
+
+	fh, err := os.Open(fnArgs[0])
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	var input io.Reader = fh
+	if version == 1 {
+		if len(fnArgs) > 1 {
+			fh2, err := os.Open(fnArgs[1])
+			if err != nil {
+				return err
+			}
+			defer fh2.Close()
+			input = fh2
+		} else if input, err = cs.editedReader(fh); err != nil {
+			return err
+		}
+	}
+
+	sizes := make([]int, 0, 1<<16)
+	var decodeErr error
+
+	events := make(chan dagger.IngestionEvent, 1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range events {
+			if ev.Type != dagger.NewChunkJsonl || decodeErr != nil {
+				continue
+			}
+
+			var ce chunkEvent
+			if decodeErr = json.Unmarshal([]byte(ev.Body), &ce); decodeErr != nil {
+				continue
+			}
+
+			// padding chunks are reported with a negative length
+			if ce.Length < 0 {
+				ce.Length = -ce.Length
+			}
+			if ce.Length == 0 {
+				continue
+			}
+
+			vs.Chunks++
+			vs.Bytes += ce.Length
+			sizes = append(sizes, int(ce.Length))
+			cb(ce)
+		}
+	}()
+
+	err = dgr.ProcessReader(input, events)
+	<-done
+	if err != nil {
+		return fmt.Errorf("chunking version %d with '%s' failed: %s", version+1, chain, err)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("decoding chunk event failed: %s", decodeErr)
+	}
+
+	vs.Sizes = distribution(sizes)
+	return nil
+}
+
+// Applies the edits on the fly while reading the original file
+func (cs *Analyzer) editedReader(fh *os.File) (io.Reader, error) {
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	rnd := rand.New(rand.NewSource(cs.cfg.EditSeed))
+	parts := make([]io.Reader, 0, 2*len(cs.cfg.edits)+1)
+
+	var cur int64
+	for _, e := range cs.cfg.edits {
+		if e.offset > size || (e.op != editInsert && e.offset+e.length > size) {
+			return nil, fmt.Errorf(
+				"edit %s:%d:%d extends past the end of '%s' (%d bytes)",
+				e.op, e.offset, e.length, fh.Name(), size,
+			)
+		}
+
+		parts = append(parts, io.NewSectionReader(fh, cur, e.offset-cur))
+		cur = e.offset
+
+		if e.op != editDelete {
+			parts = append(parts, io.LimitReader(rnd, e.length))
+		}
+		if e.op != editInsert {
+			cur += e.length
+		}
+	}
+	parts = append(parts, io.NewSectionReader(fh, cur, size-cur))
+
+	return io.MultiReader(parts...), nil
+}
+
+func parseChain(chain string) []dagger.Stage {
+	var stages []dagger.Stage
+	for _, c := range strings.Split(chain, "__") {
+		args := strings.Split(c, "_")
+		stages = append(stages, dagger.Stage{
+			Name:    args[0],
+			Options: args[1:],
+		})
+	}
+	return stages
+}
+
+func distribution(sizes []int) (d sizeDistribution) {
+	if len(sizes) == 0 {
+		return
+	}
+
+	sort.Ints(sizes)
+
+	var total int64
+	for _, s := range sizes {
+		total += int64(s)
+	}
+
+	d.Min = sizes[0]
+	d.Max = sizes[len(sizes)-1]
+	d.Avg = float64(total) / float64(len(sizes))
+
+	// nearest-rank
+	percentile := func(p int) int {
+		return sizes[(p*len(sizes)+99)/100-1]
+	}
+	d.P3, d.P10, d.P25, d.P50, d.P95 = percentile(3), percentile(10), percentile(25), percentile(50), percentile(95)
+
+	return
+}
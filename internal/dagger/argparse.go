@@ -7,6 +7,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
@@ -41,11 +42,21 @@ type config struct {
 	Help            bool `getopt:"-h --help         Display basic help"`
 	HelpAll         bool `getopt:"--help-all        Display full help including options for every currently supported chunker/collector/encoder"`
 	MultipartStream bool `getopt:"--multipart       Expect multiple SInt64BE-size-prefixed streams on stdIN"`
+	MultipartPaths  bool `getopt:"--multipart-paths Like --multipart, but every size is preceded by a SInt64BE-length-prefixed '/'-separated path. A size of -1 denotes a directory. The files are assembled into UnixFS directories, the top-level entries become the roots"`
 	SkipNulInputs   bool `getopt:"--skip-nul-inputs Instead of emitting an IPFS-compatible zero-length CID, skip zero-length streams outright"`
 
+	InputFormat      string `getopt:"--input-format=format Either 'stream', or 'tar' to process every regular member of a ustar/pax/gnu tar archive on stdIN as a substream of its own, reporting its name, mode and mtime in roots-jsonl. Directories, links and special members are skipped. Default:"`
+	TarDirectoryRoot bool   `getopt:"--tar-directory-root  With --input-format=tar assemble the members into UnixFS directories, emitting a single directory root for the whole archive"`
+	Decompress       string `getopt:"--decompress=format   Decompress stdIN before any other processing: one of 'gzip', 'zstd', 'xz', or 'auto' to select one of these by the magic at the start of the input. Combined with --multipart this accepts e.g. the compressed output of maint/src/dezstd. Default:"`
+
+	MultipartParallel int `getopt:"--multipart-parallel=integer Chunk and collect up to this many substreams concurrently, each worker using its own chunker/collector chain and ring buffer. Roots are still emitted in input order, chunks-jsonl lines are grouped per substream. Not supported with car-split-manifest-jsonl. 0 or 1 disables"`
+
 	emittersStdErr []string // Emitter spec: option/helptext in initArgvParser()
 	emittersStdOut []string // Emitter spec: option/helptext in initArgvParser()
 
+	// when running as a library: takes precedence over emittersStd{Err,Out}
+	emittersCustom map[string]io.Writer
+
 	// no-option-attached, these are instantiation error accumulators
 	erroredChunkers     []string
 	erroredCollectors   []string
@@ -60,7 +71,8 @@ type config struct {
 	RingBufferSectSize int `getopt:"--ring-buffer-sync-size=bytes   (EXPERT SETTING) The size of each buffer synchronization sector. Default:"` // option vaguely named 'sync' to not confuse users
 	RingBufferMinRead  int `getopt:"--ring-buffer-min-sysread=bytes (EXPERT SETTING) Perform next read(2) only when the specified amount of free space is available in the buffer. Default:"`
 
-	StatsActive uint `getopt:"--stats-active=uint   A bitfield representing activated stat aggregations: bit0:BlockSizing, bit1:RingbufferTiming. Default:"`
+	StatsActive         uint  `getopt:"--stats-active=uint             A bitfield representing activated stat aggregations: bit0:BlockSizing, bit1:RingbufferTiming. Default:"`
+	SeenBlocksMaxMemory int64 `getopt:"--seen-blocks-max-memory=bytes Approximate memory cap for tracking the distinct blocks seen by bit0:BlockSizing (about 80 bytes per block). Beyond it sorted runs are spilled to temporary files, keeping the stats and car deduplication exact at the cost of disk lookups. 0 disables"`
 
 	HashBits     int    `getopt:"--hash-bits=integer    Amount of bits taken from *start* of the hash output. Default:"`
 	CidMultibase string `getopt:"--cid-multibase=string Use this multibase when encoding CIDs for output. One of 'base32', 'base36'. Default:"`
@@ -71,6 +83,21 @@ type config struct {
 	requestedNodeEncoder string // The global (for now) node=>block encoder: option/helptext in initArgvParser
 
 	IpfsCompatCmd string `getopt:"--ipfs-add-compatible-command=cmdstring A complete go-ipfs/js-ipfs add command serving as a basis config (any conflicting option will take precedence)"`
+
+	ConfigFile string `getopt:"--config=path  A .json, .toml or .yaml file supplying any of the long options as structured data, e.g. chunkers as a list of tables with 'name' and 'options'. Options given on the command line take precedence"`
+	Profile    string `getopt:"--profile=name A named set of options: either from the 'profiles' table of --config, or a built-in one equivalent to an --ipfs-add-compatible-command. Takes precedence over the rest of --config, but not over the command line"`
+
+	CarSplitMaxBytes     int64  `getopt:"--car-split-max-bytes=bytes     Maximum size of each .car file written when the car-split-manifest-jsonl emitter is active"`
+	CarSplitPathTemplate string `getopt:"--car-split-path-template=path  Printf-style template of the .car files written when the car-split-manifest-jsonl emitter is active, e.g. 'out_%04d.car'"`
+
+	StatsOpenMetricsFile string `getopt:"--stats-openmetrics-file=path Atomically (re)write the same summary as the stats-openmetrics emitter to this file at the end of a successful run, e.g. for the node_exporter textfile collector"`
+
+	ProgressIntervalMsecs int `getopt:"--progress-interval=msecs How often the progress-jsonl and progress-text emitters report. Default:"`
+
+	DedupIndex string `getopt:"--dedup-index=path An append-only index of the blocks written by the .car emitter in previous runs, created if missing. Blocks found there are not written again, and the blocks of a successful run are added to it"`
+
+	RecipeFile     string `getopt:"--recipe-file=path Atomically (re)write the same document as the recipe-jsonl emitter to this file at the end of a successful run"`
+	RecipeCarBlock bool   `getopt:"--recipe-car-block Also write the recipe as a DAG-CBOR block into the car-v1-file or car-v2-file output, listed as the last root of its header"`
 }
 
 const (
@@ -84,17 +111,93 @@ const (
 	emNone               = "none"
 	emStatsText          = "stats-text"
 	emStatsJsonl         = "stats-jsonl"
+	emStatsOpenMetrics   = "stats-openmetrics"
 	emRootsJsonl         = "roots-jsonl"
 	emChunksJsonl        = "chunks-jsonl"
 	emCarV0Fifos         = "car-v0-fifos-xargs"
 	emCarV0PinlessStream = "car-v0-pinless-stream"
+	emCarV1File          = "car-v1-file"
+	emCarV2File          = "car-v2-file"
+	emCarSplitManifest   = "car-split-manifest-jsonl"
+	emProgressJsonl      = "progress-jsonl"
+	emProgressText       = "progress-text"
+	emRecipeJsonl        = "recipe-jsonl"
 )
 
 // where the CLI initial error messages go
 var argParseErrOut = os.Stderr
 
+// ArgvErrors is returned by NewFromArgvNoExit when the supplied arguments do
+// not form a valid configuration. It carries every individual problem found,
+// so that all of them can be presented to the user at once.
+type ArgvErrors []string
+
+func (e ArgvErrors) Error() string {
+	return "Fatal error parsing arguments:\n\t" + strings.Join(e, "\n\t")
+}
+
+// NewFromArgv is the CLI entrypoint: on --help or on any argument error it
+// prints usage to stderr and terminates the process.
 func NewFromArgv(argv []string) (dgr *Dagger) {
 
+	dgr, argParseErrs := parseArgv(argv, nil)
+
+	if len(argParseErrs) == 0 && (dgr.cfg.Help || dgr.cfg.HelpAll) {
+		dgr.cfg.printUsage()
+		os.Exit(0)
+	}
+
+	if len(argParseErrs) != 0 {
+		fmt.Fprint(argParseErrOut, "\nFatal error parsing arguments:\n\n")
+		if dgr.cfg.optSet != nil {
+			dgr.cfg.printUsage()
+		}
+		fmt.Fprintf(argParseErrOut, "%s\n", argParseErrs)
+		os.Exit(2)
+	}
+
+	return
+}
+
+// NewFromArgvNoExit is the library entrypoint: it never writes to stdout/stderr
+// on its own, nor terminates the process. Instead of the --emit-stdout and
+// --emit-stderr options it takes a map of emitter names to arbitrary writers.
+// Any problem with the supplied arguments is returned as ArgvErrors.
+func NewFromArgvNoExit(argv []string, emitterTargets map[string]io.Writer) (*Dagger, error) {
+
+	if emitterTargets == nil {
+		emitterTargets = map[string]io.Writer{}
+	}
+
+	dgr, argParseErrs := parseArgv(argv, emitterTargets)
+
+	if len(argParseErrs) == 0 && (dgr.cfg.Help || dgr.cfg.HelpAll) {
+		argParseErrs = ArgvErrors{"--help and --help-all are not available when running as a library"}
+	}
+
+	if len(argParseErrs) != 0 {
+		// we may have already started the hashers
+		dgr.Destroy()
+		return nil, argParseErrs
+	}
+
+	return dgr, nil
+}
+
+func parseArgv(argv []string, emitterTargets map[string]io.Writer) (dgr *Dagger, argParseErrs ArgvErrors) {
+	// plugins may be registered concurrently with us. The lock is taken once for
+	// the entire parse: a read lock may not be taken recursively, which the
+	// restart for --config/--profile would otherwise do
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return parseArgvWithPresets(argv, nil, emitterTargets)
+}
+
+// presetArgs are the expansion of --config/--profile, parsed ahead of argv[1:].
+// Must be called with registryMu held
+func parseArgvWithPresets(argv []string, presetArgs []string, emitterTargets map[string]io.Writer) (dgr *Dagger, argParseErrs ArgvErrors) {
+
 	dgr = &Dagger{
 		// Some minimal non-controversial defaults, all overridable
 		// Try really hard to *NOT* have defaults that influence resulting CIDs
@@ -105,6 +208,10 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 
 			StatsActive: statsBlocks,
 
+			ProgressIntervalMsecs: 1000,
+			InputFormat:           inputFormatStream,
+			Decompress:            decompressNone,
+
 			// RingBufferSize: 2*constants.HardMaxPayloadSize + 256*1024, // bare-minimum with defaults
 			RingBufferSize: 24 * 1024 * 1024, // SANCHECK low seems good somehow... fits in L3 maybe?
 
@@ -114,16 +221,24 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 
 			emittersStdOut: []string{emRootsJsonl},
 			emittersStdErr: []string{emStatsText},
+			emittersCustom: emitterTargets,
 
 			// not defaults but rather the list of known/configured emitters
 			emitters: emissionTargets{
 				emNone:               nil,
 				emStatsText:          nil,
 				emStatsJsonl:         nil,
+				emStatsOpenMetrics:   nil,
 				emRootsJsonl:         nil,
 				emChunksJsonl:        nil,
 				emCarV0Fifos:         nil,
 				emCarV0PinlessStream: nil,
+				emCarV1File:          nil,
+				emCarV2File:          nil,
+				emCarSplitManifest:   nil,
+				emProgressJsonl:      nil,
+				emProgressText:       nil,
+				emRecipeJsonl:        nil,
 			},
 		},
 	}
@@ -154,14 +269,29 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 	}
 
 	cfg := &dgr.cfg
-	cfg.initArgvParser()
+	if err := cfg.initArgvParser(); err != nil {
+		return dgr, ArgvErrors{err.Error()}
+	}
 
 	// accumulator for multiple errors, to present to the user all at once
-	argParseErrs := argparser.Parse(argv, cfg.optSet)
+	argParseErrs = argparser.Parse(
+		append(append([]string{argv[0]}, presetArgs...), argv[1:]...),
+		cfg.optSet,
+	)
 
 	if cfg.Help || cfg.HelpAll {
-		cfg.printUsage()
-		os.Exit(0)
+		return
+	}
+
+	// start over with whatever --config/--profile supply for the options not on
+	// the command line
+	if presetArgs == nil && len(argParseErrs) == 0 && (cfg.ConfigFile != "" || cfg.Profile != "") {
+		if presetArgs, argParseErrs = cfg.presetArgs(); len(argParseErrs) == 0 && len(presetArgs) > 0 {
+			return parseArgvWithPresets(argv, presetArgs, emitterTargets)
+		}
+		if len(argParseErrs) > 0 {
+			return
+		}
 	}
 
 	// pre-populate from a compat `ipfs add` command if one was supplied
@@ -171,6 +301,13 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 		}
 	}
 
+	argParseErrs = append(argParseErrs, dgr.setupTarInput()...)
+	argParseErrs = append(argParseErrs, dgr.setupDecompress()...)
+
+	if cfg.MultipartPaths {
+		cfg.MultipartStream = true
+	}
+
 	// "invisible" set of defaults (not printed during --help)
 	if cfg.requestedCollectors == "" && !cfg.optSet.IsSet("collectors") {
 		cfg.requestedCollectors = "none"
@@ -184,6 +321,13 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 		argParseErrs = append(argParseErrs, "The value of --hash-bits must be a minimum of 128 and be divisible by 8")
 	}
 
+	if cfg.SeenBlocksMaxMemory < 0 ||
+		(cfg.SeenBlocksMaxMemory > 0 && cfg.SeenBlocksMaxMemory < 1<<20) {
+		argParseErrs = append(argParseErrs, "The value of --seen-blocks-max-memory must be 0 or at least 1MiB")
+	} else if cfg.SeenBlocksMaxMemory > 0 && (cfg.StatsActive&statsBlocks) != statsBlocks {
+		argParseErrs = append(argParseErrs, "--seen-blocks-max-memory requires the BlockSizing bit of --stats-active")
+	}
+
 	if !cfg.optSet.IsSet("inline-max-size") &&
 		!cfg.optSet.IsSet("ipfs-add-compatible-command") &&
 		cfg.requestedCollectors != "none" {
@@ -203,48 +347,52 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 	// Not stored in the dgr object itself, to cut down on logic leaks
 	nodeEnc, errorMessages := dgr.setupEncoding()
 	argParseErrs = append(argParseErrs, errorMessages...)
+	if cfg.MultipartPaths || cfg.TarDirectoryRoot {
+		if dirEnc, canDir := nodeEnc.(dgrencoder.DirectoryEncoder); canDir {
+			dgr.dirTree = newDirTree(dirEnc)
+			dgr.dirTree.wrap = cfg.TarDirectoryRoot
+		} else if len(cfg.erroredNodeEncoders) == 0 {
+			argParseErrs = append(argParseErrs, "--multipart-paths and --tar-directory-root require a node encoder capable of producing directories, e.g. 'unixfsv1'")
+		}
+	}
 	argParseErrs = append(argParseErrs, dgr.setupChunkerChain()...)
 	argParseErrs = append(argParseErrs, dgr.setupCollectorChain(nodeEnc)...)
 	argParseErrs = append(argParseErrs, dgr.setupEmitters()...)
+	argParseErrs = append(argParseErrs, dgr.setupProgress()...)
+	if len(argParseErrs) == 0 {
+		argParseErrs = append(argParseErrs, dgr.setupRecipe()...)
+	}
+	if cfg.MultipartParallel > 1 && len(argParseErrs) == 0 {
+		argParseErrs = append(argParseErrs, dgr.setupParallelWorkers()...)
+	} else if cfg.MultipartParallel < 0 {
+		argParseErrs = append(argParseErrs, "The value of --multipart-parallel can not be negative")
+	}
 
 	// Opts check out - set up the car emitter
 	if len(argParseErrs) == 0 {
 		argParseErrs = append(argParseErrs, dgr.setupCarWriting()...)
 	}
+	if len(argParseErrs) == 0 && cfg.DedupIndex != "" {
+		argParseErrs = append(argParseErrs, dgr.setupDedupIndex()...)
+	}
 
 	if len(argParseErrs) != 0 {
-		fmt.Fprint(argParseErrOut, "\nFatal error parsing arguments:\n\n")
-		cfg.printUsage()
-
 		sort.Strings(argParseErrs)
-		fmt.Fprintf(
-			argParseErrOut,
-			"Fatal error parsing arguments:\n\t%s\n",
-			strings.Join(argParseErrs, "\n\t"),
-		)
-		os.Exit(2)
+		return
 	}
 
 	// Opts *still* check out - take a snapshot of what we ended up with
 
 	// All cid-determining opt come last in a predefined order
-	cidOpts := []string{
-		"inline-max-size",
-		"hash",
-		"hash-bits",
-		"chunkers",
-		"collectors",
-		"node-encoder",
-	}
 	cidOptsIdx := map[string]struct{}{}
-	for _, n := range cidOpts {
+	for _, n := range cidDeterminingOpts {
 		cidOptsIdx[n] = struct{}{}
 	}
 
 	// first do the generic options
 	cfg.optSet.VisitAll(func(o getopt.Option) {
 		switch o.LongName() {
-		case "help", "help-all", "ipfs-add-compatible-command":
+		case "help", "help-all", "ipfs-add-compatible-command", "config", "profile":
 			// do nothing for these
 		default:
 			// skip these keys too, they come next
@@ -261,7 +409,7 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 	sort.Strings(dgr.statSummary.SysStats.ArgvExpanded)
 
 	// now do the remaining cid-determining options
-	for _, n := range cidOpts {
+	for _, n := range cidDeterminingOpts {
 		dgr.statSummary.SysStats.ArgvExpanded = append(
 			dgr.statSummary.SysStats.ArgvExpanded, fmt.Sprintf(`--%s=%s`,
 				n,
@@ -274,6 +422,9 @@ func NewFromArgv(argv []string) (dgr *Dagger) {
 }
 
 func (cfg *config) printUsage() {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
 	cfg.optSet.PrintUsage(argParseErrOut)
 	if cfg.HelpAll || len(cfg.erroredChunkers) > 0 || len(cfg.erroredCollectors) > 0 {
 		printPluginUsage(
@@ -370,12 +521,12 @@ func printPluginUsage(
 	fmt.Fprint(out, "\n")
 }
 
-func (cfg *config) initArgvParser() {
+func (cfg *config) initArgvParser() error {
 	// The default documented way of using pborman/options is to muck with globals
 	// Operate over objects instead, allowing us to re-parse argv multiple times
 	o := getopt.New()
 	if err := options.RegisterSet("", cfg, o); err != nil {
-		log.Fatalf("option set registration failed: %s", err)
+		return fmt.Errorf("option set registration failed: %s", err)
 	}
 	cfg.optSet = o
 
@@ -406,10 +557,78 @@ func (cfg *config) initArgvParser() {
 		"One or more emitters to activate on stdOUT. Available emitters same as above. Default: ",
 		"comma,sep,emitters",
 	)
+
+	return nil
+}
+
+// these emitters can not share their output with any other emitter
+var exclusiveEmitters = []string{
+	emNone,
+	emStatsText,
+	emStatsOpenMetrics,
+	emCarV0Fifos,
+	emCarV0PinlessStream,
+	emCarV1File,
+	emCarV2File,
 }
 
 func (dgr *Dagger) setupEmitters() (argErrs []string) {
 
+	if dgr.cfg.emittersCustom != nil {
+		argErrs = dgr.setupCustomEmitters()
+	} else {
+		argErrs = dgr.setupStdioEmitters()
+	}
+
+	// set couple shortcuts based on emitter config
+	dgr.emitChunks = (dgr.cfg.emitters[emChunksJsonl] != nil)
+	dgr.generateRoots = (dgr.cfg.emitters[emRootsJsonl] != nil || dgr.cfg.emitters[emStatsJsonl] != nil)
+
+	return
+}
+
+func (dgr *Dagger) setupCustomEmitters() (argErrs []string) {
+
+	for s, w := range dgr.cfg.emittersCustom {
+		if _, exists := dgr.cfg.emitters[s]; !exists {
+			argErrs = append(argErrs, fmt.Sprintf("invalid emitter '%s' specified. Available emitters are: %s",
+				s,
+				text.AvailableMapKeys(dgr.cfg.emitters),
+			))
+		} else if s == emNone || w == nil {
+			continue
+		} else if _, isFh := w.(*os.File); s == emCarV0Fifos && !isFh {
+			argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' requires an *os.File target", s))
+		} else {
+			dgr.cfg.emitters[s] = w
+		}
+	}
+
+	// not every writer is comparable: only check the ones that are
+	for _, exclusiveEmitter := range exclusiveEmitters {
+		ew := dgr.cfg.emitters[exclusiveEmitter]
+		if ew == nil || !reflect.TypeOf(ew).Comparable() {
+			continue
+		}
+		for s, w := range dgr.cfg.emitters {
+			if s != exclusiveEmitter &&
+				w != nil &&
+				reflect.TypeOf(w) == reflect.TypeOf(ew) &&
+				w == ew {
+				argErrs = append(argErrs, fmt.Sprintf(
+					"When specified, emitter '%s' can not share its writer with emitter '%s'",
+					exclusiveEmitter,
+					s,
+				))
+			}
+		}
+	}
+
+	return
+}
+
+func (dgr *Dagger) setupStdioEmitters() (argErrs []string) {
+
 	activeStderr := make(map[string]bool, len(dgr.cfg.emittersStdErr))
 	for _, s := range dgr.cfg.emittersStdErr {
 		activeStderr[s] = true
@@ -443,12 +662,7 @@ func (dgr *Dagger) setupEmitters() (argErrs []string) {
 		}
 	}
 
-	for _, exclusiveEmitter := range []string{
-		emNone,
-		emStatsText,
-		emCarV0Fifos,
-		emCarV0PinlessStream,
-	} {
+	for _, exclusiveEmitter := range exclusiveEmitters {
 		if activeStderr[exclusiveEmitter] && len(activeStderr) > 1 {
 			argErrs = append(argErrs, fmt.Sprintf(
 				"When specified, emitter '%s' must be the sole argument to --emit-stderr",
@@ -463,31 +677,40 @@ func (dgr *Dagger) setupEmitters() (argErrs []string) {
 		}
 	}
 
-	// set couple shortcuts based on emitter config
-	dgr.emitChunks = (dgr.cfg.emitters[emChunksJsonl] != nil)
-	dgr.generateRoots = (dgr.cfg.emitters[emRootsJsonl] != nil || dgr.cfg.emitters[emStatsJsonl] != nil)
-
 	return
 }
 
 func (dgr *Dagger) setupCarWriting() (argErrs []string) {
 
 	var carSelectedOut io.Writer
+	var carSelected []string
+	for _, s := range []string{
+		emCarV0Fifos,
+		emCarV0PinlessStream,
+		emCarV1File,
+		emCarV2File,
+		emCarSplitManifest,
+	} {
+		if dgr.cfg.emitters[s] != nil {
+			carSelected = append(carSelected, s)
+			carSelectedOut = dgr.cfg.emitters[s]
+		}
+	}
 
-	// we already checked that only one is set
-	if dgr.cfg.emitters[emCarV0Fifos] != nil {
-		carSelectedOut = dgr.cfg.emitters[emCarV0Fifos]
-	} else if dgr.cfg.emitters[emCarV0PinlessStream] != nil {
-		carSelectedOut = dgr.cfg.emitters[emCarV0PinlessStream]
-	} else {
+	if len(carSelected) == 0 {
 		return
+	} else if len(carSelected) > 1 {
+		return []string{fmt.Sprintf(
+			"Only one .car emitter can be active at a time, got: '%s'",
+			strings.Join(carSelected, "', '"),
+		)}
 	}
 
 	if (dgr.cfg.StatsActive & statsBlocks) != statsBlocks {
 		argErrs = append(argErrs, "disabling blockstat collection conflicts with streaming .car data")
 	}
 
-	if stream.IsTTY(carSelectedOut) {
+	if dgr.cfg.emitters[emCarSplitManifest] == nil && stream.IsTTY(carSelectedOut) {
 		argErrs = append(argErrs, "output of .car streams to a TTY is not supported")
 	}
 
@@ -495,6 +718,16 @@ func (dgr *Dagger) setupCarWriting() (argErrs []string) {
 		return
 	}
 
+	if dgr.cfg.emitters[emCarSplitManifest] != nil {
+		return dgr.setupCarSplit()
+	}
+	if dgr.cfg.emitters[emCarV1File] != nil {
+		return dgr.setupCarFile(emCarV1File, 1, carSelectedOut)
+	}
+	if dgr.cfg.emitters[emCarV2File] != nil {
+		return dgr.setupCarFile(emCarV2File, 2, carSelectedOut)
+	}
+
 	if dgr.cfg.emitters[emCarV0PinlessStream] != nil {
 		dgr.carDataWriter = carSelectedOut
 
@@ -547,10 +780,12 @@ func (dgr *Dagger) setupEncoding() (nodeEnc dgrencoder.NodeEncoder, argErrs []st
 			cfg.HashBits/8,
 			cfg.InlineMaxSize,
 			cfg.AsyncHashers,
+			&dgr.asyncHashersWG,
 		)
 		if errStr != "" {
 			argErrs = append(argErrs, errStr)
 		}
+		dgr.blockMaker = blockMaker
 	}
 
 	// bail if we couldn't init a blockmaker
@@ -592,6 +827,17 @@ func (dgr *Dagger) setupEncoding() (nodeEnc dgrencoder.NodeEncoder, argErrs []st
 		return
 	}
 
+	return dgr.setupNodeEncoder()
+}
+
+// Instantiates the requested node encoder on top of the already configured
+// blockmaker. Link blocks it produces are handed to the block sink, so that
+// parallel workers can each run an instance of their own
+func (dgr *Dagger) setupNodeEncoder() (nodeEnc dgrencoder.NodeEncoder, argErrs []string) {
+
+	cfg := dgr.cfg
+	sink := dgr.blockSink()
+
 	nodeEncArgs := strings.Split(cfg.requestedNodeEncoder, "_")
 	if init, exists := availableNodeEncoders[nodeEncArgs[0]]; !exists {
 		argErrs = append(argErrs, fmt.Sprintf(
@@ -610,15 +856,16 @@ func (dgr *Dagger) setupEncoding() (nodeEnc dgrencoder.NodeEncoder, argErrs []st
 		if nodeEnc, initErrors = init(
 			nodeEncArgs,
 			&dgrencoder.DaggerConfig{
-				BlockMaker: blockMaker,
+				BlockMaker: dgr.blockMaker,
 				HasherName: cfg.hashFunc,
 				HasherBits: cfg.HashBits,
 				NewLinkBlockCallback: func(origin dgrencoder.NodeOrigin, newLinkHdr *dgrblock.Header, linkedBlocks []*dgrblock.Header) {
-					dgr.asyncWG.Add(1)
-					go dgr.postProcessBlock(
+					sink.asyncWG.Add(1)
+					go sink.postProcessBlock(
 						origin,
 						newLinkHdr,
 						nil, // a link-node has no data, for now at least
+						sink.carSplitTrackBlock(),
 					)
 				},
 			},
@@ -791,6 +1038,8 @@ type compatIpfsArgs struct {
 	TrickleCollector bool   `getopt:"--trickle"`
 	Chunker          string `getopt:"--chunker"`
 	Hasher           string `getopt:"--hash"`
+	Recursive        bool   `getopt:"-r --recursive"` // accepted, as a --multipart-paths stream is the equivalent
+	Hidden           bool   `getopt:"-H --hidden"`
 }
 
 func (cfg *config) presetFromIPFS() (parseErrors []string) {
@@ -855,7 +1104,8 @@ func (cfg *config) presetFromIPFS() (parseErrors []string) {
 	// ignore everything compat if an encoder is already given
 	if !cfg.optSet.IsSet("node-encoder") {
 
-		ufsv1EncoderOpts := []string{"unixfsv1", "merkledag-compat-protobuf"}
+		// go-ipfs shards directories above 256KiB since v0.12
+		ufsv1EncoderOpts := []string{"unixfsv1", "merkledag-compat-protobuf", "hamt-sharding-threshold=262144"}
 
 		if ipfsOpts.CidVersion != 1 {
 			if ipfsOpts.UpgradeV0CID && ipfsOpts.CidVersion == 0 {
@@ -5,18 +5,22 @@ import (
 	"hash"
 	"log"
 	"math"
+	"sync"
 	"sync/atomic"
 
 	sha256gocore "crypto/sha256"
+	"crypto/sha512"
 
 	sha256simd "github.com/minio/sha256-simd"
 	"github.com/twmb/murmur3"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/sha3"
 
 	"github.com/ribasushi/DAGger/chunker"
 	"github.com/ribasushi/DAGger/internal/constants"
 	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
+	"github.com/ribasushi/DAGger/internal/util/blake3"
 	"github.com/ribasushi/DAGger/internal/util/text"
 	"github.com/ribasushi/DAGger/internal/zcpstring"
 )
@@ -35,6 +39,10 @@ var AvailableHashers = map[string]hasher{
 		multihashID: 0x12,
 		hasherMaker: sha256gocore.New,
 	},
+	"sha2-512": {
+		multihashID: 0x13,
+		hasherMaker: sha512.New,
+	},
 	"sha3-512": {
 		multihashID: 0x14,
 		hasherMaker: sha3.New512,
@@ -43,6 +51,18 @@ var AvailableHashers = map[string]hasher{
 		multihashID: 0xb220,
 		hasherMaker: func() hash.Hash { hm, _ := blake2b.New256(nil); return hm },
 	},
+	"blake2b-512": {
+		multihashID: 0xb240,
+		hasherMaker: func() hash.Hash { hm, _ := blake2b.New512(nil); return hm },
+	},
+	"blake2s-256": {
+		multihashID: 0xb260,
+		hasherMaker: func() hash.Hash { hm, _ := blake2s.New256(nil); return hm },
+	},
+	"blake3": {
+		multihashID: 0x1e,
+		hasherMaker: blake3.New, // large blocks are hashed by several goroutines at once
+	},
 	"murmur3-128": {
 		multihashID: 0x22,
 		hasherMaker: func() hash.Hash { return murmur3.New128() },
@@ -57,8 +77,9 @@ type hasher struct {
 }
 
 const (
-	CodecRaw uint = 0x55
-	CodecPB  uint = 0x70
+	CodecRaw  uint = 0x55
+	CodecPB   uint = 0x70
+	CodecCBOR uint = 0x71
 
 	NulRootCarHeader = "\x19" + // 25 bytes of CBOR (encoded as varint :cryingbear: )
 		// map with 2 keys
@@ -156,6 +177,7 @@ func MakerFromConfig(
 	cidHashSize int,
 	inlineMaxSize int,
 	maxAsyncHashers int,
+	asyncHashersWG *sync.WaitGroup,
 ) (maker Maker, asyncHashQueue chan hashTask, errString string) {
 
 	hashopts, found := AvailableHashers[hashAlg]
@@ -194,6 +216,7 @@ func MakerFromConfig(
 
 	// if we need to support codec ids over 127 - this will have to be switched to a map
 	var codecs [128]codecMeta
+	var codecsInit [128]sync.Once
 
 	// Makes code easier to follow - in most conditionals below the CID
 	// is "ready" instantly/synchronously. It is only at the very last
@@ -210,8 +233,10 @@ func MakerFromConfig(
 		} else {
 			asyncHashQueue = make(chan hashTask, 8*maxAsyncHashers) // SANCHECK queue up to 8 times the available workers
 
+			asyncHashersWG.Add(maxAsyncHashers)
 			for i := 0; i < maxAsyncHashers; i++ {
 				go func() {
+					defer asyncHashersWG.Done()
 					hasher := hashopts.hasherMaker()
 					for {
 						task, chanOpen := <-asyncHashQueue
@@ -252,8 +277,11 @@ func MakerFromConfig(
 				"codec IDs larger than 127 are not supported, however %d was supplied",
 				codecID,
 			)
-		} else if codecs[codecID].hashedCidLength == 0 {
-			initCodecMeta(&codecs[codecID], codecID, hashopts.multihashID, cidHashSize)
+		} else {
+			// makers are shared by the --multipart-parallel workers
+			codecsInit[codecID].Do(func() {
+				initCodecMeta(&codecs[codecID], codecID, hashopts.multihashID, cidHashSize)
+			})
 		}
 
 		hdr := &Header{
@@ -318,6 +346,29 @@ func MakerFromConfig(
 	return
 }
 
+// MultihashHasher returns a constructor of the hash function corresponding to
+// the given multihash id, as used when the respective CIDs were generated
+func MultihashHasher(multihashID uint) (hasherMaker func() hash.Hash, found bool) {
+	for _, name := range text.AvailableMapKeysList(AvailableHashers) {
+		if h := AvailableHashers[name]; h.hasherMaker != nil && h.multihashID == multihashID {
+			return h.hasherMaker, true
+		}
+	}
+	return nil, false
+}
+
+// HashedCidLength returns the length of a binary CIDv1 produced with the given
+// hash function and digest size, or 0 if the hash function is not known
+func HashedCidLength(hashAlg string, cidHashSize int) int {
+	hashopts, found := AvailableHashers[hashAlg]
+	if !found {
+		return 0
+	}
+	var cm codecMeta
+	initCodecMeta(&cm, CodecPB, hashopts.multihashID, cidHashSize)
+	return cm.hashedCidLength
+}
+
 type codecMeta struct {
 	hashedCidLength   int
 	hashedCidPrefix   []byte
@@ -0,0 +1,479 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
+)
+
+// https://ipld.io/specs/transport/car/carv2/#format-description
+const (
+	// a CARv1-header-lookalike, with a version of 2
+	carV2Pragma = "\x0A" + // 10 bytes of CBOR (encoded as varint)
+		"\xA1" + // map with 1 key
+		"\x67" + "version" + // text-key with length 7
+		"\x02" // 2
+
+	carV2HeaderSize = 40 // 16 bytes characteristics + 3 x uint64 LE offsets/sizes
+	carV2PrefixSize = int64(len(carV2Pragma) + carV2HeaderSize)
+
+	// https://github.com/multiformats/multicodec/blob/master/table.csv
+	carV2IndexMultihashSorted = 0x0401
+
+	// How many roots to reserve inner-header space for when the amount is not
+	// known upfront ( i.e. in --multipart mode ). When more roots than that are
+	// encountered, the entire data section is relocated at the end of processing
+	carV2ReserveRootsMultipart = 1024
+)
+
+type carBlockOffset struct {
+	cid    []byte
+	offset uint64 // relative to the start of the first block in the file
+}
+
+// State of a car-vN-file emitter, maintained by backgroundCarDataWriter
+// while blocks are streaming, and consumed by finalizeCarFile() at the end
+type carFileState struct {
+	out          io.WriteSeeker
+	version      int
+	blocksStart  int64
+	blocksSize   int64
+	blockOffsets []carBlockOffset // only tracked for CARv2
+
+	// the root of every stream in input order, repeated ones included, so
+	// that stream-undagger --multipart can reproduce the input in its entirety
+	streamRoots [][]byte
+}
+
+func (dgr *Dagger) setupCarFile(emitterName string, version int, out io.Writer) (argErrs []string) {
+
+	ws, isSeeker := out.(io.WriteSeeker)
+	if !isSeeker {
+		return []string{fmt.Sprintf("Emitter '%s' requires a seekable output", emitterName)}
+	}
+	if pos, err := ws.Seek(0, io.SeekCurrent); err != nil {
+		return []string{fmt.Sprintf("Emitter '%s' requires a seekable output: %s", emitterName, err)}
+	} else if pos != 0 {
+		return []string{fmt.Sprintf("Emitter '%s' requires an output positioned at its very start", emitterName)}
+	}
+
+	dgr.carFile = &carFileState{
+		out:     ws,
+		version: version,
+	}
+	dgr.carDataWriter = out
+
+	// Whether the block data may need to be moved once processing is complete,
+	// which in turn requires reading back what was written
+	var mayRelocate bool
+
+	if version == 1 {
+		// A CARv1 can not contain padding: reserve exactly as much space as the
+		// header with the single expected root will take. If a different header
+		// is needed in the end ( inlined root, no root, multiple roots ), the
+		// block data is relocated once processing is complete
+		dgr.carFile.blocksStart = int64(len(dgrblock.NulRootCarHeader))
+		mayRelocate = true
+		if cidLen := dgrblock.HashedCidLength(dgr.cfg.hashFunc, dgr.cfg.HashBits/8); cidLen > 0 &&
+			dgr.cfg.hashFunc != "none" &&
+			!dgr.cfg.MultipartStream {
+			dgr.carFile.blocksStart = int64(len(carV1Header(
+				append([][]byte{make([]byte, cidLen)}, dgr.recipeRoots()...),
+			)))
+			mayRelocate = (dgr.cfg.InlineMaxSize > 0 || dgr.cfg.SkipNulInputs)
+		}
+	} else {
+		// Reserve enough space for the inner header to accommodate the expected
+		// amount of worst-case-length roots: CIDv1 + 3-byte codec + 3-byte multihash
+		// id + 2-byte length + the digest itself. Only an unexpectedly large amount
+		// of roots results in a relocation
+		expectedRoots := 1
+		if dgr.cfg.MultipartStream {
+			expectedRoots = carV2ReserveRootsMultipart
+			mayRelocate = true
+		}
+		placeholderRoots := make([][]byte, expectedRoots)
+		for i := range placeholderRoots {
+			placeholderRoots[i] = make([]byte, 1+3+3+2+dgr.cfg.HashBits/8)
+		}
+		placeholderRoots = append(placeholderRoots, dgr.recipeRoots()...)
+		dgr.carFile.blocksStart = carV2PrefixSize + int64(len(carV1Header(placeholderRoots)))
+	}
+
+	if mayRelocate {
+		if err := canRelocate(out); err != nil {
+			return []string{fmt.Sprintf(
+				"Emitter '%s' may need to move the block data around once the roots are known, which requires an output opened read-write ( e.g. `1<> file.car` instead of `> file.car` ): %s",
+				emitterName,
+				err,
+			)}
+		}
+	}
+
+	return
+}
+
+// Probes the reading back relocateFileRange() will perform, and the
+// truncation a shrinking header requires
+func canRelocate(out io.Writer) error {
+	rwa, canRW := out.(interface {
+		io.ReaderAt
+		io.WriterAt
+	})
+	if !canRW {
+		return fmt.Errorf("output does not support positional reads and writes")
+	}
+	if _, canTruncate := out.(interface{ Truncate(int64) error }); !canTruncate {
+		return fmt.Errorf("output does not support truncation")
+	}
+	if _, err := rwa.ReadAt(make([]byte, 1), 0); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Cuts off anything past the end of what was written, e.g. leftovers of a
+// larger file the output was opened over. Only regular files are truncated
+func truncateOutput(out io.Writer, size int64) error {
+	if f, isFile := out.(*os.File); isFile {
+		if s, err := f.Stat(); err != nil || !s.Mode().IsRegular() {
+			return err
+		}
+	}
+	if t, canTruncate := out.(interface{ Truncate(int64) error }); canTruncate {
+		return t.Truncate(size)
+	}
+	return nil
+}
+
+func (dgr *Dagger) finalizeCarFile() error {
+	roots := append(dgr.carFile.streamRoots, dgr.recipeRoots()...)
+
+	if dgr.carFile.version == 1 {
+		return dgr.carFile.finalizeV1(roots)
+	}
+	return dgr.carFile.finalizeV2(roots)
+}
+
+// Writes out the header with the actual roots at the very start, moving the
+// block data around first if the reserved space does not match
+func (cf *carFileState) finalizeV1(roots [][]byte) (err error) {
+
+	carV1Hdr := carV1Header(roots)
+
+	if delta := int64(len(carV1Hdr)) - cf.blocksStart; delta != 0 {
+		if err = relocateFileRange(cf.out, cf.blocksStart, cf.blocksSize, delta); err != nil {
+			return fmt.Errorf(
+				"header with %d roots does not fit the reserved space, and relocating the block data failed (output must be opened read-write): %s",
+				len(roots),
+				err,
+			)
+		}
+		cf.blocksStart += delta
+	}
+
+	if err = truncateOutput(cf.out, cf.blocksStart+cf.blocksSize); err != nil {
+		return
+	}
+
+	if _, err = cf.out.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = cf.out.Write(carV1Hdr); err != nil {
+		return
+	}
+
+	_, err = cf.out.Seek(0, io.SeekEnd)
+	return
+}
+
+// Writes out the index past the end of the data, backfills the inner CARv1
+// header with the actual roots, and finally writes out the CARv2 header at the
+// very start
+func (cf *carFileState) finalizeV2(roots [][]byte) (err error) {
+
+	carV1Hdr := carV1Header(roots)
+
+	dataOffset := cf.blocksStart - int64(len(carV1Hdr))
+	if dataOffset < carV2PrefixSize {
+		shift := carV2PrefixSize - dataOffset
+		if err = relocateFileRange(cf.out, cf.blocksStart, cf.blocksSize, shift); err != nil {
+			return fmt.Errorf(
+				"reserved header space insufficient for %d roots, and relocating the block data failed (output must be opened read-write): %s",
+				len(roots),
+				err,
+			)
+		}
+		cf.blocksStart += shift
+		dataOffset = carV2PrefixSize
+	}
+	dataSize := int64(len(carV1Hdr)) + cf.blocksSize
+
+	if _, err = cf.out.Seek(dataOffset+dataSize, io.SeekStart); err != nil {
+		return
+	}
+	bw := bufio.NewWriterSize(cf.out, 1<<20)
+	if err = writeCarV2Index(bw, cf.blockOffsets, uint64(len(carV1Hdr))); err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	indexEnd, err := cf.out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	if err = truncateOutput(cf.out, indexEnd); err != nil {
+		return
+	}
+
+	if _, err = cf.out.Seek(dataOffset, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = cf.out.Write(carV1Hdr); err != nil {
+		return
+	}
+
+	hdr := make([]byte, len(carV2Pragma)+carV2HeaderSize)
+	copy(hdr, carV2Pragma)
+	// characteristics remain all-zero
+	binary.LittleEndian.PutUint64(hdr[len(carV2Pragma)+16:], uint64(dataOffset))
+	binary.LittleEndian.PutUint64(hdr[len(carV2Pragma)+24:], uint64(dataSize))
+	binary.LittleEndian.PutUint64(hdr[len(carV2Pragma)+32:], uint64(dataOffset+dataSize))
+
+	if _, err = cf.out.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = cf.out.Write(hdr); err != nil {
+		return
+	}
+
+	_, err = cf.out.Seek(0, io.SeekEnd)
+	return
+}
+
+// Serializes a CARv1 header (including its varint length prefix) listing the
+// supplied roots. When no roots are supplied the nul-identity root is used,
+// see the definition of NulRootCarHeader for a description of each byte.
+func carV1Header(roots [][]byte) []byte {
+	if len(roots) == 0 {
+		return []byte(dgrblock.NulRootCarHeader)
+	}
+
+	var rootsWiresize uint64
+	for _, r := range roots {
+		rootsWiresize += carV1RootWiresize(len(r))
+	}
+	cborLen := carV1HeaderCborWiresize(len(roots), rootsWiresize)
+
+	b := bytes.NewBuffer(make([]byte, 0, encoding.VarintWireSize(cborLen)+int(cborLen)))
+
+	// writes to a bytes.Buffer do not fail
+	b.Write(encoding.VarintSlice(cborLen))
+	b.WriteString("\xA2\x65roots")
+	encoding.CborHeaderWrite(b, 4, uint64(len(roots)))
+	for _, r := range roots {
+		b.Write([]byte{0xd8, 0x2a})
+		encoding.CborHeaderWrite(b, 2, uint64(1+len(r)))
+		b.WriteByte(0)
+		b.Write(r)
+	}
+	b.WriteString("\x67version\x01")
+
+	return b.Bytes()
+}
+
+// The total on-wire size of what carV1Header() would return for rootCount
+// roots with a combined carV1RootWiresize() of rootsWiresize
+func carV1HeaderWiresize(rootCount int, rootsWiresize uint64) int64 {
+	if rootCount == 0 {
+		return int64(len(dgrblock.NulRootCarHeader))
+	}
+	cborLen := carV1HeaderCborWiresize(rootCount, rootsWiresize)
+	return int64(encoding.VarintWireSize(cborLen)) + int64(cborLen)
+}
+
+func carV1HeaderCborWiresize(rootCount int, rootsWiresize uint64) uint64 {
+	return 7 + // map with 2 keys + text-key "roots"
+		uint64(encoding.CborHeaderWiresize(uint64(rootCount))) + // root array header
+		rootsWiresize +
+		9 // text-key "version" + 1
+}
+
+func carV1RootWiresize(cidLen int) uint64 {
+	return uint64(
+		2 + // prefixed tag 42
+			encoding.CborHeaderWiresize(uint64(cidLen)+1) + // that many raw bytes follow
+			1 + // the \x00 cid prefix
+			cidLen,
+	)
+}
+
+func (dgr *Dagger) seenRootCount() int {
+	return len(dgr.seenRoots) + len(dgr.seenInlinedRoots)
+}
+
+func (dgr *Dagger) sortedRootCids() [][]byte {
+	sortedRoots := make([]seenRoot, 0, dgr.seenRootCount())
+	for _, sr := range dgr.seenRoots {
+		sortedRoots = append(sortedRoots, sr)
+	}
+	for _, sr := range dgr.seenInlinedRoots {
+		sortedRoots = append(sortedRoots, sr)
+	}
+	sort.Slice(sortedRoots, func(i, j int) bool {
+		return sortedRoots[i].order < sortedRoots[j].order
+	})
+
+	cids := make([][]byte, len(sortedRoots))
+	for i := range sortedRoots {
+		cids[i] = sortedRoots[i].cid
+	}
+	return cids
+}
+
+// Writes a MultihashIndexSorted, the default index format of go-car:
+// varint codec, then int32 LE count of multihash functions, and for each
+// function in ascending order a uint64 LE multihash id, followed by an int32
+// LE count of digest widths. For each width in ascending order: uint32 LE
+// width (digest + 8), int64 LE size of the bucket in bytes, then the bucket
+// itself: digests in ascending byte-order each followed by its uint64 LE
+// offset relative to the start of the CARv1 data payload.
+func writeCarV2Index(w io.Writer, blocks []carBlockOffset, baseOffset uint64) (err error) {
+
+	type indexEntry struct {
+		digest []byte
+		offset uint64
+	}
+	buckets := make(map[uint64]map[int][]indexEntry)
+
+	for _, b := range blocks {
+		mhID, digest, err := cidMultihash(b.cid)
+		if err != nil {
+			return err
+		}
+		if buckets[mhID] == nil {
+			buckets[mhID] = make(map[int][]indexEntry)
+		}
+		buckets[mhID][len(digest)] = append(buckets[mhID][len(digest)], indexEntry{
+			digest: digest,
+			offset: baseOffset + b.offset,
+		})
+	}
+
+	var scratch [8]byte
+	writeLE := func(v uint64, size int) {
+		if err == nil {
+			binary.LittleEndian.PutUint64(scratch[:], v)
+			_, err = w.Write(scratch[:size])
+		}
+	}
+
+	if _, err = w.Write(encoding.VarintSlice(carV2IndexMultihashSorted)); err != nil {
+		return
+	}
+	writeLE(uint64(len(buckets)), 4)
+
+	mhIDs := make([]uint64, 0, len(buckets))
+	for id := range buckets {
+		mhIDs = append(mhIDs, id)
+	}
+	sort.Slice(mhIDs, func(i, j int) bool { return mhIDs[i] < mhIDs[j] })
+
+	for _, id := range mhIDs {
+		writeLE(id, 8)
+		writeLE(uint64(len(buckets[id])), 4)
+
+		widths := make([]int, 0, len(buckets[id]))
+		for w := range buckets[id] {
+			widths = append(widths, w)
+		}
+		sort.Ints(widths)
+
+		for _, width := range widths {
+			entries := buckets[id][width]
+			sort.Slice(entries, func(i, j int) bool {
+				return bytes.Compare(entries[i].digest, entries[j].digest) < 0
+			})
+
+			writeLE(uint64(width+8), 4)
+			writeLE(uint64(len(entries)*(width+8)), 8)
+			for _, e := range entries {
+				if err == nil {
+					_, err = w.Write(e.digest)
+				}
+				writeLE(e.offset, 8)
+			}
+		}
+	}
+
+	return
+}
+
+// Returns the multihash function id and the digest contained in a binary CID
+func cidMultihash(cid []byte) (mhID uint64, digest []byte, err error) {
+
+	// CIDv0 is a bare sha2-256 multihash
+	if len(cid) == 34 && cid[0] == 0x12 && cid[1] == 0x20 {
+		return 0x12, cid[2:], nil
+	}
+
+	rest := cid
+	var vals [4]uint64 // version, codec, multihash id, digest length
+	for i := range vals {
+		var n int
+		if vals[i], n = binary.Uvarint(rest); n <= 0 {
+			return 0, nil, fmt.Errorf("malformed CID 0x%X", cid)
+		}
+		rest = rest[n:]
+	}
+
+	if vals[0] != 1 || vals[3] != uint64(len(rest)) {
+		return 0, nil, fmt.Errorf("malformed CID 0x%X", cid)
+	}
+
+	return vals[2], rest, nil
+}
+
+// Moves the [start:start+length] range of a file by delta bytes, proceeding
+// from the far end of the move so that overlapping ranges are handled correctly
+func relocateFileRange(f io.Writer, start, length, delta int64) error {
+
+	rwa, canRW := f.(interface {
+		io.ReaderAt
+		io.WriterAt
+	})
+	if !canRW {
+		return fmt.Errorf("output does not support positional reads and writes")
+	}
+
+	buf := make([]byte, 4<<20)
+	for done := int64(0); done < length; {
+		n := int64(len(buf))
+		if length-done < n {
+			n = length - done
+		}
+
+		pos := start + done // moving towards the start: copy front to back
+		if delta > 0 {
+			pos = start + length - done - n // moving towards the end: copy back to front
+		}
+
+		if _, err := rwa.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		if _, err := rwa.WriteAt(buf[:n], pos+delta); err != nil {
+			return err
+		}
+		done += n
+	}
+
+	return nil
+}
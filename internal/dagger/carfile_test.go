@@ -0,0 +1,129 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A car-v1-file header must list the actual roots, whether the block data
+// could be written in its final place right away or had to be relocated.
+// Whatever the output held before must not survive past the end of the car
+func TestCarV1FileRoots(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+	payload := make([]byte, 3<<20+7)
+	rnd.Read(payload)
+
+	var multipart bytes.Buffer
+	for _, s := range [][]byte{payload, nil, payload[:20], payload, payload[:12345]} {
+		binary.Write(&multipart, binary.BigEndian, int64(len(s)))
+		multipart.Write(s)
+	}
+
+	stale := bytes.Repeat([]byte{0xFF}, 16<<20)
+
+	for _, tc := range []struct {
+		desc  string
+		args  []string
+		input []byte
+		roots int
+	}{
+		{"single root", nil, payload, 1},
+		{"inlined root", []string{"--inline-max-size=36"}, payload[:20], 1},
+		{"multipart roots", []string{"--multipart", "--inline-max-size=36"}, multipart.Bytes(), 5},
+	} {
+		args := append([]string{"--ipfs-add-compatible-command=--cid-version=1"}, tc.args...)
+
+		fh, err := ioutil.TempFile("", "dagger-test-")
+		if err != nil {
+			t.Fatalf("Unexpected tempfile error: %s", err)
+		}
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+		if _, err := fh.Write(stale); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("Unexpected seek error: %s", err)
+		}
+
+		var rootsJsonl bytes.Buffer
+		dgr, err := NewFromArgvNoExit(
+			append([]string{"dolphin-dongs"}, args...),
+			map[string]io.Writer{emCarV1File: fh, emRootsJsonl: &rootsJsonl},
+		)
+		if err != nil {
+			t.Fatalf("%s: unexpected initialization error: %s", tc.desc, err)
+		}
+		if err := dgr.ProcessReader(bytes.NewReader(tc.input), nil); err != nil {
+			t.Fatalf("%s: unexpected stream processing error: %s", tc.desc, err)
+		}
+		dgr.Destroy()
+
+		var roots [][]byte
+		for _, c := range testRootCids(t, rootsJsonl.Bytes()) {
+			b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(c[1:]))
+			if err != nil {
+				t.Fatalf("%s: unexpected CID decoding error: %s", tc.desc, err)
+			}
+			roots = append(roots, b)
+		}
+		if len(roots) != tc.roots {
+			t.Fatalf("%s: expected %d roots, got %d", tc.desc, tc.roots, len(roots))
+		}
+
+		car, err := ioutil.ReadFile(fh.Name())
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+
+		// the header length prefix is included, sections omit it
+		expectedHdr := carV1Header(roots)
+		_, n := binary.Uvarint(expectedHdr)
+		if sections := testCarSections(t, car); !bytes.Equal(sections[0], expectedHdr[n:]) {
+			t.Fatalf("%s: car header\n%X\ndoes not match the expected\n%X", tc.desc, sections[0], expectedHdr[n:])
+		}
+	}
+}
+
+// Outputs that can not be written as needed are rejected before any input is
+// processed
+func TestCarFileOutputRejected(t *testing.T) {
+
+	wo, err := ioutil.TempFile("", "dagger-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempfile error: %s", err)
+	}
+	defer os.Remove(wo.Name())
+	wo.Close()
+	if wo, err = os.OpenFile(wo.Name(), os.O_WRONLY, 0); err != nil {
+		t.Fatalf("Unexpected open error: %s", err)
+	}
+	defer wo.Close()
+
+	for _, tc := range []struct {
+		emitter  string
+		out      io.Writer
+		expected string
+	}{
+		{emCarV1File, new(bytes.Buffer), "requires a seekable output"},
+		{emCarV2File, new(bytes.Buffer), "requires a seekable output"},
+		{emCarV1File, wo, "requires an output opened read-write"},
+		{emCarV2File, wo, "requires an output opened read-write"},
+	} {
+		_, err := NewFromArgvNoExit(
+			[]string{"dolphin-dongs", "--ipfs-add-compatible-command=--cid-version=1", "--multipart"},
+			map[string]io.Writer{tc.emitter: tc.out},
+		)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s to %T: expected an initialization error containing '%s', got: %v", tc.emitter, tc.out, tc.expected, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package dagger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ribasushi/DAGger/internal/constants"
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+)
+
+// State of the car-split-manifest-jsonl emitter. Only ever accessed from
+// within backgroundCarDataWriter, and from finalizeCarSplit() after it exited
+type carSplitState struct {
+	pathTemplate string
+	maxBytes     int64
+	rootCidLen   int
+
+	cur              *carFileState
+	curIdx           int
+	curRoots         [][]byte
+	curRootsWiresize uint64
+
+	// a root already completed in a previous file is not listed again
+	completedIn map[[seenHashSize]byte]int
+}
+
+// Tracks the blocks of each stream on their way into the split .car files, so
+// that a root can be declared complete without waiting on the processing of
+// any subsequent stream. Only accessed from the ingestion loop, except where
+// noted otherwise
+type carSplitStreams struct {
+	cur      *carSplitStream
+	prevRoot chan struct{} // closed once the root of the preceding stream is queued
+
+	// blocks queued for writing but not yet written, under dgr.mu
+	inFlight map[[seenHashSize]byte]*carSplitClaim
+}
+
+type carSplitStream struct {
+	pending  sync.WaitGroup // postProcessBlock() invocations still running
+	firstIdx int            // first file receiving a new block of the stream, under dgr.mu
+}
+
+// A block claimed by the first stream to observe it. Other streams referring
+// to it wait until it is written, in order to learn which file it ended up in
+type carSplitClaim struct {
+	key     [seenHashSize]byte
+	stream  *carSplitStream
+	fileIdx int
+	written chan struct{}
+}
+
+func newCarSplitStream() *carSplitStream {
+	return &carSplitStream{firstIdx: -1}
+}
+
+// Invoked under dgr.mu
+func (s *carSplitStream) noteFile(idx int) {
+	if s.firstIdx < 0 || idx < s.firstIdx {
+		s.firstIdx = idx
+	}
+}
+
+// Accounts for a postProcessBlock() about to be started, returning the stream
+// it belongs to. A nil return means no car splitting is taking place
+func (dgr *Dagger) carSplitTrackBlock() *carSplitStream {
+	if dgr.carSplitStreams == nil {
+		return nil
+	}
+	s := dgr.carSplitStreams.cur
+	s.pending.Add(1)
+	return s
+}
+
+// Queues the marker declaring a stream complete once all of its blocks made it
+// into the queue ahead of it. The waiting happens in the background, so that
+// the next stream can proceed meanwhile, yet the markers retain stream order
+func (dgr *Dagger) carSplitQueueRoot(root *dgrblock.Header, streamNum int64) {
+	css := dgr.carSplitStreams
+
+	s, prevRoot, rootQueued := css.cur, css.prevRoot, make(chan struct{})
+	css.cur, css.prevRoot = newCarSplitStream(), rootQueued
+
+	dgr.asyncWG.Add(1)
+	go func() {
+		defer dgr.asyncWG.Done()
+		defer close(rootQueued)
+
+		s.pending.Wait()
+		if prevRoot != nil {
+			<-prevRoot
+		}
+		dgr.carDataQueue <- carUnit{
+			streamRoot:  root,
+			streamNum:   streamNum,
+			splitStream: s,
+		}
+	}()
+}
+
+// Invoked by backgroundCarDataWriter once a claimed block is written
+func (dgr *Dagger) carSplitBlockWritten(c *carSplitClaim) {
+	dgr.mu.Lock()
+	c.fileIdx = dgr.carSplit.curIdx
+	c.stream.noteFile(c.fileIdx)
+	delete(dgr.carSplitStreams.inFlight, c.key)
+	dgr.mu.Unlock()
+	close(c.written)
+}
+
+func (dgr *Dagger) setupCarSplit() (argErrs []string) {
+	cfg := &dgr.cfg
+
+	if !cfg.optSet.IsSet("car-split-path-template") {
+		argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' requires a --car-split-path-template", emCarSplitManifest))
+	} else if strings.Count(strings.ReplaceAll(cfg.CarSplitPathTemplate, "%%", ""), "%") != 1 ||
+		strings.Contains(fmt.Sprintf(cfg.CarSplitPathTemplate, 0), "%!") {
+		argErrs = append(argErrs, fmt.Sprintf(
+			"The value of --car-split-path-template '%s' must contain exactly one integer verb, e.g. 'out_%%04d.car'",
+			cfg.CarSplitPathTemplate,
+		))
+	}
+
+	if cfg.MultipartPaths || cfg.TarDirectoryRoot {
+		argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' can not be combined with --multipart-paths or --tar-directory-root", emCarSplitManifest))
+	}
+
+	// a file must comfortably accommodate at least one block of max size
+	minSize := int64(2 * (constants.MaxBlockWireSize + 1))
+	if !cfg.optSet.IsSet("car-split-max-bytes") {
+		argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' requires a --car-split-max-bytes", emCarSplitManifest))
+	} else if cfg.CarSplitMaxBytes < minSize {
+		argErrs = append(argErrs, fmt.Sprintf(
+			"The value of --car-split-max-bytes must be at least %d",
+			minSize,
+		))
+	}
+
+	if len(argErrs) > 0 {
+		return
+	}
+
+	dgr.carSplit = &carSplitState{
+		pathTemplate: cfg.CarSplitPathTemplate,
+		maxBytes:     cfg.CarSplitMaxBytes,
+		rootCidLen:   dgrblock.HashedCidLength(cfg.hashFunc, cfg.HashBits/8),
+		curIdx:       -1,
+		completedIn:  make(map[[seenHashSize]byte]int),
+	}
+	dgr.carSplitStreams = &carSplitStreams{
+		cur:      newCarSplitStream(),
+		inFlight: make(map[[seenHashSize]byte]*carSplitClaim),
+	}
+
+	return
+}
+
+// Called by backgroundCarDataWriter before writing a block: rolls over to a
+// new file if the block along with a possible additional root would not fit
+func (dgr *Dagger) carSplitReserve(blockWiresize int64) error {
+	cs := dgr.carSplit
+
+	if cs.cur != nil && cs.projectedSize(blockWiresize, 1) > cs.maxBytes {
+		if err := dgr.carSplitFinalizeCurrent(); err != nil {
+			return err
+		}
+	}
+
+	if cs.cur == nil {
+		if err := dgr.carSplitOpenNext(); err != nil {
+			return err
+		}
+		if cs.projectedSize(blockWiresize, 1) > cs.maxBytes {
+			return fmt.Errorf(
+				"block of %d bytes does not fit within --car-split-max-bytes %d",
+				blockWiresize,
+				cs.maxBytes,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Called by backgroundCarDataWriter once every block of a stream has been
+// written: lists the root in the current file and emits a manifest entry
+func (dgr *Dagger) carSplitAddRoot(root *dgrblock.Header, streamNum int64, s *carSplitStream) (err error) {
+	cs := dgr.carSplit
+
+	sk := seenKey(root)
+	idx, completed := cs.completedIn[*sk]
+	if !completed {
+
+		// Only possible when the stream did not introduce any new blocks
+		if cs.cur == nil || cs.projectedSize(0, 1) > cs.maxBytes {
+			if cs.cur != nil {
+				if err = dgr.carSplitFinalizeCurrent(); err != nil {
+					return
+				}
+			}
+			if err = dgr.carSplitOpenNext(); err != nil {
+				return
+			}
+		}
+
+		cs.curRoots = append(cs.curRoots, root.Cid())
+		cs.curRootsWiresize += carV1RootWiresize(len(root.Cid()))
+		cs.completedIn[*sk] = cs.curIdx
+		idx = cs.curIdx
+	}
+
+	firstIdx := idx
+	dgr.mu.Lock()
+	if s.firstIdx >= 0 {
+		firstIdx = s.firstIdx
+	}
+	dgr.mu.Unlock()
+
+	_, err = fmt.Fprintf(
+		dgr.cfg.emitters[emCarSplitManifest],
+		"{\"event\":\"carRoot\", \"stream\":%d, \"cid\":\"%s\", \"carFirst\":%d, \"car\":%d, \"carFile\":%q }\n",
+		streamNum,
+		dgr.formattedCid(root),
+		firstIdx,
+		idx,
+		fmt.Sprintf(cs.pathTemplate, idx),
+	)
+	return
+}
+
+func (dgr *Dagger) carSplitOpenNext() error {
+	cs := dgr.carSplit
+
+	cs.curIdx++
+	fh, err := os.OpenFile(
+		fmt.Sprintf(cs.pathTemplate, cs.curIdx),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Same as a car-v1-file: reserve exactly enough for a single root, and
+	// relocate the block data on finalization if that is not what we got
+	cs.cur = &carFileState{
+		out:         fh,
+		version:     1,
+		blocksStart: carV1HeaderWiresize(1, carV1RootWiresize(cs.rootCidLen)),
+	}
+	cs.curRoots = nil
+	cs.curRootsWiresize = 0
+
+	if _, err = fh.Seek(cs.cur.blocksStart, io.SeekStart); err != nil {
+		return err
+	}
+
+	dgr.carDataWriter = fh
+	return nil
+}
+
+func (cs *carSplitState) projectedSize(extraBlockWiresize int64, extraRoots int) int64 {
+	return carV1HeaderWiresize(
+		len(cs.curRoots)+extraRoots,
+		cs.curRootsWiresize+uint64(extraRoots)*carV1RootWiresize(cs.rootCidLen),
+	) + cs.cur.blocksSize + extraBlockWiresize
+}
+
+// Completes the current file, and lists it in the manifest: a file may well
+// not contain any roots, yet be needed to resolve the roots of later ones
+func (dgr *Dagger) carSplitFinalizeCurrent() error {
+	cs := dgr.carSplit
+
+	err := cs.cur.finalizeV1(cs.curRoots)
+	if closeErr := cs.cur.out.(*os.File).Close(); err == nil {
+		err = closeErr
+	}
+	cs.cur = nil
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(
+		dgr.cfg.emitters[emCarSplitManifest],
+		"{\"event\":\"carFile\", \"car\":%d, \"carFile\":%q, \"roots\":%d }\n",
+		cs.curIdx,
+		fmt.Sprintf(cs.pathTemplate, cs.curIdx),
+		len(cs.curRoots),
+	)
+	return err
+}
+
+// Invoked after the data writer has shut down
+func (dgr *Dagger) finalizeCarSplit(success bool) error {
+	cs := dgr.carSplit
+	if cs.cur == nil {
+		return nil
+	}
+	if !success {
+		return cs.cur.out.(*os.File).Close()
+	}
+	return dgr.carSplitFinalizeCurrent()
+}
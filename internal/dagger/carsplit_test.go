@@ -0,0 +1,137 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Every stream must be listed in the split manifest, in order and with the
+// same root as in roots-jsonl, pointing at a file whose header contains that
+// root. Every file written must be listed as well, and stay within the limit
+func TestCarSplitManifest(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dagger-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempdir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rnd := rand.New(rand.NewSource(42))
+	streams := make([][]byte, 3)
+	for i, size := range []int{6 << 20, 5<<20 + 3, 123} {
+		streams[i] = make([]byte, size)
+		rnd.Read(streams[i])
+	}
+
+	var input bytes.Buffer
+	for _, s := range [][]byte{streams[0], nil, streams[1], streams[2], streams[0], nil, streams[2]} {
+		binary.Write(&input, binary.BigEndian, int64(len(s)))
+		input.Write(s)
+	}
+
+	const maxBytes = 4194304
+	out := testRun(
+		t,
+		[]string{
+			"--ipfs-add-compatible-command=--cid-version=1",
+			"--multipart",
+			"--car-split-max-bytes=" + strconv.Itoa(maxBytes),
+			"--car-split-path-template=" + filepath.Join(dir, "out_%02d.car"),
+		},
+		bytes.NewReader(input.Bytes()),
+		emCarSplitManifest, emRootsJsonl,
+	)
+
+	type manifestEntry struct {
+		Event    string
+		Stream   int64
+		Cid      string
+		CarFirst int
+		Car      int
+		CarFile  string
+		Roots    int
+	}
+	var carRoots, carFiles []manifestEntry
+	s := bufio.NewScanner(bytes.NewReader(out[emCarSplitManifest]))
+	for s.Scan() {
+		var e manifestEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("Unexpected manifest unmarshal error: %s", err)
+		}
+		switch e.Event {
+		case "carRoot":
+			carRoots = append(carRoots, e)
+		case "carFile":
+			carFiles = append(carFiles, e)
+		default:
+			t.Fatalf("Unexpected manifest event '%s'", e.Event)
+		}
+	}
+
+	if len(carFiles) < 3 {
+		t.Fatalf("Expected the input to be split over at least 3 files, got %d", len(carFiles))
+	}
+	if written, _ := filepath.Glob(filepath.Join(dir, "out_*.car")); len(written) != len(carFiles) {
+		t.Fatalf("Manifest lists %d files, while %d were written", len(carFiles), len(written))
+	}
+
+	headers := make([][]byte, len(carFiles))
+	for i, f := range carFiles {
+		if f.Car != i {
+			t.Fatalf("Manifest lists file #%d in position %d", f.Car, i)
+		}
+		car, err := ioutil.ReadFile(f.CarFile)
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+		if len(car) > maxBytes {
+			t.Fatalf("File %s is %d bytes, over the limit of %d", f.CarFile, len(car), maxBytes)
+		}
+		headers[i] = testCarSections(t, car)[0]
+	}
+
+	roots := testRootCids(t, out[emRootsJsonl])
+	if len(carRoots) != len(roots) {
+		t.Fatalf("Manifest lists %d roots, while %d streams were processed", len(carRoots), len(roots))
+	}
+
+	rootsPerFile := make([]int, len(carFiles))
+	seen := make(map[string]struct{}, len(roots))
+	for i, r := range carRoots {
+		if r.Stream != int64(i+1) || r.Cid != roots[i] {
+			t.Fatalf("Manifest root #%d is stream %d %s, expected stream %d %s", i, r.Stream, r.Cid, i+1, roots[i])
+		}
+		if r.Car < 0 || r.Car >= len(carFiles) || r.CarFirst > r.Car || r.CarFile != carFiles[r.Car].CarFile {
+			t.Fatalf("Manifest root of stream %d points at car #%d %s, first #%d", r.Stream, r.Car, r.CarFile, r.CarFirst)
+		}
+
+		cid, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(r.Cid[1:]))
+		if err != nil {
+			t.Fatalf("Unexpected CID decoding error: %s", err)
+		}
+		if !bytes.Contains(headers[r.Car], cid) {
+			t.Fatalf("Root %s of stream %d is not listed in the header of %s", r.Cid, r.Stream, r.CarFile)
+		}
+
+		if _, dup := seen[r.Cid]; !dup {
+			seen[r.Cid] = struct{}{}
+			rootsPerFile[r.Car]++
+		}
+	}
+
+	for i, f := range carFiles {
+		if f.Roots != rootsPerFile[i] {
+			t.Fatalf("Manifest lists %d roots for %s, expected %d", f.Roots, f.CarFile, rootsPerFile[i])
+		}
+	}
+}
@@ -70,6 +70,9 @@ func NewChunker(
 	return &c, dgrchunker.InstanceConstants{
 		MinChunkSize: c.MinSize,
 		MaxChunkSize: c.MaxSize,
+		Identities: map[string]string{
+			"hash-table": dgrchunker.TableDigest(c.xv),
+		},
 	}, initErrs
 }
 
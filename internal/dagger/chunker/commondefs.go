@@ -1,6 +1,10 @@
 package dgrchunker
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
 	"github.com/ribasushi/DAGger/chunker"
 	"github.com/ribasushi/DAGger/internal/constants"
 )
@@ -9,12 +13,24 @@ type InstanceConstants struct {
 	_            constants.Incomparabe
 	MinChunkSize int
 	MaxChunkSize int
+
+	// Whatever determines the chunk boundaries beyond the options themselves,
+	// e.g. digests of lookup tables selected by name. Recorded in the recipe
+	Identities map[string]string
 }
 
 type DaggerConfig struct {
 	IsLastInChain bool
 }
 
+// ZeroRangeHinter is optionally implemented by chunkers able to skip over
+// ranges of the buffer known to consist of zeros, e.g. the holes of a sparse
+// input file. The [start, end) ranges are sorted and relative to the buffer of
+// the very next Split() call, and must not alter the resulting chunks
+type ZeroRangeHinter interface {
+	HintZeroRanges(ranges [][2]int)
+}
+
 type Initializer func(
 	chunkerCLISubArgs []string,
 	cfg *DaggerConfig,
@@ -23,3 +39,13 @@ type Initializer func(
 	constants InstanceConstants,
 	initErrorStrings []string,
 )
+
+// TableDigest returns the sha2-256 of a fixed-size lookup table, serialized
+// as a sequence of big-endian integers
+func TableDigest(table interface{}) string {
+	h := sha256.New()
+	if err := binary.Write(h, binary.BigEndian, table); err != nil {
+		return ""
+	}
+	return "sha2-256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,63 @@
+package compressedblocks
+
+import (
+	"fmt"
+
+	"github.com/ribasushi/DAGger/chunker"
+	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/DAGger/internal/dagger/util/argparser"
+)
+
+func NewChunker(
+	args []string,
+	dgrCfg *dgrchunker.DaggerConfig,
+) (
+	_ chunker.Chunker,
+	_ dgrchunker.InstanceConstants,
+	initErrs []string,
+) {
+
+	c := compressedBlocksChunker{}
+
+	optSet := getopt.New()
+	if err := options.RegisterSet("", &c.config, optSet); err != nil {
+		initErrs = []string{fmt.Sprintf("option set registration failed: %s", err)}
+		return
+	}
+
+	// on nil-args the "error" is the help text to be incorporated into
+	// the larger help display
+	if args == nil {
+		initErrs = argparser.SubHelp(
+			"Chunker for gzip and zstd compressed streams (concatenations of gzip\n"+
+				"members and/or zstd frames), cutting at the ends of the deflate and\n"+
+				"zstd blocks, as determined by parsing the compressed framing. Combined\n"+
+				"with 'gzip --rsyncable' or 'zstd --rsyncable' the cuts line up with where\n"+
+				"the compressor resets its state, so that two versions of a compressed\n"+
+				"file deduplicate. Deflate block ends are rounded up to the next byte.\n"+
+				"Input that is not recognized, or can no longer be followed, is split\n"+
+				"at max-size.",
+			optSet,
+		)
+		return
+	}
+
+	// bail early if getopt fails
+	if initErrs = argparser.Parse(args, optSet); len(initErrs) > 0 {
+		return
+	}
+
+	if c.MinSize >= c.MaxSize {
+		initErrs = append(initErrs,
+			"value for 'max-size' must be larger than 'min-size'",
+		)
+	}
+
+	return &c, dgrchunker.InstanceConstants{
+		MinChunkSize: c.MinSize,
+		MaxChunkSize: c.MaxSize,
+	}, initErrs
+}
@@ -0,0 +1,98 @@
+package compressedblocks
+
+import (
+	"github.com/ribasushi/DAGger/chunker"
+)
+
+type config struct {
+	MaxSize    int  `getopt:"--max-size=[1:MaxPayload] Maximum data chunk size, also the size of every chunk past the point the input can no longer be parsed"`
+	MinSize    int  `getopt:"--min-size=[0:MaxPayload] Minimum data chunk size"`
+	ResetsOnly bool `getopt:"--resets-only             Only cut where the compressor state was reset: at a deflate block ending on a byte boundary (a sync/full flush, or the padding of 'gzip --rsyncable') or at the end of a gzip member or zstd frame. Note that 'zstd --rsyncable' resets at block boundaries within a frame: leave this unset for it"`
+}
+
+type compressedBlocksChunker struct {
+	config
+
+	// The framing is parsed one block at a time, and blocks are not aligned to
+	// the chunks, nor to the buffers passed to Split(). This is where parsing
+	// resumes on the next call, with pos relative to the start of its buffer.
+	// Reset at the end of every stream
+	state parser
+}
+
+func (c *compressedBlocksChunker) Split(
+	buf []byte,
+	useEntireBuffer bool,
+	cb chunker.SplitResultCallback,
+) (err error) {
+
+	var lastIdx int
+	emit := func(idx int) error {
+		size := idx - lastIdx
+		lastIdx = idx
+		return cb(chunker.Chunk{Size: size})
+	}
+
+	// a buffer used in its entirety is the end of the stream
+	defer func() {
+		if useEntireBuffer || err != nil {
+			c.state = parser{}
+		}
+	}()
+
+	p := c.state
+	p.buf = buf
+
+	for !p.lost {
+
+		checkpoint := p
+		end, isCandidate, isReset, unitErr := p.nextUnit()
+
+		if unitErr == errNeedMore {
+			if !useEntireBuffer && lastIdx > 0 {
+				c.state = checkpoint
+				c.state.buf = nil
+				c.state.pos -= lastIdx
+				return nil
+			}
+			if useEntireBuffer && checkpoint.atStreamEnd() {
+				break
+			}
+		}
+
+		// truncated, unrecognized or corrupted: size cap from here on
+		if unitErr != nil {
+			p.lost = true
+			break
+		}
+
+		if !isCandidate {
+			continue
+		}
+
+		for end-lastIdx > c.MaxSize {
+			if err = emit(lastIdx + c.MaxSize); err != nil {
+				return
+			}
+		}
+
+		if end-lastIdx >= c.MinSize && end > lastIdx && (isReset || !c.ResetsOnly) {
+			if err = emit(end); err != nil {
+				return
+			}
+		}
+	}
+
+	for len(buf)-lastIdx >= c.MaxSize {
+		if err = emit(lastIdx + c.MaxSize); err != nil {
+			return
+		}
+	}
+
+	if useEntireBuffer && len(buf) > lastIdx {
+		return emit(len(buf))
+	}
+
+	c.state = parser{lost: p.lost}
+	return
+}
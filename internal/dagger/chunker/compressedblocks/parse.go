@@ -0,0 +1,421 @@
+package compressedblocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Where within the compressed stream the parser is
+const (
+	withinNothing = iota // between gzip members / zstd frames
+	withinDeflate
+	withinZstd
+)
+
+var (
+	errNeedMore = errors.New("insufficient data")
+
+	gzipMagic          = []byte{0x1F, 0x8B, 0x08}
+	zstdMagic          = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	zstdSkippableMagic = []byte{0x2A, 0x4D, 0x18} // preceded by 0x50 ~ 0x5F
+)
+
+// A parse failure unwinds nextUnit() via panic(), sparing an error check on
+// every single bit read
+type parseFailure struct{ err error }
+
+func fail(format string, args ...interface{}) {
+	panic(parseFailure{fmt.Errorf(format, args...)})
+}
+
+// Copied by value: a copy taken before a unit is a checkpoint to resume from
+type parser struct {
+	buf    []byte
+	pos    int
+	bitBuf uint32
+	bitCnt uint // always < 8 between units: the remainder of buf[pos-1]
+
+	within       int
+	zstdChecksum bool
+	lost         bool
+}
+
+func (p *parser) atStreamEnd() bool {
+	return p.within == withinNothing && p.pos == len(p.buf)
+}
+
+// Parses the next self-contained unit: a container header, a deflate block or
+// a zstd block (together with the member/frame trailer following the last
+// one), or a skippable frame. Returns the offset right past the unit, and
+// whether it is a chunk boundary candidate and whether the compressor state
+// was reset at that point
+func (p *parser) nextUnit() (end int, isCandidate, isReset bool, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			pf, isParseFailure := r.(parseFailure)
+			if !isParseFailure {
+				panic(r)
+			}
+			err = pf.err
+		}
+	}()
+
+	switch p.within {
+
+	case withinNothing:
+		if p.pos == len(p.buf) {
+			return 0, false, false, errNeedMore
+		}
+		magic := p.peek(4)
+
+		if bytes.HasPrefix(magic, gzipMagic) {
+			p.gzipHeader()
+			p.within = withinDeflate
+			return p.pos, false, false, nil
+		}
+
+		if bytes.Equal(magic, zstdMagic) {
+			p.zstdFrameHeader()
+			p.within = withinZstd
+			return p.pos, false, false, nil
+		}
+
+		if magic[0]&0xF0 == 0x50 && bytes.Equal(magic[1:], zstdSkippableMagic) {
+			p.skip(4)
+			p.skip(int(binary.LittleEndian.Uint32(p.take(4))))
+			return p.pos, true, true, nil
+		}
+
+		fail("unrecognized compression format magic 0x%X", magic)
+
+	case withinDeflate:
+		isFinal := p.deflateBlock()
+		isReset = (p.bitCnt == 0)
+		if isFinal {
+			// CRC32 and ISIZE
+			p.align()
+			p.skip(8)
+			p.within = withinNothing
+			isReset = true
+		}
+		return p.pos, true, isReset, nil
+
+	case withinZstd:
+		if isLast := p.zstdBlock(); isLast {
+			if p.zstdChecksum {
+				p.skip(4)
+			}
+			p.within = withinNothing
+			return p.pos, true, true, nil
+		}
+		return p.pos, true, false, nil
+	}
+
+	return
+}
+
+//
+// Byte-level access, only valid on a byte boundary
+//
+
+func (p *parser) peek(n int) []byte {
+	if len(p.buf)-p.pos < n {
+		panic(parseFailure{errNeedMore})
+	}
+	return p.buf[p.pos : p.pos+n]
+}
+
+func (p *parser) take(n int) []byte {
+	b := p.peek(n)
+	p.pos += n
+	return b
+}
+
+func (p *parser) skip(n int) {
+	if len(p.buf)-p.pos < n {
+		panic(parseFailure{errNeedMore})
+	}
+	p.pos += n
+}
+
+// Bit-level access, LSB first. Bytes are loaded only as needed, so that on a
+// block boundary at most the remaining bits of the previous byte are held
+func (p *parser) bits(n uint) uint32 {
+	for p.bitCnt < n {
+		if p.pos == len(p.buf) {
+			panic(parseFailure{errNeedMore})
+		}
+		p.bitBuf |= uint32(p.buf[p.pos]) << p.bitCnt
+		p.pos++
+		p.bitCnt += 8
+	}
+	v := p.bitBuf & (1<<n - 1)
+	p.bitBuf >>= n
+	p.bitCnt -= n
+	return v
+}
+
+func (p *parser) align() {
+	p.bitBuf = 0
+	p.bitCnt = 0
+}
+
+//
+// gzip (RFC1952) and deflate (RFC1951)
+//
+
+func (p *parser) gzipHeader() {
+	const (
+		fHcrc     = 1 << 1
+		fExtra    = 1 << 2
+		fName     = 1 << 3
+		fComment  = 1 << 4
+		fReserved = 0xE0
+	)
+
+	hdr := p.take(10)
+	flags := hdr[3]
+	if flags&fReserved != 0 {
+		fail("reserved gzip header flags 0x%02X set", flags)
+	}
+
+	if flags&fExtra != 0 {
+		p.skip(int(binary.LittleEndian.Uint16(p.take(2))))
+	}
+	for _, f := range []byte{fName, fComment} {
+		if flags&f != 0 {
+			for p.take(1)[0] != 0 {
+			}
+		}
+	}
+	if flags&fHcrc != 0 {
+		p.skip(2)
+	}
+}
+
+func (p *parser) deflateBlock() (isFinal bool) {
+
+	isFinal = (p.bits(1) == 1)
+
+	switch p.bits(2) {
+	case 0:
+		p.align()
+		lens := p.take(4)
+		l := binary.LittleEndian.Uint16(lens)
+		if l != ^binary.LittleEndian.Uint16(lens[2:]) {
+			fail("stored deflate block length mismatch")
+		}
+		p.skip(int(l))
+	case 1:
+		p.deflateCodes(&fixedLitLen, &fixedDist)
+	case 2:
+		var litLen, dist huffman
+		p.deflateDynamicTables(&litLen, &dist)
+		p.deflateCodes(&litLen, &dist)
+	default:
+		fail("invalid deflate block type")
+	}
+
+	return
+}
+
+// Canonical huffman code, decoded one bit at a time as in zlib's puff.c
+type huffman struct {
+	count  [16]uint16 // amount of codes of each length
+	symbol [288]uint16
+}
+
+func (h *huffman) build(lengths []uint8) {
+	*h = huffman{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+
+	left := 1
+	for l := 1; l < 16; l++ {
+		left = left<<1 - int(h.count[l])
+		if left < 0 {
+			fail("over-subscribed deflate huffman code")
+		}
+	}
+
+	var offs [16]uint16
+	for l := 1; l < 15; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+}
+
+func (p *parser) decode(h *huffman) int {
+	var code, first, index int
+	for l := 1; l < 16; l++ {
+		code |= int(p.bits(1))
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+code-first])
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	fail("invalid deflate huffman code")
+	return -1
+}
+
+var (
+	lengthExtraBits = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distExtraBits   = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLitLen, fixedDist huffman
+)
+
+func init() {
+	var l [288]uint8
+	for i := range l {
+		switch {
+		case i < 144:
+			l[i] = 8
+		case i < 256:
+			l[i] = 9
+		case i < 280:
+			l[i] = 7
+		default:
+			l[i] = 8
+		}
+	}
+	fixedLitLen.build(l[:])
+
+	var d [30]uint8
+	for i := range d {
+		d[i] = 5
+	}
+	fixedDist.build(d[:])
+}
+
+// Only the bit lengths of the codes matter: literals are skipped, and back
+// references are not followed
+func (p *parser) deflateCodes(litLen, dist *huffman) {
+	for {
+		sym := p.decode(litLen)
+		switch {
+		case sym < 256:
+			continue
+		case sym == 256:
+			return
+		case sym > 285:
+			fail("invalid deflate length symbol %d", sym)
+		}
+		p.bits(lengthExtraBits[sym-257])
+
+		dsym := p.decode(dist)
+		if dsym > 29 {
+			fail("invalid deflate distance symbol %d", dsym)
+		}
+		p.bits(distExtraBits[dsym])
+	}
+}
+
+func (p *parser) deflateDynamicTables(litLen, dist *huffman) {
+
+	nLen := int(p.bits(5)) + 257
+	nDist := int(p.bits(5)) + 1
+	nCode := int(p.bits(4)) + 4
+	if nLen > 286 || nDist > 30 {
+		fail("invalid deflate dynamic block code counts")
+	}
+
+	var lengths [286 + 30]uint8
+	for i := 0; i < nCode; i++ {
+		lengths[codeLengthOrder[i]] = uint8(p.bits(3))
+	}
+	var lenCode huffman
+	lenCode.build(lengths[:19])
+
+	for i := range lengths[:19] {
+		lengths[i] = 0
+	}
+
+	for i := 0; i < nLen+nDist; {
+		sym := p.decode(&lenCode)
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var val uint8
+		var rep int
+		switch sym {
+		case 16:
+			if i == 0 {
+				fail("deflate length repeat without a previous length")
+			}
+			val = lengths[i-1]
+			rep = 3 + int(p.bits(2))
+		case 17:
+			rep = 3 + int(p.bits(3))
+		default:
+			rep = 11 + int(p.bits(7))
+		}
+		if i+rep > nLen+nDist {
+			fail("too many deflate code lengths")
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = val
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		fail("deflate dynamic block without an end-of-block code")
+	}
+
+	litLen.build(lengths[:nLen])
+	dist.build(lengths[nLen : nLen+nDist])
+}
+
+//
+// zstd (RFC8878)
+//
+
+func (p *parser) zstdFrameHeader() {
+	p.skip(4)
+	fhd := p.take(1)[0]
+	if fhd&0x08 != 0 {
+		fail("reserved zstd frame header bit set")
+	}
+	p.zstdChecksum = (fhd&0x04 != 0)
+
+	n := []int{0, 1, 2, 4}[fhd&0x03] + []int{0, 2, 4, 8}[fhd>>6]
+	if fhd&0x20 == 0 {
+		n++ // window descriptor
+	} else if fhd>>6 == 0 {
+		n++ // single-byte content size
+	}
+	p.skip(n)
+}
+
+func (p *parser) zstdBlock() (isLast bool) {
+	b := p.take(3)
+	bh := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+
+	switch (bh >> 1) & 3 {
+	case 1: // RLE: a single byte repeated size times
+		p.skip(1)
+	case 3:
+		fail("reserved zstd block type")
+	default:
+		p.skip(int(bh >> 3))
+	}
+
+	return bh&1 == 1
+}
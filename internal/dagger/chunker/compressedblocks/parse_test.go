@@ -0,0 +1,370 @@
+package compressedblocks
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"math/rand"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ribasushi/DAGger/chunker"
+	"github.com/ribasushi/DAGger/internal/constants"
+	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
+)
+
+// Same as the MinRegion of the ring buffer: the size of every buffer passed to
+// Split() that is not the last one of a stream
+const testMinRegion = 2 * constants.MaxLeafPayloadSize
+
+// The buffers handed to Split() end at arbitrary points within the compressed
+// framing: resuming from the checkpoint must arrive at the very same chunks as
+// parsing the entire input at once
+func TestSplitResumption(t *testing.T) {
+
+	inputs := map[string][]byte{
+		"gzip":  gzipStream(t, testText(1, 6<<20)),
+		"zstd":  zstdStream(t, testText(2, 6<<20)),
+		"mixed": append(zstdStream(t, testText(3, 3<<20)), gzipStream(t, testText(4, 3<<20))...),
+	}
+
+	for name, input := range inputs {
+		for _, args := range [][]string{
+			{"--max-size=65536", "--min-size=0"},
+			{"--max-size=262144", "--min-size=16384"},
+			{"--max-size=1048576", "--min-size=0", "--resets-only"},
+		} {
+			whole := splitEntirely(t, args, input)
+
+			if maxSized := countSized(whole, maxSizeArg(args)); maxSized*2 > len(whole) {
+				t.Fatalf("%s %s: %d out of %d chunks at max-size, framing not followed", name, args, maxSized, len(whole))
+			}
+
+			for _, piece := range []int{1 << 20, 65521, 7919} {
+				if pieces := splitIncrementally(t, args, input, piece); !equalEnds(whole, pieces) {
+					t.Fatalf("%s %s: reading in pieces of %d bytes resulted in different chunks", name, args, piece)
+				}
+			}
+		}
+	}
+}
+
+// Once the framing can no longer be followed every chunk is max-sized, while
+// everything before that point is cut exactly as if the input was intact
+func TestSplitLost(t *testing.T) {
+
+	args := []string{"--max-size=65536", "--min-size=0"}
+
+	members := [][]byte{
+		gzipStream(t, testText(5, 2<<20)),
+		zstdStream(t, testText(6, 2<<20)),
+		gzipStream(t, testText(7, 2<<20)),
+	}
+	intact := bytes.Join(members, nil)
+	intactEnds := splitEntirely(t, args, intact)
+
+	brokenAt := len(members[0]) + len(members[1])
+
+	truncated := intact[:brokenAt+len(members[2])/2]
+
+	corrupted := append([]byte{}, intact...)
+	copy(corrupted[brokenAt:], "NOT A MAGIC")
+
+	random := make([]byte, 3<<20)
+	rand.New(rand.NewSource(8)).Read(random)
+
+	for _, tc := range []struct {
+		name       string
+		input      []byte
+		lastIntact int // boundaries up to here are the same as in the intact input
+	}{
+		{"truncated", truncated, len(truncated)},
+		{"corrupted", corrupted, brokenAt},
+		{"unrecognized", random, 0},
+	} {
+
+		var expected []int
+		for _, e := range intactEnds {
+			if e > tc.lastIntact || tc.lastIntact == 0 {
+				break
+			}
+			expected = append(expected, e)
+		}
+		pos := 0
+		if len(expected) > 0 {
+			pos = expected[len(expected)-1]
+		}
+		for pos < len(tc.input) {
+			pos += 65536
+			if pos > len(tc.input) {
+				pos = len(tc.input)
+			}
+			expected = append(expected, pos)
+		}
+
+		if whole := splitEntirely(t, args, tc.input); !equalEnds(expected, whole) {
+			t.Fatalf("%s input: unexpected chunks", tc.name)
+		}
+		for _, piece := range []int{1 << 20, 7919} {
+			if pieces := splitIncrementally(t, args, tc.input, piece); !equalEnds(expected, pieces) {
+				t.Fatalf("%s input: reading in pieces of %d bytes resulted in unexpected chunks", tc.name, piece)
+			}
+		}
+	}
+}
+
+// With --rsyncable the compressed versions of two revisions of a file share
+// most of their content: the chunks past the edit must be shared as well
+func TestSplitRsyncable(t *testing.T) {
+
+	v1 := testText(9, 16<<20)
+	v2 := append(append(append([]byte{}, v1[:1<<20]...), "an edit near the start of the file\n"...), v1[1<<20:]...)
+
+	for _, tc := range []struct {
+		cmd  []string
+		args []string
+	}{
+		{[]string{"gzip", "-6", "--rsyncable"}, []string{"--max-size=1048576", "--min-size=0", "--resets-only"}},
+		{[]string{"zstd", "-3", "-B1048576", "--rsyncable"}, []string{"--max-size=1048576", "--min-size=0"}},
+	} {
+		if _, err := exec.LookPath(tc.cmd[0]); err != nil {
+			t.Logf("%s not available, skipping its --rsyncable check", tc.cmd[0])
+			continue
+		}
+
+		c1 := compressExternally(t, tc.cmd, v1)
+		c2 := compressExternally(t, tc.cmd, v2)
+
+		seen := make(map[string]struct{})
+		for _, c := range chunkContents(splitEntirely(t, tc.args, c1), c1) {
+			seen[c] = struct{}{}
+		}
+
+		var shared int
+		for _, c := range chunkContents(splitEntirely(t, tc.args, c2), c2) {
+			if _, found := seen[c]; found {
+				shared += len(c)
+			}
+		}
+
+		if shared*10 < len(c2)*8 {
+			t.Fatalf(
+				"%s: only %d out of %d bytes of the edited compressed file within chunks shared with the original",
+				strings.Join(tc.cmd, " "),
+				shared,
+				len(c2),
+			)
+		}
+	}
+}
+
+//
+// Helpers
+//
+
+func newTestChunker(t *testing.T, args []string) chunker.Chunker {
+	c, _, errs := NewChunker(
+		append([]string{"compressed-blocks"}, args...),
+		&dgrchunker.DaggerConfig{IsLastInChain: true},
+	)
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected chunker initialization errors: %s", strings.Join(errs, ", "))
+	}
+	return c
+}
+
+func splitEntirely(t *testing.T, args []string, input []byte) []int {
+	return splitIncrementally(t, args, input, len(input))
+}
+
+// Feeds the input in pieces, the way the ring buffer does: a buffer is passed
+// on once it holds at least testMinRegion, and whatever was not cut off is
+// passed again at the start of the next one. Returns the offsets of every cut
+func splitIncrementally(t *testing.T, args []string, input []byte, pieceSize int) (ends []int) {
+
+	c := newTestChunker(t, args)
+
+	var start, end int
+	for {
+		for end < len(input) && (end-start < testMinRegion || pieceSize == len(input)) {
+			end += pieceSize
+			if end > len(input) {
+				end = len(input)
+			}
+		}
+
+		isLast := (end == len(input))
+		var used int
+		if err := c.Split(input[start:end], isLast, func(ch chunker.Chunk) error {
+			used += ch.Size
+			ends = append(ends, start+used)
+			return nil
+		}); err != nil {
+			t.Fatalf("Unexpected split error: %s", err)
+		}
+		start += used
+
+		if isLast {
+			if start != len(input) {
+				t.Fatalf("Final split left %d bytes unused", len(input)-start)
+			}
+			return
+		}
+	}
+}
+
+func equalEnds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func countSized(ends []int, size int) (cnt int) {
+	var prev int
+	for _, e := range ends {
+		if e-prev == size {
+			cnt++
+		}
+		prev = e
+	}
+	return
+}
+
+func maxSizeArg(args []string) (size int) {
+	for _, a := range args {
+		if strings.HasPrefix(a, "--max-size=") {
+			size, _ = strconv.Atoi(a[len("--max-size="):])
+		}
+	}
+	return
+}
+
+func chunkContents(ends []int, input []byte) (chunks []string) {
+	var prev int
+	for _, e := range ends {
+		chunks = append(chunks, string(input[prev:e]))
+		prev = e
+	}
+	return
+}
+
+// Compressible, yet not trivially so
+func testText(seed int64, size int) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+
+	words := make([]string, 2048)
+	for i := range words {
+		w := make([]byte, 2+rnd.Intn(9))
+		for j := range w {
+			w[j] = byte('a' + rnd.Intn(26))
+		}
+		words[i] = string(w)
+	}
+
+	var b bytes.Buffer
+	for b.Len() < size {
+		b.WriteString(words[rnd.Intn(len(words))])
+		if rnd.Intn(12) == 0 {
+			b.WriteByte('\n')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	return b.Bytes()[:size]
+}
+
+// Several members, covering stored, fixed and dynamic huffman blocks, and
+// byte-aligned sync flushes
+func gzipStream(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+
+	levels := []int{flate.DefaultCompression, flate.NoCompression, flate.HuffmanOnly, flate.BestSpeed}
+	part := len(data)/len(levels) + 1
+
+	for i, lvl := range levels {
+		zw, err := gzip.NewWriterLevel(&b, lvl)
+		if err != nil {
+			t.Fatalf("Unexpected gzip initialization error: %s", err)
+		}
+		zw.Name = "member"
+
+		chunk := data[i*part:]
+		if len(chunk) > part {
+			chunk = chunk[:part]
+		}
+		for len(chunk) > 0 {
+			n := 300000
+			if n > len(chunk) {
+				n = len(chunk)
+			}
+			if _, err := zw.Write(chunk[:n]); err != nil {
+				t.Fatalf("Unexpected gzip write error: %s", err)
+			}
+			if err := zw.Flush(); err != nil {
+				t.Fatalf("Unexpected gzip flush error: %s", err)
+			}
+			chunk = chunk[n:]
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Unexpected gzip close error: %s", err)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// Two frames, checksummed and padded with a skippable frame, followed by an
+// RLE-heavy one
+func zstdStream(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+
+	for _, opts := range [][]zstd.EOption{
+		{zstd.WithEncoderCRC(true), zstd.WithEncoderPadding(1 << 16)},
+		{zstd.WithEncoderCRC(false), zstd.WithEncoderLevel(zstd.SpeedFastest)},
+	} {
+		zw, err := zstd.NewWriter(&b, opts...)
+		if err != nil {
+			t.Fatalf("Unexpected zstd initialization error: %s", err)
+		}
+		if _, err := zw.Write(data[:len(data)/2]); err != nil {
+			t.Fatalf("Unexpected zstd write error: %s", err)
+		}
+		data = data[len(data)/2:]
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Unexpected zstd close error: %s", err)
+		}
+	}
+
+	zw, err := zstd.NewWriter(&b)
+	if err != nil {
+		t.Fatalf("Unexpected zstd initialization error: %s", err)
+	}
+	if _, err := zw.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("Unexpected zstd write error: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Unexpected zstd close error: %s", err)
+	}
+
+	return b.Bytes()
+}
+
+func compressExternally(t *testing.T, cmd []string, data []byte) []byte {
+	var out bytes.Buffer
+	c := exec.Command(cmd[0], append(cmd[1:], "-c")...)
+	c.Stdin = bytes.NewReader(data)
+	c.Stdout = &out
+	if err := c.Run(); err != nil {
+		t.Fatalf("Running %s failed: %s", strings.Join(cmd, " "), err)
+	}
+	return out.Bytes()
+}
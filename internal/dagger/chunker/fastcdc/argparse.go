@@ -0,0 +1,115 @@
+package fastcdc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ribasushi/DAGger/chunker"
+	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/DAGger/internal/dagger/util/argparser"
+	"github.com/ribasushi/DAGger/internal/util/text"
+)
+
+func NewChunker(
+	args []string,
+	dgrCfg *dgrchunker.DaggerConfig,
+) (
+	_ chunker.Chunker,
+	_ dgrchunker.InstanceConstants,
+	initErrs []string,
+) {
+
+	c := fastcdcChunker{}
+
+	optSet := getopt.New()
+	if err := options.RegisterSet("", &c.config, optSet); err != nil {
+		initErrs = []string{fmt.Sprintf("option set registration failed: %s", err)}
+		return
+	}
+	optSet.FlagLong(&c.gearName, "gear-table", 0, "The gear table to use, one of: "+text.AvailableMapKeys(gearTables), "name")
+
+	// on nil-args the "error" is the help text to be incorporated into
+	// the larger help display
+	if args == nil {
+		initErrs = argparser.SubHelp(
+			"Chunker based on the 'FastCDC' gear hash with normalized chunking, as\n"+
+				"described by Xia et al. in 2016. The gear table 'SHA256' consists of the\n"+
+				"first 8 bytes of the sha2-256 digest of every single byte value, while\n"+
+				"'SplitMix64' is the first 256 outputs of a SplitMix64 seeded with 0.",
+			optSet,
+		)
+		return
+	}
+
+	// bail early if getopt fails
+	if initErrs = argparser.Parse(args, optSet); len(initErrs) > 0 {
+		return
+	}
+
+	if c.MinSize >= c.AvgSize || c.AvgSize >= c.MaxSize {
+		initErrs = append(initErrs,
+			"values must satisfy 'min-size' < 'avg-size' < 'max-size'",
+		)
+	}
+
+	// The topmost bits of the state are influenced by the most bytes
+	c.maskSmall = ^uint64(0) << uint(64-c.MaskBits-c.NormalizationLevel)
+	c.maskLarge = ^uint64(0) << uint(64-c.MaskBits+c.NormalizationLevel)
+
+	if c.TargetValue >= 1<<uint(c.MaskBits-c.NormalizationLevel) {
+		initErrs = append(initErrs, fmt.Sprintf(
+			"value for 'state-target' must be smaller than 2**(state-mask-bits - normalization-level) = %d",
+			uint64(1)<<uint(c.MaskBits-c.NormalizationLevel),
+		))
+	}
+	c.targetSmall = c.TargetValue << uint(64-c.MaskBits-c.NormalizationLevel)
+	c.targetLarge = c.TargetValue << uint(64-c.MaskBits+c.NormalizationLevel)
+
+	var exists bool
+	if c.gear, exists = gearTables[c.gearName]; !exists {
+		initErrs = append(initErrs, fmt.Sprintf(
+			"unknown gear-table '%s' requested, available names are: %s",
+			c.gearName,
+			text.AvailableMapKeys(gearTables),
+		))
+	}
+
+	if len(initErrs) > 0 {
+		return
+	}
+
+	return &c, dgrchunker.InstanceConstants{
+		MinChunkSize: c.MinSize,
+		MaxChunkSize: c.MaxSize,
+		Identities: map[string]string{
+			"gear-table": dgrchunker.TableDigest(c.gear),
+		},
+	}, initErrs
+}
+
+var gearTables = map[string]*gearTable{
+	"SHA256": func() *gearTable {
+		var gt gearTable
+		for i := range gt {
+			d := sha256.Sum256([]byte{byte(i)})
+			gt[i] = binary.BigEndian.Uint64(d[:8])
+		}
+		return &gt
+	}(),
+	"SplitMix64": func() *gearTable {
+		var gt gearTable
+		var s uint64
+		for i := range gt {
+			s += 0x9E3779B97F4A7C15
+			z := s
+			z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+			z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+			gt[i] = z ^ (z >> 31)
+		}
+		return &gt
+	}(),
+}
@@ -0,0 +1,94 @@
+package fastcdc
+
+import (
+	"github.com/ribasushi/DAGger/chunker"
+)
+
+type config struct {
+	TargetValue        uint64 `getopt:"--state-target=uint64           State value denoting a chunk boundary, compared against the topmost state-mask-bits of state (default: 0)"`
+	MaskBits           int    `getopt:"--state-mask-bits=[5:22]        Amount of topmost bits of state to compare to target at avg-size. For random input average chunk size is about min-size + 2**m"`
+	NormalizationLevel int    `getopt:"--normalization-level=[0:4]     Amount of mask bits added before and removed after reaching avg-size, narrowing the chunk size distribution (recommended: 2)"`
+	AvgSize            int    `getopt:"--avg-size=[1:MaxPayload]       Chunk size at which the boundary mask is relaxed"`
+	MaxSize            int    `getopt:"--max-size=[1:MaxPayload]       Maximum data chunk size"`
+	MinSize            int    `getopt:"--min-size=[0:MaxPayload]       Minimum data chunk size"`
+	gearName           string // getopt attached dynamically during init
+}
+
+type fastcdcChunker struct {
+	// derived from the selected gear table and mask settings
+	maskSmall   uint64
+	maskLarge   uint64
+	targetSmall uint64
+	targetLarge uint64
+	gear        *gearTable
+	config
+}
+type gearTable [256]uint64
+
+func (c *fastcdcChunker) Split(
+	buf []byte,
+	useEntireBuffer bool,
+	cb chunker.SplitResultCallback,
+) (err error) {
+
+	var state uint64
+	var curIdx, lastIdx, nextRoundMax, normalIdx int
+	postBufIdx := len(buf)
+
+	for {
+		lastIdx = curIdx
+		nextRoundMax = lastIdx + c.MaxSize
+
+		// we will be running out of data, but still *could* run a round
+		if nextRoundMax > postBufIdx {
+			// abort early if we are allowed to
+			if !useEntireBuffer {
+				return
+			}
+			// otherwise signify where we stop hard
+			nextRoundMax = postBufIdx
+		}
+
+		// in case we will *NOT* be able to run another round at all
+		if curIdx+c.MinSize >= postBufIdx {
+			if useEntireBuffer && postBufIdx != curIdx {
+				err = cb(chunker.Chunk{Size: postBufIdx - curIdx})
+			}
+			return
+		}
+
+		// reset, no preheat: the gear state naturally only reflects the last 64 bytes
+		state = 0
+		curIdx += c.MinSize
+
+		normalIdx = lastIdx + c.AvgSize
+		if normalIdx > nextRoundMax {
+			normalIdx = nextRoundMax
+		}
+
+		// cycle with the stricter mask until avg-size...
+		for curIdx < normalIdx {
+			state = (state << 1) + c.gear[buf[curIdx]]
+			curIdx++
+			if (state & c.maskSmall) == c.targetSmall {
+				// found: skip the relaxed cycle
+				nextRoundMax = curIdx
+				break
+			}
+		}
+
+		// ...and with the relaxed one after
+		for curIdx < nextRoundMax {
+			state = (state << 1) + c.gear[buf[curIdx]]
+			curIdx++
+			if (state & c.maskLarge) == c.targetLarge {
+				break
+			}
+		}
+
+		err = cb(chunker.Chunk{Size: curIdx - lastIdx})
+		if err != nil {
+			return
+		}
+	}
+}
@@ -2,6 +2,7 @@ package padfinder
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/ribasushi/DAGger/chunker"
 	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
@@ -62,6 +63,10 @@ func NewChunker(
 		} else {
 			c.padMeta["padding-cluster-atom-hex"] = c.StaticPadHex
 
+			if c.StaticMinRepeats > 0 && strings.Trim(c.StaticPadHex, "0") == "" {
+				c.zeroAtomLen = len(c.StaticPadHex) / 2
+			}
+
 			esc := []byte("\\x")
 			hex := []byte(c.StaticPadHex)
 			inner := make([]byte, 0, len(hex)*2)
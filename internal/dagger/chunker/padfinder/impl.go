@@ -1,6 +1,9 @@
 package padfinder
 
 import (
+	"bytes"
+	"encoding/binary"
+
 	"github.com/ribasushi/DAGger/chunker"
 	"github.com/ribasushi/DAGger/internal/constants"
 )
@@ -17,6 +20,17 @@ type padfinderPreChunker struct {
 	finder  finderInstance
 	padMeta chunker.ChunkMeta
 	config
+
+	// Set when the static pad consists of zeros: known zero ranges are then
+	// taken as-is instead of being scanned, valid for a single Split()
+	zeroAtomLen int
+	zeroRanges  [][2]int
+}
+
+func (c *padfinderPreChunker) HintZeroRanges(ranges [][2]int) {
+	if c.zeroAtomLen > 0 {
+		c.zeroRanges = ranges
+	}
 }
 
 func (c *padfinderPreChunker) Split(
@@ -29,6 +43,8 @@ func (c *padfinderPreChunker) Split(
 	var curIdx, matchStart, matchEnd int
 	var didOverflow bool
 
+	defer func() { c.zeroRanges = nil }()
+
 	for {
 		// we will be running out of data, but still *could* run a round
 		// abort early if we are allowed to
@@ -37,7 +53,7 @@ func (c *padfinderPreChunker) Split(
 			return
 		}
 
-		if matchStart, matchEnd = c.finder.findNext(buf[curIdx:]); matchEnd > 0 {
+		if matchStart, matchEnd = c.findNext(buf, curIdx); matchEnd > 0 {
 			// We did match *somewhere* in the buffer - let's break this down
 
 			// NOTE: the match{Start,End} offsets are relative to curIdx as it is NOW
@@ -83,6 +99,70 @@ func (c *padfinderPreChunker) Split(
 	}
 }
 
+func (c *padfinderPreChunker) findNext(buf []byte, curIdx int) (int, int) {
+
+	for len(c.zeroRanges) > 0 && c.zeroRanges[0][1] <= curIdx {
+		c.zeroRanges = c.zeroRanges[1:]
+	}
+	if len(c.zeroRanges) == 0 {
+		return c.finder.findNext(buf[curIdx:])
+	}
+
+	// The equivalent of the (?:\x00...){N,} regex: the leftmost maximal run
+	// of zeros at least N atoms long, trimmed to a whole amount of atoms
+	minRunLen := c.StaticMinRepeats * c.zeroAtomLen
+	ranges := c.zeroRanges
+
+	for runStart := curIdx; runStart < len(buf); {
+
+		nextZero := bytes.IndexByte(buf[runStart:], 0)
+		if nextZero < 0 {
+			break
+		}
+		runStart += nextZero
+
+		runEnd := runStart
+		for runEnd < len(buf) {
+			for len(ranges) > 0 && ranges[0][1] <= runEnd {
+				ranges = ranges[1:]
+			}
+			if len(ranges) > 0 && ranges[0][0] <= runEnd {
+				runEnd = ranges[0][1]
+				if runEnd > len(buf) {
+					runEnd = len(buf)
+				}
+				continue
+			}
+
+			scanEnd := len(buf)
+			if len(ranges) > 0 {
+				scanEnd = ranges[0][0]
+			}
+			runEnd += zeroPrefixLen(buf[runEnd:scanEnd])
+			if runEnd < scanEnd {
+				break
+			}
+		}
+
+		if runEnd-runStart >= minRunLen {
+			return runStart - curIdx, runStart - curIdx + (runEnd-runStart)/c.zeroAtomLen*c.zeroAtomLen
+		}
+		runStart = runEnd
+	}
+
+	return 0, 0
+}
+
+func zeroPrefixLen(b []byte) (l int) {
+	for l+8 <= len(b) && binary.LittleEndian.Uint64(b[l:]) == 0 {
+		l += 8
+	}
+	for l < len(b) && b[l] == 0 {
+		l++
+	}
+	return
+}
+
 func (c *padfinderPreChunker) padSubSplit(
 	length int,
 	cb chunker.SplitResultCallback,
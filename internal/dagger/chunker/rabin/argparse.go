@@ -72,5 +72,8 @@ func NewChunker(
 	return &c, dgrchunker.InstanceConstants{
 		MinChunkSize: c.MinSize,
 		MaxChunkSize: c.MaxSize,
+		Identities: map[string]string{
+			"lookup-tables": dgrchunker.TableDigest([2][256]uint64{c.outTable, c.modTable}),
+		},
 	}, initErrs
 }
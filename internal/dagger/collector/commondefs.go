@@ -11,6 +11,17 @@ type Collector interface {
 	FlushState() (rootBlockAfterReducingAndDestroyingObjectState *dgrblock.Header)
 }
 
+// LayerLabeler is optionally implemented by collectors forming more than one
+// kind of node, naming each in the stats in place of the generic LinkingLayerN
+type LayerLabeler interface {
+	LayerLabels() map[dgrencoder.NodeOrigin]LayerLabel
+}
+
+type LayerLabel struct {
+	Short string // at most 3 characters, used by stats-text
+	Long  string
+}
+
 type DaggerConfig struct {
 	ChunkerChainMaxResult int // used for initialization sanity checks
 	ChainPosition         int // used for DAG-stats layering
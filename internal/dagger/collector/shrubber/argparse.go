@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	dgrcollector "github.com/ribasushi/DAGger/internal/dagger/collector"
+	"github.com/ribasushi/DAGger/internal/util/text"
 
 	"github.com/pborman/getopt/v2"
 	"github.com/pborman/options"
@@ -30,7 +31,20 @@ func NewCollector(args []string, dgrCfg *dgrcollector.DaggerConfig) (_ dgrcollec
 				"subtrees (shrubberies), before passing them to the next collector in the\n"+
 				"chain. It combines several modes of operation, each benefitting from being\n"+
 				"as close to the 'leaf node' layer as possible. Specifically:\n"+
-				" - ",
+				" - Runs of padding chunks sharing a 'padding-cluster-atom-hex' (as emitted\n"+
+				"   by pad-finder) are collapsed into a single node: repeats of the same\n"+
+				"   padding block are referenced via a tree of repeater nodes, so that a run\n"+
+				"   of any length results in only a handful of distinct blocks.\n"+
+				" - With a non-zero cid-subgroup-mask-bits nodes are grouped by content: a\n"+
+				"   subgroup ends with the first node whose masked CID tail matches the\n"+
+				"   cid-subgroup-target, once at least cid-subgroup-min-nodes are clustered.\n"+
+				"   As a CID depends on nothing but the content it represents, the subgroups\n"+
+				"   of identical data converge past its first matching node, regardless of\n"+
+				"   what precedes it.\n"+
+				" - With a non-zero max-payload a group is also ended before it exceeds\n"+
+				"   this much payload.\n"+
+				"A switch between inlined and regular CIDs, and the end of every stream,\n"+
+				"end the current group as well. A group of a single node is passed on as-is.",
 			optSet,
 		)
 		return
@@ -48,8 +62,37 @@ func NewCollector(args []string, dgrCfg *dgrcollector.DaggerConfig) (_ dgrcollec
 		initErrs = append(initErrs, "collector can not be last in chain")
 	}
 
-	co.cidMask = (1 << uint(co.SubgroupCidMaskBits)) - 1
-	co.cidTailTarget = uint16(co.SubgroupCidTarget)
+	// every chunk, padding runs of pad-finder included, must fit within a group
+	if co.MaxPayload != 0 && co.MaxPayload < co.ChunkerChainMaxResult {
+		initErrs = append(initErrs, fmt.Sprintf(
+			"value for 'max-payload' must be 0 or at least %s, the largest chunk the chunker chain may produce",
+			text.Commify(co.ChunkerChainMaxResult),
+		))
+	}
+
+	if co.SubgroupCidMaskBits == 0 {
+		if co.SubgroupCidTarget != 0 || co.SubgroupCidMinNodes != 0 {
+			initErrs = append(initErrs,
+				"values for 'cid-subgroup-target' and 'cid-subgroup-min-nodes' must be 0 when 'cid-subgroup-mask-bits' is 0",
+			)
+		}
+	} else {
+		co.cidMask = uint16((1 << uint(co.SubgroupCidMaskBits)) - 1)
+		co.cidTailTarget = uint16(co.SubgroupCidTarget)
+
+		if co.SubgroupCidTarget > int(co.cidMask) {
+			initErrs = append(initErrs, fmt.Sprintf(
+				"value for 'cid-subgroup-target' must fit within %d bits (at most %d)",
+				co.SubgroupCidMaskBits,
+				co.cidMask,
+			))
+		}
+		if co.SubgroupCidMinNodes < 2 {
+			initErrs = append(initErrs,
+				"value for 'cid-subgroup-min-nodes' must be at least 2 when 'cid-subgroup-mask-bits' is set",
+			)
+		}
+	}
 
 	return co, initErrs
 }
@@ -12,14 +12,25 @@ import (
 )
 
 type config struct {
-	MaxPayload          int `getopt:"--max-payload=[0:MaxPayload]   FIXME Maximum payload size in each node. To skip payload-based balancing, set this to 0."`
-	RepeaterLayerNodes  int `getopt:"--static-pad-repeater-nodes=[1:]  FIXME LS"`
-	SubgroupCidMaskBits int `getopt:"--cid-subgroup-mask-bits=[4:16] FIXME Amount of bits from the end of a cryptographic Cid to compare of state to compare to target on every iteration. For random input average chunk size is about 2**m"`
-	SubgroupCidTarget   int `getopt:"--cid-subgroup-target=[0:]    FIXME State value denoting a chunk boundary, check against mask"`
-	SubgroupCidMinNodes int `getopt:"--cid-subgroup-min-nodes=[0:]  FIXME The minimum amount of nodes clustered together before employing CID-based subgrouping. 0 disables "`
+	MaxPayload          int `getopt:"--max-payload=[0:MaxPayload]     Maximum payload of a group of nodes, no less than the largest data chunk. 0 disables payload-based grouping"`
+	RepeaterLayerNodes  int `getopt:"--static-pad-repeater-nodes=[2:]  Amount of links within each repeater node, referencing the same padding block (or the same smaller repeater node) over and over"`
+	SubgroupCidMaskBits int `getopt:"--cid-subgroup-mask-bits=[0:16]  Amount of trailing bits of the CID of every node compared to cid-subgroup-target. For random input the average subgroup is about 2**m nodes. 0 disables CID-based subgrouping"`
+	SubgroupCidTarget   int `getopt:"--cid-subgroup-target=[0:65535]   Value of the masked CID tail of the last node of every subgroup. Must fit within cid-subgroup-mask-bits"`
+	SubgroupCidMinNodes int `getopt:"--cid-subgroup-min-nodes=[0:]     Minimum amount of nodes in a subgroup: a matching CID tail is disregarded before this many nodes are clustered. At least 2 when subgrouping is active, 0 otherwise"`
 }
+
+// The LocalSubLayer of every kind of node formed, each labeled separately in
+// the stats. The padding nodes originate at the leaf layer (-1), the groups at
+// the chain position of the collector
+const (
+	subLayerGroup          = 0 // ended by max-payload, an inlining switch or the stream end
+	subLayerCidSubgroup    = 1 // ended by a matching CID tail
+	subLayerPadRepeater    = 2 // the same padding block (or smaller repeater) over and over
+	subLayerPaddingCluster = 3 // an entire run of padding blocks
+)
+
 type collector struct {
-	cidMask       uint16
+	cidMask       uint16 // 0 when CID-based subgrouping is disabled
 	cidTailTarget uint16
 	config
 	sumPayload uint64
@@ -36,24 +47,22 @@ type padBlock struct {
 	block  *dgrblock.Header
 }
 
+func (co *collector) LayerLabels() map[dgrencoder.NodeOrigin]dgrcollector.LayerLabel {
+	return map[dgrencoder.NodeOrigin]dgrcollector.LayerLabel{
+		{OriginatingLayer: co.ChainPosition, LocalSubLayer: subLayerGroup}:       {Short: "SG", Long: "ShrubberGroups"},
+		{OriginatingLayer: co.ChainPosition, LocalSubLayer: subLayerCidSubgroup}: {Short: "SC", Long: "ShrubberCidSubgroups"},
+		{OriginatingLayer: -1, LocalSubLayer: subLayerPadRepeater}:               {Short: "PS", Long: "PaddingSuperblocks"},
+		{OriginatingLayer: -1, LocalSubLayer: subLayerPaddingCluster}:            {Short: "PC", Long: "PaddingClusters"},
+	}
+}
+
 func (co *collector) FlushState() *dgrblock.Header {
 	co.flushPadding()
 
-	if len(co.stack) == 0 {
-		return nil
+	if len(co.stack) > 0 {
+		co.emitGroup(subLayerGroup, len(co.stack))
 	}
 
-	var tailHdr *dgrblock.Header
-	if len(co.stack) == 1 {
-		tailHdr = co.stack[0]
-	} else {
-		tailHdr = co.NodeEncoder.NewLink(
-			dgrencoder.NodeOrigin{OriginatingLayer: co.ChainPosition},
-			co.stack,
-		)
-	}
-	co.NextCollector.AppendBlock(tailHdr)
-
 	// we flush often, do not realloc
 	co.stack = co.stack[:0]
 	co.sumPayload = 0
@@ -61,6 +70,29 @@ func (co *collector) FlushState() *dgrblock.Header {
 	return nil // we are never last: do not return the intermediate block
 }
 
+// Passes the first groupSize nodes of the stack on to the next collector, and
+// shifts the rest to the front. A group of a single node is passed as-is: the
+// same node is formed whether the group ends mid-stream or at the stream end
+func (co *collector) emitGroup(subLayer, groupSize int) {
+
+	groupHdr := co.stack[0]
+	if groupSize > 1 {
+		groupHdr = co.NodeEncoder.NewLink(
+			dgrencoder.NodeOrigin{OriginatingLayer: co.ChainPosition, LocalSubLayer: subLayer},
+			co.stack[:groupSize],
+		)
+	}
+	co.NextCollector.AppendBlock(groupHdr)
+
+	co.sumPayload -= groupHdr.SizeCumulativePayload()
+
+	// shift everything to the last cut, without realloc
+	co.stack = co.stack[:copy(
+		co.stack,
+		co.stack[groupSize:],
+	)]
+}
+
 func (co *collector) AppendData(ds dgrblock.DataSource) *dgrblock.Header {
 
 	curBase, curBaseFound := ds.Meta["padding-cluster-atom-hex"].(string)
@@ -136,28 +168,14 @@ func (co *collector) AppendBlock(newHdr *dgrblock.Header) {
 		}
 	}
 
-	if len(co.stack) > co.SubgroupCidMinNodes {
+	// The CID of a node is only examined once the next one arrives: at the end
+	// of the stream FlushState() forms the same group regardless
+	if co.cidMask != 0 && len(co.stack) >= co.SubgroupCidMinNodes {
 
-		tgtIdx := len(co.stack) - 1
-		tgtBlock := co.stack[tgtIdx]
-		tgtCid := tgtBlock.Cid()
+		tgtCid := co.stack[len(co.stack)-1].Cid()
 
 		if (binary.BigEndian.Uint16(tgtCid[len(tgtCid)-2:]) & co.cidMask) == co.cidTailTarget {
-
-			linkHdr := co.NodeEncoder.NewLink(
-				dgrencoder.NodeOrigin{OriginatingLayer: co.ChainPosition},
-				co.stack[0:tgtIdx+1],
-			)
-			co.NextCollector.AppendBlock(linkHdr)
-
-			co.sumPayload -= linkHdr.SizeCumulativePayload()
-
-			// shift everything to the last cut, without realloc
-			co.stack = co.stack[:copy(
-				co.stack,
-				co.stack[tgtIdx+1:],
-			)]
-			return
+			co.emitGroup(subLayerCidSubgroup, len(co.stack))
 		}
 	}
 }
@@ -216,7 +234,7 @@ func (co *collector) flushPadding() {
 					expNext = append(expNext, expBlocks[len(expBlocks)-1])
 				}
 				expBlocks = append(expBlocks, co.NodeEncoder.NewLink(
-					dgrencoder.NodeOrigin{OriginatingLayer: -1, LocalSubLayer: 2},
+					dgrencoder.NodeOrigin{OriginatingLayer: -1, LocalSubLayer: subLayerPadRepeater},
 					expNext,
 				))
 			} else {
@@ -230,7 +248,7 @@ func (co *collector) flushPadding() {
 	}
 
 	co.AppendBlock(co.NodeEncoder.NewLink(
-		dgrencoder.NodeOrigin{OriginatingLayer: -1, LocalSubLayer: 2},
+		dgrencoder.NodeOrigin{OriginatingLayer: -1, LocalSubLayer: subLayerPaddingCluster},
 		finBlocks,
 	))
 }
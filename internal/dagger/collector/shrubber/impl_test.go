@@ -0,0 +1,186 @@
+package shrubber
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ribasushi/DAGger/chunker"
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrcollector "github.com/ribasushi/DAGger/internal/dagger/collector"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+	"github.com/ribasushi/DAGger/internal/zcpstring"
+)
+
+// Records every link node formed, linking the CIDs of its children
+type testEncoder struct {
+	maker dgrblock.Maker
+	links []testLink
+}
+
+type testLink struct {
+	origin dgrencoder.NodeOrigin
+	blocks []*dgrblock.Header
+}
+
+func (e *testEncoder) NewLeaf(ds dgrblock.DataSource) *dgrblock.Header {
+	return e.maker(ds.Content, dgrblock.CodecRaw, uint64(ds.Size), 0)
+}
+
+func (e *testEncoder) NewLink(origin dgrencoder.NodeOrigin, blocks []*dgrblock.Header) *dgrblock.Header {
+	e.links = append(e.links, testLink{origin: origin, blocks: append([]*dgrblock.Header{}, blocks...)})
+
+	var payload, dag uint64
+	var content []byte
+	for _, b := range blocks {
+		payload += b.SizeCumulativePayload()
+		dag += b.SizeCumulativeDag()
+		content = append(content, b.Cid()...)
+	}
+	return e.maker(zcpstring.WrapSlice(content), dgrblock.CodecPB, payload, dag)
+}
+
+// Records every node passed on by the shrubber
+type testNextCollector struct {
+	blocks []*dgrblock.Header
+}
+
+func (n *testNextCollector) AppendData(ds dgrblock.DataSource) *dgrblock.Header { return nil }
+func (n *testNextCollector) AppendBlock(h *dgrblock.Header)                     { n.blocks = append(n.blocks, h) }
+func (n *testNextCollector) FlushState() *dgrblock.Header                       { return nil }
+
+// Every option is mandatory: the given ones take the place of the defaults
+func testArgs(args ...string) []string {
+	full := []string{
+		"shrubber",
+		"--max-payload=0",
+		"--static-pad-repeater-nodes=4",
+		"--cid-subgroup-mask-bits=0",
+		"--cid-subgroup-target=0",
+		"--cid-subgroup-min-nodes=0",
+	}
+	for _, a := range args {
+		for i := range full {
+			if strings.SplitN(full[i], "=", 2)[0] == strings.SplitN(a, "=", 2)[0] {
+				full[i] = a
+			}
+		}
+	}
+	return full
+}
+
+func newTestShrubber(t *testing.T, args ...string) (*collector, *testEncoder, *testNextCollector) {
+	maker, _, errStr := dgrblock.MakerFromConfig("sha2-256", 32, 0, 0, &sync.WaitGroup{})
+	if errStr != "" {
+		t.Fatalf("Unexpected blockmaker initialization error: %s", errStr)
+	}
+
+	enc := &testEncoder{maker: maker}
+	next := &testNextCollector{}
+	co, initErrs := NewCollector(testArgs(args...), &dgrcollector.DaggerConfig{
+		ChunkerChainMaxResult: 100,
+		ChainPosition:         1,
+		NodeEncoder:           enc,
+		NextCollector:         next,
+	})
+	if len(initErrs) > 0 {
+		t.Fatalf("Unexpected initialization errors: %v", initErrs)
+	}
+	return co.(*collector), enc, next
+}
+
+func testChunk(i, size int, meta chunker.ChunkMeta) dgrblock.DataSource {
+	return dgrblock.DataSource{
+		Chunk:   chunker.Chunk{Size: size, Meta: meta},
+		Content: zcpstring.WrapSlice(bytes.Repeat([]byte{byte(i)}, size)),
+	}
+}
+
+func TestOptionValidation(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--max-payload=99"}, "must be 0 or at least 100"},
+		{[]string{"--cid-subgroup-target=1"}, "must be 0 when 'cid-subgroup-mask-bits' is 0"},
+		{[]string{"--cid-subgroup-mask-bits=3", "--cid-subgroup-target=8", "--cid-subgroup-min-nodes=2"}, "must fit within 3 bits"},
+		{[]string{"--cid-subgroup-mask-bits=3", "--cid-subgroup-min-nodes=1"}, "must be at least 2"},
+	} {
+		_, initErrs := NewCollector(testArgs(tc.args...), &dgrcollector.DaggerConfig{
+			ChunkerChainMaxResult: 100,
+			ChainPosition:         1,
+			NextCollector:         &testNextCollector{},
+		})
+		if !strings.Contains(fmt.Sprint(initErrs), tc.expected) {
+			t.Errorf("%v: expected an initialization error containing '%s', got %v", tc.args, tc.expected, initErrs)
+		}
+	}
+}
+
+// Groups are ended before exceeding max-payload, and by the end of the stream.
+// A group of a single node is passed on as-is
+func TestMaxPayloadGroups(t *testing.T) {
+
+	co, enc, next := newTestShrubber(t, "--max-payload=350")
+
+	var leaves []*dgrblock.Header
+	for i := 0; i < 10; i++ {
+		leaves = append(leaves, co.AppendData(testChunk(i, 100, nil)))
+	}
+	co.FlushState()
+
+	if len(enc.links) != 3 || len(next.blocks) != 4 {
+		t.Fatalf("Expected 3 groups and 4 nodes passed on, got %d groups and %d nodes", len(enc.links), len(next.blocks))
+	}
+	for i, l := range enc.links {
+		if l.origin != (dgrencoder.NodeOrigin{OriginatingLayer: 1, LocalSubLayer: subLayerGroup}) || len(l.blocks) != 3 || l.blocks[0] != leaves[3*i] {
+			t.Fatalf("Group #%d of %d nodes at %+v does not hold leaves %d-%d", i, len(l.blocks), l.origin, 3*i, 3*i+2)
+		}
+	}
+	if next.blocks[3] != leaves[9] {
+		t.Fatalf("The trailing single leaf was not passed on as-is")
+	}
+}
+
+// A run of identical padding chunks is collapsed into a single cluster node,
+// linking repeater nodes which in turn link the same padding leaf over and over
+func TestPaddingCluster(t *testing.T) {
+
+	co, enc, next := newTestShrubber(t, "--static-pad-repeater-nodes=4")
+
+	pad := chunker.ChunkMeta{"padding-cluster-atom-hex": "00"}
+	padLeaf := co.AppendData(testChunk(0, 100, pad))
+	for i := 1; i < 20; i++ {
+		if h := co.AppendData(testChunk(0, 100, pad)); h != padLeaf {
+			t.Fatalf("Padding chunk #%d did not result in the same leaf", i)
+		}
+	}
+	co.FlushState()
+
+	if len(enc.links) != 2 || len(next.blocks) != 1 {
+		t.Fatalf("Expected 2 link nodes and a single node passed on, got %d and %d", len(enc.links), len(next.blocks))
+	}
+
+	repeater, cluster := enc.links[0], enc.links[1]
+	if repeater.origin.LocalSubLayer != subLayerPadRepeater || len(repeater.blocks) != 4 {
+		t.Fatalf("Unexpected repeater node of %d links at %+v", len(repeater.blocks), repeater.origin)
+	}
+	for _, b := range repeater.blocks {
+		if b != padLeaf {
+			t.Fatalf("Repeater node links something other than the padding leaf")
+		}
+	}
+	if cluster.origin.LocalSubLayer != subLayerPaddingCluster || len(cluster.blocks) != 5 {
+		t.Fatalf("Unexpected cluster node of %d links at %+v", len(cluster.blocks), cluster.origin)
+	}
+	for _, b := range cluster.blocks {
+		if !bytes.Equal(b.Cid(), cluster.blocks[0].Cid()) || b.SizeCumulativePayload() != 400 {
+			t.Fatalf("Cluster node links something other than the repeater node")
+		}
+	}
+	if next.blocks[0].SizeCumulativePayload() != 2000 {
+		t.Fatalf("Padding cluster represents %d bytes instead of 2000", next.blocks[0].SizeCumulativePayload())
+	}
+}
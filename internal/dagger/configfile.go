@@ -0,0 +1,372 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ribasushi/DAGger/internal/util/text"
+	"gopkg.in/yaml.v2"
+)
+
+// Built-in profiles are defined as the go-ipfs add command they emulate, and
+// expand to exactly what --ipfs-add-compatible-command would have selected
+var builtinProfiles = map[string]string{
+	"ipfs-cidv0":         "--upgrade-cidv0-in-output",
+	"ipfs-cidv1":         "--cid-version=1",
+	"ipfs-cidv1-trickle": "--cid-version=1 --trickle",
+	"ipfs-cidv1-rabin":   "--cid-version=1 --chunker=rabin",
+	"ipfs-cidv1-buzhash": "--cid-version=1 --chunker=buzhash",
+}
+
+// Keys with a meaning of their own, everything else is a regular long option
+const (
+	cfgKeyProfiles    = "profiles"
+	cfgKeyProfile     = "profile"
+	cfgKeyChunkers    = "chunkers"
+	cfgKeyCollectors  = "collectors"
+	cfgKeyNodeEncoder = "node-encoder"
+)
+
+// Returns the options supplied by --config and --profile, in argv form. Only
+// options absent from the command line are included: the caller prepends them
+// to argv, so they end up in the expanded argv of the summary as if typed out.
+// The precedence is: command line, then the selected profile, then the
+// top-level of the config file
+func (cfg *config) presetArgs() (args []string, errs []string) {
+
+	var file map[string]interface{}
+	if cfg.ConfigFile != "" {
+		var err error
+		if file, err = readConfigFile(cfg.ConfigFile); err != nil {
+			return nil, []string{fmt.Sprintf("Reading --config '%s' failed: %s", cfg.ConfigFile, err)}
+		}
+		if _, exists := file["config"]; exists {
+			return nil, []string{fmt.Sprintf("Config file '%s' can not refer to another config file", cfg.ConfigFile)}
+		}
+	}
+
+	fileProfiles := map[string]interface{}{}
+	if p, exists := file[cfgKeyProfiles]; exists {
+		if fileProfiles, _ = p.(map[string]interface{}); fileProfiles == nil {
+			return nil, []string{fmt.Sprintf("Config file '%s' key '%s' must be a table of named profiles", cfg.ConfigFile, cfgKeyProfiles)}
+		}
+	}
+
+	profileName := cfg.Profile
+	if profileName == "" {
+		if p, exists := file[cfgKeyProfile]; exists {
+			if profileName, _ = p.(string); profileName == "" {
+				return nil, []string{fmt.Sprintf("Config file '%s' key '%s' must be a profile name", cfg.ConfigFile, cfgKeyProfile)}
+			}
+		}
+	}
+
+	merged := make(map[string]interface{}, len(file))
+	for k, v := range file {
+		if k != cfgKeyProfiles && k != cfgKeyProfile {
+			merged[k] = v
+		}
+	}
+
+	if profileName != "" {
+		var profile map[string]interface{}
+		if p, exists := fileProfiles[profileName]; exists {
+			if profile, _ = p.(map[string]interface{}); profile == nil {
+				return nil, []string{fmt.Sprintf("Profile '%s' in config file '%s' must be a table of options", profileName, cfg.ConfigFile)}
+			}
+		} else if cmd, exists := builtinProfiles[profileName]; exists {
+			var profileErrs []string
+			if profile, profileErrs = builtinProfile(cmd); len(profileErrs) > 0 {
+				return nil, profileErrs
+			}
+		} else {
+			available := make(map[string]struct{}, len(fileProfiles)+len(builtinProfiles))
+			for n := range fileProfiles {
+				available[n] = struct{}{}
+			}
+			for n := range builtinProfiles {
+				available[n] = struct{}{}
+			}
+			return nil, []string{fmt.Sprintf(
+				"Profile '%s' not found. Available profiles are: %s",
+				profileName,
+				text.AvailableMapKeys(available),
+			)}
+		}
+
+		for k, v := range profile {
+			if k == cfgKeyProfiles || k == cfgKeyProfile || k == "config" {
+				return nil, []string{fmt.Sprintf("Profile '%s' can not contain the key '%s'", profileName, k)}
+			}
+			merged[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if cfg.optSet.IsSet(k) {
+			continue
+		}
+
+		var val string
+		var err error
+		switch k {
+		case cfgKeyChunkers, cfgKeyCollectors:
+			val, err = chainSpec(merged[k])
+		case cfgKeyNodeEncoder:
+			val, err = stageSpec(merged[k])
+		default:
+			if b, isBool := merged[k].(bool); isBool {
+				// a bare flag, or left at its default
+				if b {
+					args = append(args, "--"+k)
+				}
+				continue
+			}
+			val, err = optionValue(merged[k])
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Invalid value for '%s' in --config/--profile: %s", k, err))
+			continue
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", k, val))
+	}
+
+	return
+}
+
+func builtinProfile(ipfsCmd string) (map[string]interface{}, []string) {
+	scratch := &config{IpfsCompatCmd: ipfsCmd}
+	if err := scratch.initArgvParser(); err != nil {
+		return nil, []string{err.Error()}
+	}
+	if errs := scratch.presetFromIPFS(); len(errs) > 0 {
+		return nil, errs
+	}
+	return map[string]interface{}{
+		"hash":            scratch.hashFunc,
+		"inline-max-size": scratch.InlineMaxSize,
+		cfgKeyChunkers:    scratch.requestedChunkers,
+		cfgKeyCollectors:  scratch.requestedCollectors,
+		cfgKeyNodeEncoder: scratch.requestedNodeEncoder,
+	}, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// keep large integers (e.g. rabin polynomials) exact
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.UseNumber()
+		err = dec.Decode(&parsed)
+	case ".toml":
+		_, err = toml.Decode(string(content), &parsed)
+	case ".yaml", ".yml":
+		var y map[interface{}]interface{}
+		if err = yaml.Unmarshal(content, &y); err == nil {
+			var norm interface{}
+			if norm, err = normalizeYaml(y); err == nil {
+				parsed, _ = norm.(map[string]interface{})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized extension '%s', expecting one of .json, .toml, .yaml or .yml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if parsed == nil {
+		parsed = map[string]interface{}{}
+	}
+	return parsed, nil
+}
+
+// yaml.v2 decodes maps with interface{} keys: turn them into the same shapes
+// the json and toml decoders produce
+func normalizeYaml(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, sub := range t {
+			ks, isStr := k.(string)
+			if !isStr {
+				return nil, fmt.Errorf("non-string key '%v'", k)
+			}
+			var err error
+			if m[ks], err = normalizeYaml(sub); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, sub := range t {
+			var err error
+			if l[i], err = normalizeYaml(sub); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	default:
+		return v, nil
+	}
+}
+
+// A chain is either given in its command line form, or as a list of stages
+func chainSpec(v interface{}) (string, error) {
+	if s, isStr := v.(string); isStr {
+		return s, nil
+	}
+
+	stages, isList := toList(v)
+	if !isList || len(stages) == 0 {
+		return "", fmt.Errorf("expecting a non-empty list of stages")
+	}
+
+	specs := make([]string, len(stages))
+	for i, s := range stages {
+		var err error
+		if specs[i], err = stageSpec(s); err != nil {
+			return "", fmt.Errorf("stage #%d: %s", i+1, err)
+		}
+	}
+	return strings.Join(specs, "__"), nil
+}
+
+// A stage is either given in its command line form, or as a table with a
+// 'name' and optional 'options'. The options are either a table, where true
+// denotes a bare flag and false omits it, or a list of individual options
+func stageSpec(v interface{}) (string, error) {
+	if s, isStr := v.(string); isStr {
+		return s, nil
+	}
+
+	m, isMap := v.(map[string]interface{})
+	if !isMap {
+		return "", fmt.Errorf("expecting a stage name or a table with 'name' and 'options'")
+	}
+	for k := range m {
+		if k != "name" && k != "options" {
+			return "", fmt.Errorf("unexpected stage key '%s'", k)
+		}
+	}
+
+	name, _ := m["name"].(string)
+	if name == "" || strings.Contains(name, "_") {
+		return "", fmt.Errorf("invalid stage name '%v'", m["name"])
+	}
+	parts := []string{name}
+
+	if opts, isMap := m["options"].(map[string]interface{}); isMap {
+		names := make([]string, 0, len(opts))
+		for n := range opts {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if b, isBool := opts[n].(bool); isBool {
+				if b {
+					parts = append(parts, n)
+				}
+				continue
+			}
+			val, err := optionValue(opts[n])
+			if err != nil {
+				return "", fmt.Errorf("option '%s' of '%s': %s", n, name, err)
+			}
+			parts = append(parts, n+"="+val)
+		}
+	} else if opts, isList := toList(m["options"]); isList {
+		for _, o := range opts {
+			val, err := optionValue(o)
+			if err != nil {
+				return "", fmt.Errorf("option of '%s': %s", name, err)
+			}
+			parts = append(parts, val)
+		}
+	} else if m["options"] != nil {
+		return "", fmt.Errorf("options of '%s' must be a table or a list", name)
+	}
+
+	// the command line form can not represent these, and the result is
+	// handed to the very same parser
+	for _, p := range parts[1:] {
+		if p == "" || strings.Contains(p, "_") {
+			return "", fmt.Errorf("option '%s' of '%s' may not be empty nor contain '_'", p, name)
+		}
+	}
+
+	return strings.Join(parts, "_"), nil
+}
+
+func optionValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case json.Number:
+		return t.String(), nil
+	case int:
+		return strconv.FormatInt(int64(t), 10), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case uint64:
+		return strconv.FormatUint(t, 10), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	}
+
+	if l, isList := toList(v); isList {
+		vals := make([]string, len(l))
+		for i, e := range l {
+			var err error
+			if vals[i], err = optionValue(e); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(vals, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value '%v'", v)
+}
+
+// toml produces typed slices for homogeneous arrays
+func toList(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case []interface{}:
+		return t, true
+	case []map[string]interface{}:
+		l := make([]interface{}, len(t))
+		for i := range t {
+			l[i] = t[i]
+		}
+		return l, true
+	case []string:
+		l := make([]interface{}, len(t))
+		for i := range t {
+			l[i] = t[i]
+		}
+		return l, true
+	}
+	return nil, false
+}
@@ -0,0 +1,131 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var configFileFixtures = map[string]string{
+	"chains.toml": `
+hash = "sha2-256"
+inline-max-size = 36
+
+[[chunkers]]
+name = "buzhash"
+options = { hash-table = "GoIPFSv0", state-target = 0, state-mask-bits = 17, min-size = 87381, max-size = 393216 }
+
+[profiles.dagcbor]
+collectors = "fixed-outdegree_max-outdegree=174"
+node-encoder = { name = "dagcbor", options = { link-dag-sizes = true } }
+`,
+	"chains.json": `{
+  "hash": "sha2-256",
+  "inline-max-size": 36,
+  "chunkers": [
+    { "name": "buzhash", "options": { "hash-table": "GoIPFSv0", "state-target": 0, "state-mask-bits": 17, "min-size": 87381, "max-size": 393216 } }
+  ],
+  "profiles": {
+    "dagcbor": {
+      "collectors": "fixed-outdegree_max-outdegree=174",
+      "node-encoder": { "name": "dagcbor", "options": { "link-dag-sizes": true } }
+    }
+  }
+}`,
+	"chains.yaml": `
+hash: sha2-256
+inline-max-size: 36
+chunkers:
+  - name: buzhash
+    options: { hash-table: GoIPFSv0, state-target: 0, state-mask-bits: 17, min-size: 87381, max-size: 393216 }
+profiles:
+  dagcbor:
+    collectors: fixed-outdegree_max-outdegree=174
+    node-encoder: { name: dagcbor, options: { link-dag-sizes: true } }
+`,
+}
+
+// Whatever the format, a --config / --profile combination must expand to
+// exactly the options it stands for, and result in the same roots as typing
+// those out. The command line takes precedence over both
+func TestConfigMatchesArgv(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dagger-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempdir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := make([]byte, 3<<20+7)
+	rand.New(rand.NewSource(42)).Read(payload)
+
+	chain := []string{
+		"--hash=sha2-256",
+		"--chunkers=buzhash_hash-table=GoIPFSv0_max-size=393216_min-size=87381_state-mask-bits=17_state-target=0",
+		"--collectors=fixed-outdegree_max-outdegree=174",
+		"--node-encoder=dagcbor_link-dag-sizes",
+	}
+
+	type testCase struct {
+		desc   string
+		preset []string
+		argv   []string
+	}
+	var cases []testCase
+	for name, cmd := range builtinProfiles {
+		cases = append(cases, testCase{
+			name,
+			[]string{"--profile=" + name},
+			[]string{"--ipfs-add-compatible-command=" + cmd},
+		})
+	}
+	for name, content := range configFileFixtures {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+		cases = append(cases,
+			testCase{
+				name + " profile",
+				[]string{"--config=" + path, "--profile=dagcbor"},
+				append([]string{"--inline-max-size=36"}, chain...),
+			},
+			testCase{
+				name + " profile overridden",
+				[]string{"--config=" + path, "--profile=dagcbor", "--inline-max-size=0"},
+				append([]string{"--inline-max-size=0"}, chain...),
+			},
+		)
+	}
+
+	for _, tc := range cases {
+		var results [2]struct {
+			roots []string
+			argv  []string
+		}
+		for i, args := range [][]string{tc.preset, tc.argv} {
+			out := testRun(t, args, bytes.NewReader(payload), emRootsJsonl, emStatsJsonl)
+
+			var stats struct {
+				Sys struct{ ArgvExpanded []string }
+			}
+			if err := json.Unmarshal(out[emStatsJsonl], &stats); err != nil {
+				t.Fatalf("Unexpected stats unmarshal error: %s", err)
+			}
+			results[i].roots = testRootCids(t, out[emRootsJsonl])
+			results[i].argv = stats.Sys.ArgvExpanded
+		}
+
+		if !reflect.DeepEqual(results[0].argv, results[1].argv) {
+			t.Fatalf("%s: expanded argv\n%v\ndiffers from the equivalent\n%v", tc.desc, results[0].argv, results[1].argv)
+		}
+		if !reflect.DeepEqual(results[0].roots, results[1].roots) {
+			t.Fatalf("%s: roots %v differ from the equivalent %v", tc.desc, results[0].roots, results[1].roots)
+		}
+	}
+}
@@ -3,9 +3,7 @@ package dagger
 import (
 	"io"
 	"os"
-	"runtime"
 	"sync"
-	"time"
 
 	"github.com/ipfs/go-qringbuf"
 	"github.com/ribasushi/DAGger/internal/constants"
@@ -14,6 +12,8 @@ import (
 	"github.com/ribasushi/DAGger/chunker"
 	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
 	"github.com/ribasushi/DAGger/internal/dagger/chunker/buzhash"
+	"github.com/ribasushi/DAGger/internal/dagger/chunker/compressedblocks"
+	"github.com/ribasushi/DAGger/internal/dagger/chunker/fastcdc"
 	"github.com/ribasushi/DAGger/internal/dagger/chunker/fixedsize"
 	"github.com/ribasushi/DAGger/internal/dagger/chunker/padfinder"
 	"github.com/ribasushi/DAGger/internal/dagger/chunker/pigz"
@@ -27,6 +27,7 @@ import (
 	"github.com/ribasushi/DAGger/internal/dagger/collector/trickle"
 
 	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+	"github.com/ribasushi/DAGger/internal/dagger/encoder/dagcbor"
 	"github.com/ribasushi/DAGger/internal/dagger/encoder/unixfsv1"
 )
 
@@ -34,8 +35,11 @@ var availableChunkers = map[string]dgrchunker.Initializer{
 	"pad-finder": padfinder.NewChunker,
 	"fixed-size": fixedsize.NewChunker,
 	"buzhash":    buzhash.NewChunker,
+	"fastcdc":    fastcdc.NewChunker,
 	"rabin":      rabin.NewChunker,
 	"pigz":       pigz.NewChunker,
+
+	"compressed-blocks": compressedblocks.NewChunker,
 }
 var availableCollectors = map[string]dgrcollector.Initializer{
 	"none":                noop.NewCollector,
@@ -46,6 +50,7 @@ var availableCollectors = map[string]dgrcollector.Initializer{
 }
 var availableNodeEncoders = map[string]dgrencoder.Initializer{
 	"unixfsv1": unixfsv1.NewEncoder,
+	"dagcbor":  dagcbor.NewEncoder,
 }
 
 type dgrChunkerUnit struct {
@@ -54,10 +59,16 @@ type dgrChunkerUnit struct {
 	constants dgrchunker.InstanceConstants
 }
 
+// Either a block to write out, or when splitting .car output, a marker that
+// every block of the stream with the given root has been queued
 type carUnit struct {
-	_      constants.Incomparabe
-	hdr    *dgrblock.Header
-	region *qringbuf.Region
+	_           constants.Incomparabe
+	hdr         *dgrblock.Header
+	region      *qringbuf.Region
+	streamRoot  *dgrblock.Header
+	streamNum   int64
+	splitStream *carSplitStream
+	splitClaim  *carSplitClaim
 }
 
 type Dagger struct {
@@ -72,19 +83,40 @@ type Dagger struct {
 	chainedChunkers   []dgrChunkerUnit
 	chainedCollectors []dgrcollector.Collector
 	formattedCid      func(*dgrblock.Header) string
+	blockMaker        dgrblock.Maker
 	externalEventBus  chan<- IngestionEvent
 	qrb               *qringbuf.QuantizedRingBuffer
 	asyncWG           sync.WaitGroup
+	asyncHashersWG    sync.WaitGroup
 	asyncHashingBus   dgrblock.AsyncHashingBus
 	mu                sync.Mutex
-	seenBlocks        seenBlocks
+	seenBlocks        *seenBlocks
 	seenRoots         seenRoots
+	seenInlinedRoots  map[string]seenRoot
 	carDataQueue      chan carUnit
 	carWriteError     chan error
 	carDataWriter     io.Writer
+	carFile           *carFileState
+	carSplit          *carSplitState
+	carSplitStreams   *carSplitStreams
+	dirTree           *dirTree
+	tarInput          *tarInput
+	sparseInput       *sparseInput
+	dedupIndex        *dedupIndexState
+	carNulBlockQueued bool
 	carFifoDirectory  string
 	carFifoData       *os.File
 	carFifoPins       *os.File
+
+	// progress-{jsonl,text} reporting, nil when neither is active
+	progress *progressTracker
+
+	// recipe-jsonl, --recipe-file and --recipe-car-block, nil when none is active
+	recipe *recipeState
+
+	// --multipart-parallel: workers, or the parent of a worker
+	parallelWorkers []*Dagger
+	parent          *Dagger
 }
 
 var CheckGoroutineShutdown bool
@@ -92,22 +124,21 @@ var CheckGoroutineShutdown bool
 func (dgr *Dagger) Destroy() {
 	dgr.mu.Lock()
 	if dgr.asyncHashingBus != nil {
-		wantCount := runtime.NumGoroutine() - dgr.cfg.AsyncHashers
 		close(dgr.asyncHashingBus)
 		dgr.asyncHashingBus = nil
 
 		if constants.PerformSanityChecks {
 			dgr.mu.Unlock()
-			// we will be checking for leaked goroutines - wait a bit for hashers to shut down
-			for {
-				time.Sleep(2 * time.Millisecond)
-				if runtime.NumGoroutine() <= wantCount {
-					break
-				}
-			}
+			// we will be checking for leaked goroutines - wait for hashers to shut down
+			// do not count goroutines: other instances may be running in the same process
+			dgr.asyncHashersWG.Wait()
 			dgr.mu.Lock()
 		}
 	}
+	if dgr.dedupIndex != nil {
+		dgr.dedupIndex.close()
+		dgr.dedupIndex = nil
+	}
 	dgr.qrb = nil
 	dgr.mu.Unlock()
 }
@@ -0,0 +1,114 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	decompressNone         = "none"
+	decompressAuto         = "auto"
+	decompressGzip         = "gzip"
+	decompressZstd         = "zstd"
+	decompressXz           = "xz"
+	decompressSniffBufSize = 256 * 1024
+)
+
+var decompressMagics = []struct {
+	format string
+	magic  []byte
+}{
+	{decompressGzip, []byte{0x1F, 0x8B}},
+	{decompressZstd, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+	{decompressXz, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+func (dgr *Dagger) setupDecompress() (argErrs []string) {
+
+	cfg := &dgr.cfg
+
+	switch cfg.Decompress {
+	case decompressNone, decompressAuto, decompressGzip, decompressZstd, decompressXz:
+	default:
+		argErrs = append(argErrs, fmt.Sprintf(
+			"Invalid --decompress '%s', expecting one of '%s', '%s', '%s', '%s' or '%s'",
+			cfg.Decompress,
+			decompressNone,
+			decompressAuto,
+			decompressGzip,
+			decompressZstd,
+			decompressXz,
+		))
+	}
+
+	return
+}
+
+// Called once per ProcessReader, before anything else looks at the input. The
+// returned release func stops any decoder goroutines and must always be called
+func (dgr *Dagger) decompressingReader(inputReader io.Reader) (r io.Reader, release func(), err error) {
+
+	release = func() {}
+	br := bufio.NewReaderSize(inputReader, decompressSniffBufSize)
+
+	format := dgr.cfg.Decompress
+	if format == decompressAuto {
+		format = decompressNone
+		// a short input is fine: it simply matches nothing
+		head, _ := br.Peek(6)
+		for _, m := range decompressMagics {
+			if bytes.HasPrefix(head, m.magic) {
+				format = m.format
+				break
+			}
+		}
+	}
+	if format != decompressNone {
+		dgr.statSummary.InputCompression = format
+	}
+
+	switch format {
+	case decompressNone:
+		return br, release, nil
+	case decompressGzip:
+		var gzr *gzip.Reader
+		if gzr, err = gzip.NewReader(br); err != nil {
+			return nil, release, fmt.Errorf("gzip decompression failed: %s", err)
+		}
+		return decompressErrorReader{r: gzr, format: format}, func() { gzr.Close() }, nil
+	case decompressXz:
+		var xzr *xz.Reader
+		if xzr, err = xz.NewReader(br); err != nil {
+			return nil, release, fmt.Errorf("xz decompression failed: %s", err)
+		}
+		return decompressErrorReader{r: xzr, format: format}, release, nil
+	}
+
+	// consecutive frames are decoded as one stream: a compressed dezstd framing
+	// ( or a concatenation of several ) is thus valid --multipart input
+	var zr *zstd.Decoder
+	if zr, err = zstd.NewReader(br); err != nil {
+		return nil, release, fmt.Errorf("zstd decompression failed: %s", err)
+	}
+	return decompressErrorReader{r: zr, format: format}, zr.Close, nil
+}
+
+// Decoder errors surface through the ring buffer: give them some context
+type decompressErrorReader struct {
+	r      io.Reader
+	format string
+}
+
+func (d decompressErrorReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s decompression failed: %s", d.format, err)
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The --multipart framing emitted by maint/src/dezstd, compressed as a whole,
+// must result in the very same roots as the uncompressed framing. The zstd
+// variant is split over two separately compressed streams, the way a
+// concatenation of several dezstd outputs would be
+func TestDecompressMultipart(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	var framing bytes.Buffer
+	var halfway int
+	for i, size := range []int{3 << 20, 0, 12345, 1 << 20, 1} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		binary.Write(&framing, binary.BigEndian, int64(size))
+		framing.Write(b)
+		if i == 2 {
+			halfway = framing.Len()
+		}
+	}
+	plain := framing.Bytes()
+
+	var zstdIn bytes.Buffer
+	for _, part := range [][]byte{plain[:halfway], plain[halfway:]} {
+		zw, err := zstd.NewWriter(&zstdIn)
+		if err != nil {
+			t.Fatalf("Unexpected zstd initialization error: %s", err)
+		}
+		if _, err := zw.Write(part); err != nil {
+			t.Fatalf("Unexpected zstd write error: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Unexpected zstd close error: %s", err)
+		}
+	}
+
+	var gzipIn bytes.Buffer
+	gw := gzip.NewWriter(&gzipIn)
+	if _, err := gw.Write(plain); err != nil {
+		t.Fatalf("Unexpected gzip write error: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Unexpected gzip close error: %s", err)
+	}
+
+	args := []string{
+		"--ipfs-add-compatible-command=--cid-version=1",
+		"--multipart",
+	}
+
+	expected := testRootCids(t, testRun(t, args, bytes.NewReader(plain), emRootsJsonl)[emRootsJsonl])
+	if len(expected) != 5 {
+		t.Fatalf("Expected 5 roots from the uncompressed input, got %d", len(expected))
+	}
+
+	for _, tc := range []struct {
+		format string
+		input  []byte
+	}{
+		{decompressZstd, zstdIn.Bytes()},
+		{decompressGzip, gzipIn.Bytes()},
+		{decompressAuto, zstdIn.Bytes()},
+		{decompressAuto, gzipIn.Bytes()},
+		{decompressAuto, plain},
+	} {
+		roots := testRootCids(t, testRun(
+			t,
+			append(args, "--decompress="+tc.format),
+			bytes.NewReader(tc.input),
+			emRootsJsonl,
+		)[emRootsJsonl])
+
+		if !reflect.DeepEqual(roots, expected) {
+			t.Fatalf("--decompress=%s resulted in roots %v instead of %v", tc.format, roots, expected)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
+)
+
+// An append-only log of the binary CIDs of every block written out by a car
+// emitter in a previous run, each prefixed by its varint length
+const (
+	dedupIndexMagic     = "DAGger dedup-index v1\n"
+	dedupIndexMaxCidLen = 127
+
+	// Amount of keys sorted in memory at a time while loading the log
+	dedupIndexRunEntries = 1 << 22
+)
+
+// The log is locked for the entire run. Its keys are loaded into sorted runs
+// within temporary files, of which only the bloom filters stay in memory, same
+// as the spilled seenBlocks. The CIDs of the blocks written by this run are
+// spooled to another temporary file, and appended to the log by
+// appendDedupIndex() once the car output is complete
+type dedupIndexState struct {
+	fh           *os.File
+	size         int64 // offset of the end of the last intact record
+	runs         []*spillRun
+	pending      *os.File
+	pendingW     *bufio.Writer
+	pendingCount int64
+	err          error // first lookup/spooling error, surfaced by appendDedupIndex()
+}
+
+func (dgr *Dagger) setupDedupIndex() (argErrs []string) {
+
+	if dgr.carDataWriter == nil && dgr.carSplit == nil {
+		return []string{"--dedup-index requires an active .car emitter"}
+	}
+
+	fh, err := os.OpenFile(dgr.cfg.DedupIndex, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to open --dedup-index: %s", err)}
+	}
+
+	di := &dedupIndexState{fh: fh}
+
+	if err := lockFile(fh); err != nil {
+		fh.Close()
+		return []string{fmt.Sprintf("unable to lock --dedup-index '%s', is another run using it? %s", dgr.cfg.DedupIndex, err)}
+	}
+
+	known, err := di.load()
+	if err == nil {
+		if di.pending, err = ioutil.TempFile("", "dagger-dedup-pending-"); err == nil {
+			di.pendingW = bufio.NewWriterSize(di.pending, 1<<20)
+		}
+	}
+	if err != nil {
+		di.close()
+		return []string{fmt.Sprintf("unable to load --dedup-index '%s': %s", dgr.cfg.DedupIndex, err)}
+	}
+
+	dgr.dedupIndex = di
+	dgr.statSummary.DedupIndex = &dedupIndexStats{KnownBlocks: known}
+	return
+}
+
+func (di *dedupIndexState) load() (known int64, err error) {
+
+	r := bufio.NewReaderSize(di.fh, 1<<20)
+
+	magic := make([]byte, len(dedupIndexMagic))
+	if n, err := io.ReadFull(r, magic); err == io.EOF {
+		// a brand new index
+		if _, err := di.fh.WriteString(dedupIndexMagic); err != nil {
+			return 0, err
+		}
+		di.size = int64(len(dedupIndexMagic))
+		return 0, nil
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	} else if n < len(magic) || !bytes.Equal(magic, []byte(dedupIndexMagic)) {
+		return 0, fmt.Errorf("not a dedup-index file")
+	}
+	di.size = int64(len(magic))
+
+	keys := make([][seenHashSize]byte, 0, 1024)
+	cid := make([]byte, dedupIndexMaxCidLen)
+	for {
+		cidLen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// a partially written record from an interrupted run: discard below
+			break
+		} else if err != nil {
+			return 0, err
+		} else if cidLen < seenHashSize || cidLen > dedupIndexMaxCidLen {
+			return 0, fmt.Errorf("invalid record length %d at offset %d", cidLen, di.size)
+		}
+
+		if _, err := io.ReadFull(r, cid[:cidLen]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		// same key as seenKey() derives
+		var k [seenHashSize]byte
+		copy(k[:], cid[cidLen-seenHashSize:cidLen])
+		keys = append(keys, k)
+		known++
+		di.size += int64(encoding.VarintWireSize(cidLen)) + int64(cidLen)
+
+		if len(keys) == dedupIndexRunEntries {
+			if err := di.addRun(keys); err != nil {
+				return 0, err
+			}
+			keys = keys[:0]
+		}
+	}
+	if len(keys) > 0 {
+		if err := di.addRun(keys); err != nil {
+			return 0, err
+		}
+	}
+
+	// drop any incomplete trailing record, and position for appending
+	if err := di.fh.Truncate(di.size); err != nil {
+		return 0, err
+	}
+	_, err = di.fh.Seek(di.size, io.SeekStart)
+	return known, err
+}
+
+func (di *dedupIndexState) addRun(keys [][seenHashSize]byte) error {
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	fh, err := ioutil.TempFile("", "dagger-dedup-index-")
+	if err != nil {
+		return err
+	}
+	r := &spillRun{
+		fh:      fh,
+		recSize: seenHashSize,
+		entries: int64(len(keys)),
+		filter:  newBloomFilter(len(keys)),
+	}
+	// register right away, so that close() cleans up after a failure
+	di.runs = append(di.runs, r)
+
+	w := bufio.NewWriterSize(fh, 1<<20)
+	for i := range keys {
+		if _, err := w.Write(keys[i][:]); err != nil {
+			return err
+		}
+		r.filter.add(&keys[i])
+	}
+	return w.Flush()
+}
+
+// Returns whether the block was emitted in a previous run, otherwise spools
+// its CID for recording. Must be called under dgr.mu
+func (di *dedupIndexState) seenBefore(k *[seenHashSize]byte, hdr *dgrblock.Header) bool {
+
+	for _, r := range di.runs {
+		if !r.filter.mayContain(k) {
+			continue
+		}
+		found, err := r.lookup(k)
+		if err != nil {
+			// writing the block out again is the safe choice for the car output
+			if di.err == nil {
+				di.err = fmt.Errorf("looking up --dedup-index failed: %s", err)
+			}
+			break
+		}
+		if found {
+			return true
+		}
+	}
+
+	cid := hdr.Cid()
+	_, err := di.pendingW.Write(encoding.VarintSlice(uint64(len(cid))))
+	if err == nil {
+		_, err = di.pendingW.Write(cid)
+	}
+	if err != nil && di.err == nil {
+		di.err = fmt.Errorf("spooling --dedup-index records failed: %s", err)
+	}
+	di.pendingCount++
+	return false
+}
+
+// Records the blocks emitted by this run, only called when the car output
+// completed successfully
+func (dgr *Dagger) appendDedupIndex() error {
+	di := dgr.dedupIndex
+
+	if di.err != nil {
+		return di.err
+	}
+
+	if err := di.pendingW.Flush(); err != nil {
+		return fmt.Errorf("spooling --dedup-index records failed: %s", err)
+	}
+	if _, err := di.pending.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("spooling --dedup-index records failed: %s", err)
+	}
+	if _, err := io.Copy(di.fh, di.pending); err != nil {
+		return fmt.Errorf("appending to --dedup-index failed: %s", err)
+	}
+	if err := di.fh.Sync(); err != nil {
+		return fmt.Errorf("syncing --dedup-index failed: %s", err)
+	}
+
+	dgr.statSummary.DedupIndex.AddedBlocks = di.pendingCount
+	return nil
+}
+
+// Removes the temporary files, and releases the lock by closing the log
+func (di *dedupIndexState) close() (err error) {
+	for _, r := range di.runs {
+		if e := r.remove(); e != nil && err == nil {
+			err = e
+		}
+	}
+	di.runs = nil
+
+	if di.pending != nil {
+		if e := di.pending.Close(); e != nil && err == nil {
+			err = e
+		}
+		if e := os.Remove(di.pending.Name()); e != nil && err == nil {
+			err = e
+		}
+		di.pending = nil
+	}
+
+	if e := di.fh.Close(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
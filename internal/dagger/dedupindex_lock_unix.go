@@ -0,0 +1,14 @@
+// +build !windows
+
+package dagger
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// An exclusive advisory lock, released when fh is closed
+func lockFile(fh *os.File) error {
+	return unix.Flock(int(fh.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
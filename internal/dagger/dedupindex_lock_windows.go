@@ -0,0 +1,19 @@
+package dagger
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// An exclusive lock, released when fh is closed
+func lockFile(fh *os.File) error {
+	return windows.LockFileEx(
+		windows.Handle(fh.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0,
+		1,
+		0,
+		new(windows.Overlapped),
+	)
+}
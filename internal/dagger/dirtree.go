@@ -0,0 +1,209 @@
+package dagger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+)
+
+// same as PATH_MAX on most systems
+const maxMultipartPathLen = 4096
+
+// Accumulates the per-file roots of a --multipart-paths stream, to be
+// assembled into directories once the input is exhausted
+type dirTree struct {
+	enc  dgrencoder.DirectoryEncoder
+	root *dirNode
+	wrap bool // a single root for the top-level directory itself
+}
+
+type dirNode struct {
+	path     string
+	explicit bool
+	names    []string // insertion order
+	entries  map[string]*dirEntry
+}
+
+type dirEntry struct {
+	dir  *dirNode
+	file *dgrblock.Header
+}
+
+func newDirTree(enc dgrencoder.DirectoryEncoder) *dirTree {
+	return &dirTree{
+		enc:  enc,
+		root: &dirNode{entries: make(map[string]*dirEntry)},
+	}
+}
+
+func (dgr *Dagger) readMultipartPath(r io.Reader) (path string, err error) {
+	var pathLen int64
+	err = binary.Read(r, binary.BigEndian, &pathLen)
+	dgr.statSummary.SysStats.ReadCalls++
+	if err == io.EOF {
+		return
+	} else if err != nil {
+		return "", fmt.Errorf("error reading next 8-byte multipart path length: %s", err)
+	}
+
+	if pathLen < 1 || pathLen > maxMultipartPathLen {
+		return "", fmt.Errorf("multipart path length %d out of bounds [1:%d]", pathLen, maxMultipartPathLen)
+	}
+
+	buf := make([]byte, pathLen)
+	_, err = io.ReadFull(r, buf)
+	dgr.statSummary.SysStats.ReadCalls++
+	if err != nil {
+		return "", fmt.Errorf("error reading %d-byte multipart path: %s", pathLen, err)
+	}
+
+	path = string(buf)
+	for _, c := range strings.Split(path, "/") {
+		if c == "" || c == "." || c == ".." {
+			return "", fmt.Errorf("invalid multipart path '%s': empty, '.' and '..' components are not allowed", path)
+		}
+	}
+
+	return
+}
+
+// Returns the directory holding the last component of the path, creating
+// any missing intermediate directories along the way
+func (dt *dirTree) parentOf(path string) (parent *dirNode, name string, err error) {
+	comps := strings.Split(path, "/")
+	parent = dt.root
+
+	for _, c := range comps[:len(comps)-1] {
+		e, exists := parent.entries[c]
+		if !exists {
+			e = &dirEntry{dir: &dirNode{
+				path:    strings.TrimPrefix(parent.path+"/"+c, "/"),
+				entries: make(map[string]*dirEntry),
+			}}
+			parent.entries[c] = e
+			parent.names = append(parent.names, c)
+		} else if e.dir == nil {
+			return nil, "", fmt.Errorf("path '%s' traverses '%s', which is a file", path, strings.TrimPrefix(parent.path+"/"+c, "/"))
+		}
+		parent = e.dir
+	}
+
+	return parent, comps[len(comps)-1], nil
+}
+
+func (dt *dirTree) addDir(path string) error {
+	parent, name, err := dt.parentOf(path)
+	if err != nil {
+		return err
+	}
+
+	if e, exists := parent.entries[name]; !exists {
+		parent.entries[name] = &dirEntry{dir: &dirNode{
+			path:     path,
+			explicit: true,
+			entries:  make(map[string]*dirEntry),
+		}}
+		parent.names = append(parent.names, name)
+	} else if e.dir == nil || e.dir.explicit {
+		return fmt.Errorf("path '%s' encountered more than once", path)
+	} else {
+		e.dir.explicit = true
+	}
+
+	return nil
+}
+
+func (dt *dirTree) addFile(path string, root *dgrblock.Header) error {
+	parent, name, err := dt.parentOf(path)
+	if err != nil {
+		return err
+	}
+
+	if _, exists := parent.entries[name]; exists {
+		return fmt.Errorf("path '%s' encountered more than once", path)
+	}
+	parent.entries[name] = &dirEntry{file: root}
+	parent.names = append(parent.names, name)
+
+	return nil
+}
+
+// Encodes every directory bottom-up, and registers the top-level entries as
+// the roots of the stream, or with wrap the top-level directory itself
+func (dgr *Dagger) emitDirectories() error {
+
+	dt := dgr.dirTree
+	origin := dgrencoder.NodeOrigin{OriginatingLayer: len(dgr.chainedCollectors) + 1}
+
+	var encodeDir func(d *dirNode) (*dgrblock.Header, error)
+	encodeDir = func(d *dirNode) (*dgrblock.Header, error) {
+
+		entries := make([]dgrencoder.DirectoryEntry, 0, len(d.names))
+		for _, n := range d.names {
+			e := d.entries[n]
+			b := e.file
+			if e.dir != nil {
+				var err error
+				if b, err = encodeDir(e.dir); err != nil {
+					return nil, err
+				}
+			}
+			entries = append(entries, dgrencoder.DirectoryEntry{Name: n, Block: b})
+		}
+
+		dirBlock, err := dt.enc.NewDirectory(origin, entries)
+		if err != nil {
+			return nil, fmt.Errorf("directory '%s': %s", d.path, err)
+		}
+
+		jsonl := fmt.Sprintf(
+			"{\"event\":    \"dir\", \"payload\":%12d, \"entries\":%6d, %-67s, \"wiresize\":%12d, \"path\":%s }\n",
+			dirBlock.SizeCumulativePayload(),
+			len(entries),
+			fmt.Sprintf(`"cid":"%s"`, dgr.formattedCid(dirBlock)),
+			dirBlock.SizeCumulativeDag(),
+			jsonString(d.path),
+		)
+		dgr.maybeSendEvent(NewRootJsonl, jsonl)
+		if dgr.cfg.emitters[emRootsJsonl] != nil {
+			if _, err := io.WriteString(dgr.cfg.emitters[emRootsJsonl], jsonl); err != nil {
+				return nil, fmt.Errorf("emitting '%s' failed: %s", emRootsJsonl, err)
+			}
+		}
+
+		return dirBlock, nil
+	}
+
+	if dt.wrap {
+		b, err := encodeDir(dt.root)
+		if err != nil {
+			return err
+		}
+		dgr.registerRoot(b)
+		return nil
+	}
+
+	for _, n := range dt.root.names {
+		e := dt.root.entries[n]
+		b := e.file
+		if e.dir != nil {
+			var err error
+			if b, err = encodeDir(e.dir); err != nil {
+				return err
+			}
+		}
+		dgr.registerRoot(b)
+	}
+
+	return nil
+}
+
+func jsonString(s string) string {
+	j, _ := json.Marshal(s) // can not fail on a string
+	return string(j)
+}
@@ -9,6 +9,17 @@ type NodeEncoder interface {
 	NewLink(origin NodeOrigin, blocksToLink []*dgrblock.Header) (linkBlock *dgrblock.Header)
 }
 
+// DirectoryEncoder is implemented by node encoders capable of representing a
+// named collection of already encoded roots, e.g. a UnixFS directory
+type DirectoryEncoder interface {
+	NewDirectory(origin NodeOrigin, entries []DirectoryEntry) (dirBlock *dgrblock.Header, err error)
+}
+
+type DirectoryEntry struct {
+	Name  string
+	Block *dgrblock.Header
+}
+
 type NodeOrigin struct {
 	OriginatingLayer int
 	LocalSubLayer    int
@@ -0,0 +1,43 @@
+package dagcbor
+
+import (
+	"fmt"
+
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/DAGger/internal/dagger/util/argparser"
+)
+
+func NewEncoder(args []string, dgrCfg *dgrencoder.DaggerConfig) (_ dgrencoder.NodeEncoder, initErrs []string) {
+
+	e := &encoder{
+		DaggerConfig: dgrCfg,
+	}
+
+	optSet := getopt.New()
+	if err := options.RegisterSet("", &e.config, optSet); err != nil {
+		initErrs = []string{fmt.Sprintf("option set registration failed: %s", err)}
+		return
+	}
+
+	// on nil-args the "error" is the help text to be incorporated into
+	// the larger help display
+	if args == nil {
+		initErrs = argparser.SubHelp(
+			"Generates raw leaves, linked by canonical DAG-CBOR nodes of the form\n"+
+				"{ \"links\": [ CID, ... ], \"dagSizes\": [ uint, ... ], \"payloadSizes\": [ uint, ... ] }\n"+
+				"with the sizes of each link present only when requested.",
+			optSet,
+		)
+		return
+	}
+
+	// bail early if getopt fails
+	if initErrs = argparser.Parse(args, optSet); len(initErrs) > 0 {
+		return
+	}
+
+	return e, initErrs
+}
@@ -0,0 +1,140 @@
+package dagcbor
+
+import (
+	"bytes"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+
+	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
+	"github.com/ribasushi/DAGger/internal/zcpstring"
+)
+
+type config struct {
+	LinkDagSizes     bool `getopt:"--link-dag-sizes     Add a 'dagSizes' list holding the cumulative on-wire size of the DAG under each link"`
+	LinkPayloadSizes bool `getopt:"--link-payload-sizes Add a 'payloadSizes' list holding the cumulative payload size under each link"`
+}
+
+type encoder struct {
+	config
+	*dgrencoder.DaggerConfig
+}
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTagCid = "\xd8\x2a" // tag(42)
+)
+
+// keys of canonical DAG-CBOR maps are ordered length-first
+const (
+	keyLinks        = "links"
+	keyDagSizes     = "dagSizes"
+	keyPayloadSizes = "payloadSizes"
+)
+
+func (e *encoder) NewLeaf(ds dgrblock.DataSource) *dgrblock.Header {
+	return e.BlockMaker(
+		ds.Content,
+		dgrblock.CodecRaw,
+		uint64(ds.Size),
+		0,
+	)
+}
+
+func (e *encoder) NewLink(origin dgrencoder.NodeOrigin, blocks []*dgrblock.Header) *dgrblock.Header {
+
+	// a nul-leaf requested by a collector
+	if blocks == nil {
+		h := e.BlockMaker(nil, dgrblock.CodecRaw, 0, 0)
+		e.NewLinkBlockCallback(origin, h, nil)
+		return h
+	}
+
+	var totalPayload, subDagSize uint64
+	dagSizes := make([]uint64, len(blocks))
+	payloadSizes := make([]uint64, len(blocks))
+
+	mapLen := 1
+	size := textWiresize(keyLinks) + encoding.CborHeaderWiresize(uint64(len(blocks)))
+
+	for i := range blocks {
+		cidLen := uint64(len(blocks[i].Cid()) + 1)
+		size += len(cborTagCid) + encoding.CborHeaderWiresize(cidLen) + int(cidLen)
+
+		dagSizes[i] = blocks[i].SizeCumulativeDag()
+		payloadSizes[i] = blocks[i].SizeCumulativePayload()
+		totalPayload += payloadSizes[i]
+		subDagSize += dagSizes[i]
+	}
+	if e.LinkDagSizes {
+		mapLen++
+		size += textWiresize(keyDagSizes) + uintListWiresize(dagSizes)
+	}
+	if e.LinkPayloadSizes {
+		mapLen++
+		size += textWiresize(keyPayloadSizes) + uintListWiresize(payloadSizes)
+	}
+	size += encoding.CborHeaderWiresize(uint64(mapLen))
+
+	// writes to a bytes.Buffer do not fail
+	b := bytes.NewBuffer(make([]byte, 0, size))
+	encoding.CborHeaderWrite(b, cborMap, uint64(mapLen))
+
+	writeText(b, keyLinks)
+	encoding.CborHeaderWrite(b, cborArray, uint64(len(blocks)))
+	for i := range blocks {
+		cid := blocks[i].Cid()
+		b.WriteString(cborTagCid)
+		encoding.CborHeaderWrite(b, cborBytes, uint64(len(cid)+1))
+		b.WriteByte(0) // the binary multibase prefix
+		b.Write(cid)
+	}
+
+	if e.LinkDagSizes {
+		writeText(b, keyDagSizes)
+		writeUintList(b, dagSizes)
+	}
+	if e.LinkPayloadSizes {
+		writeText(b, keyPayloadSizes)
+		writeUintList(b, payloadSizes)
+	}
+
+	h := e.BlockMaker(
+		zcpstring.WrapSlice(b.Bytes()),
+		dgrblock.CodecCBOR,
+		totalPayload,
+		subDagSize,
+	)
+
+	e.NewLinkBlockCallback(origin, h, nil)
+	return h
+}
+
+func textWiresize(s string) int {
+	return encoding.CborHeaderWiresize(uint64(len(s))) + len(s)
+}
+
+func writeText(b *bytes.Buffer, s string) {
+	encoding.CborHeaderWrite(b, cborText, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func uintListWiresize(l []uint64) (size int) {
+	size = encoding.CborHeaderWiresize(uint64(len(l)))
+	for _, v := range l {
+		size += encoding.CborHeaderWiresize(v)
+	}
+	return
+}
+
+func writeUintList(b *bytes.Buffer, l []uint64) {
+	encoding.CborHeaderWrite(b, cborArray, uint64(len(l)))
+	for _, v := range l {
+		encoding.CborHeaderWrite(b, cborUint, v)
+	}
+}
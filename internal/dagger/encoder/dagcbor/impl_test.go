@@ -0,0 +1,112 @@
+package dagcbor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ribasushi/DAGger/chunker"
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+	"github.com/ribasushi/DAGger/internal/zcpstring"
+)
+
+// Link nodes are spelled out byte by byte, and their CIDs derived without any
+// of the DAGger machinery: a change in the canonical form can not go unnoticed
+func TestLinkNodes(t *testing.T) {
+
+	leafA := []byte("hello")
+	leafB := bytes.Repeat([]byte{0x42}, 300)
+
+	cidA := sha256Cid(0x55, leafA)
+	cidB := sha256Cid(0x55, leafB)
+	links := concat(
+		[]byte("\x65links\x82"),
+		[]byte("\xd8\x2a\x58\x25\x00"), cidA,
+		[]byte("\xd8\x2a\x58\x25\x00"), cidB,
+	)
+	sizes := []byte("\x82\x05\x19\x01\x2c")
+
+	for _, tc := range []struct {
+		args     []string
+		expected []byte
+		pinned   string
+	}{
+		{
+			[]string{"dagcbor"},
+			concat([]byte("\xa1"), links),
+			"bafyreieibie2i4yhp57l23dhwwlmy5dk33cne47ngqyib52rpbauftac4m",
+		},
+		{
+			[]string{"dagcbor", "--link-payload-sizes"},
+			concat([]byte("\xa2"), links, []byte("\x6cpayloadSizes"), sizes),
+			"bafyreifciudp6urrqky5ic2q6ex3eg6rcyk7qdxzxek757vxmlmjhy63vy",
+		},
+		{
+			[]string{"dagcbor", "--link-dag-sizes", "--link-payload-sizes"},
+			concat([]byte("\xa3"), links, []byte("\x68dagSizes"), sizes, []byte("\x6cpayloadSizes"), sizes),
+			"bafyreict2lrhcgxrntckc3xvjjnkntc33sfb5y4wosrzvajv26bn5ykcqi",
+		},
+	} {
+		var wg sync.WaitGroup
+		maker, _, errStr := dgrblock.MakerFromConfig("sha2-256", 32, 0, 0, &wg)
+		if errStr != "" {
+			t.Fatalf("Unexpected blockmaker initialization error: %s", errStr)
+		}
+
+		var callbacks int
+		enc, initErrs := NewEncoder(tc.args, &dgrencoder.DaggerConfig{
+			BlockMaker: maker,
+			HasherName: "sha2-256",
+			HasherBits: 256,
+			NewLinkBlockCallback: func(_ dgrencoder.NodeOrigin, _ *dgrblock.Header, _ []*dgrblock.Header) {
+				callbacks++
+			},
+		})
+		if len(initErrs) > 0 {
+			t.Fatalf("%v: unexpected initialization errors: %v", tc.args, initErrs)
+		}
+
+		leaves := make([]*dgrblock.Header, 2)
+		for i, l := range [][]byte{leafA, leafB} {
+			leaves[i] = enc.NewLeaf(dgrblock.DataSource{
+				Chunk:   chunker.Chunk{Size: len(l)},
+				Content: zcpstring.WrapSlice(l),
+			})
+		}
+		if !bytes.Equal(leaves[0].Cid(), cidA) || !bytes.Equal(leaves[1].Cid(), cidB) {
+			t.Fatalf("%v: unexpected raw leaf CIDs %X %X", tc.args, leaves[0].Cid(), leaves[1].Cid())
+		}
+
+		node := enc.NewLink(dgrencoder.NodeOrigin{}, leaves)
+		wg.Wait()
+
+		if content := node.Content().AppendTo(nil); !bytes.Equal(content, tc.expected) {
+			t.Fatalf("%v: link node\n%X\ndoes not match the expected\n%X", tc.args, content, tc.expected)
+		}
+		if !bytes.Equal(node.Cid(), sha256Cid(0x71, tc.expected)) {
+			t.Fatalf("%v: link node CID %X does not match the content", tc.args, node.Cid())
+		}
+		if cs := "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(node.Cid())); cs != tc.pinned {
+			t.Fatalf("%v: link node CID %s does not match the pinned %s", tc.args, cs, tc.pinned)
+		}
+		if node.SizeCumulativePayload() != 305 || node.SizeCumulativeDag() != uint64(305+len(tc.expected)) {
+			t.Fatalf("%v: unexpected cumulative sizes: payload %d, dag %d", tc.args, node.SizeCumulativePayload(), node.SizeCumulativeDag())
+		}
+		if callbacks != 1 {
+			t.Fatalf("%v: expected a single link block callback, got %d", tc.args, callbacks)
+		}
+	}
+}
+
+func sha256Cid(codec byte, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	return append([]byte{0x01, codec, 0x12, 0x20}, digest[:]...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -44,6 +44,10 @@ func NewEncoder(args []string, dgrCfg *dgrencoder.DaggerConfig) (_ dgrencoder.No
 		initErrs = append(initErrs, "when provided value of 'unixfs-leaf-decorator-type' can be only 0 or 2")
 	}
 
+	if e.HamtShardingThreshold < 0 {
+		initErrs = append(initErrs, "value of 'hamt-sharding-threshold' can not be negative")
+	}
+
 	if e.LegacyCIDv0Links &&
 		(e.HasherName != "sha2-256" ||
 			e.HasherBits != 256) {
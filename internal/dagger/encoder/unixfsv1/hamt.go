@@ -0,0 +1,94 @@
+package unixfsv1
+
+import (
+	"fmt"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
+	"github.com/twmb/murmur3"
+)
+
+// Parameters identical to go-unixfs/hamt: every shard level consumes 8 bits of
+// the first 64 bits of a murmur3-x64-128 over the entry name
+const (
+	hamtFanout      = 256
+	hamtHashMurmur3 = 0x22
+	hamtMaxDepth    = 64 / 8
+)
+
+// Entries within a bucket are named by the uppercase hex bucket index followed
+// by the entry name, while links to sub-shards carry the index alone
+func (e *encoder) newShard(origin dgrencoder.NodeOrigin, entries []dgrencoder.DirectoryEntry, depth int) (*dgrblock.Header, error) {
+
+	if depth >= hamtMaxDepth {
+		return nil, fmt.Errorf(
+			"unable to shard directory: %d entries share the same 64-bit name hash, e.g. '%s'",
+			len(entries),
+			entries[0].Name,
+		)
+	}
+
+	var buckets [hamtFanout][]dgrencoder.DirectoryEntry
+	for i := range entries {
+		idx := byte(murmur3.StringSum64(entries[i].Name) >> uint(56-8*depth))
+		buckets[idx] = append(buckets[idx], entries[i])
+	}
+
+	// big-endian, bit N representing bucket N
+	var bitfield [hamtFanout / 8]byte
+	links := make([]dgrencoder.DirectoryEntry, 0, hamtFanout)
+
+	for idx := range buckets {
+		if len(buckets[idx]) == 0 {
+			continue
+		}
+		bitfield[len(bitfield)-1-idx/8] |= 1 << uint(idx%8)
+
+		if len(buckets[idx]) == 1 {
+			links = append(links, dgrencoder.DirectoryEntry{
+				Name:  fmt.Sprintf("%02X%s", idx, buckets[idx][0].Name),
+				Block: buckets[idx][0].Block,
+			})
+			continue
+		}
+
+		sub, err := e.newShard(origin, buckets[idx], depth+1)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, dgrencoder.DirectoryEntry{
+			Name:  fmt.Sprintf("%02X", idx),
+			Block: sub,
+		})
+	}
+
+	// leading zero bytes are omitted, as in go-bitfield
+	bf := bitfield[:]
+	for len(bf) > 0 && bf[0] == 0 {
+		bf = bf[1:]
+	}
+
+	// 1 {
+	// 	1: 5
+	// 	2: bitfield
+	// 	5: 0x22
+	// 	6: 256
+	// }
+	fanoutVI := encoding.VarintSlice(hamtFanout)
+	bfLenVI := encoding.VarintSlice(uint64(len(bf)))
+	ufsLen := 2 + 1 + len(bfLenVI) + len(bf) + 2 + 1 + len(fanoutVI)
+
+	ufsData := make([]byte, 0, 1+len(encoding.VarintSlice(uint64(ufsLen)))+ufsLen)
+	ufsData = append(ufsData, pbHdrF1LD)
+	ufsData = append(ufsData, encoding.VarintSlice(uint64(ufsLen))...)
+	ufsData = append(ufsData, pbHdrF1VI, 5)
+	ufsData = append(ufsData, pbHdrF2LD)
+	ufsData = append(ufsData, bfLenVI...)
+	ufsData = append(ufsData, bf...)
+	ufsData = append(ufsData, pbHdrF5VI, hamtHashMurmur3)
+	ufsData = append(ufsData, pbHdrF6VI)
+	ufsData = append(ufsData, fanoutVI...)
+
+	return e.newDirBlock(origin, ufsData, links)
+}
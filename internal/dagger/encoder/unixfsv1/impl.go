@@ -1,6 +1,10 @@
 package unixfsv1
 
 import (
+	"fmt"
+	"sort"
+
+	"github.com/ribasushi/DAGger/internal/constants"
 	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
 	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
 
@@ -9,10 +13,11 @@ import (
 )
 
 type config struct {
-	CompatPb             bool `getopt:"--merkledag-compat-protobuf  Output merkledag links/data in non-canonical protobuf order for convergence with go-ipfs"`
-	LegacyCIDv0Links     bool `getopt:"--cidv0                      Generate compat-mode CIDv0 links"`
-	NonstandardLeanLinks bool `getopt:"--non-standard-lean-links    Omit dag-size and offset information from all links. While IPFS will likely render the result, ONE VOIDS ALL WARRANTIES"`
-	UnixFsType           int  `getopt:"--unixfs-leaf-decorator-type Generate leaves as full UnixFS nodes with the given UnixFSv1 type (0 or 2). When unspecified (default) uses raw leaves instead."`
+	CompatPb              bool `getopt:"--merkledag-compat-protobuf  Output merkledag links/data in non-canonical protobuf order for convergence with go-ipfs"`
+	LegacyCIDv0Links      bool `getopt:"--cidv0                      Generate compat-mode CIDv0 links"`
+	NonstandardLeanLinks  bool `getopt:"--non-standard-lean-links    Omit dag-size and offset information from all links. While IPFS will likely render the result, ONE VOIDS ALL WARRANTIES"`
+	UnixFsType            int  `getopt:"--unixfs-leaf-decorator-type Generate leaves as full UnixFS nodes with the given UnixFSv1 type (0 or 2). When unspecified (default) uses raw leaves instead."`
+	HamtShardingThreshold int  `getopt:"--hamt-sharding-threshold   Represent directories whose go-ipfs estimated size (sum of all entry name and link CID lengths) reaches this value as HAMT shards with fanout 256 and murmur3-64 hashing. 0 (default) disables sharding."`
 }
 
 type encoder struct {
@@ -155,6 +160,120 @@ func (e *encoder) NewLink(origin dgrencoder.NodeOrigin, blocks []*dgrblock.Heade
 	return h
 }
 
+// represents the protobuf
+// 1 {
+// 	1: 1
+// }
+var dirPb = []byte("\x0a\x02\x08\x01")
+
+func (e *encoder) NewDirectory(origin dgrencoder.NodeOrigin, entries []dgrencoder.DirectoryEntry) (*dgrblock.Header, error) {
+
+	// go-ipfs orders directory links by name
+	sorted := make([]dgrencoder.DirectoryEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	if e.HamtShardingThreshold > 0 {
+		// same estimate and inclusive comparison as go-unixfs
+		var estimatedSize int
+		for i := range sorted {
+			estimatedSize += len(sorted[i].Name) + len(e.linkCid(sorted[i].Block))
+		}
+		if estimatedSize >= e.HamtShardingThreshold {
+			return e.newShard(origin, sorted, 0)
+		}
+	}
+
+	return e.newDirBlock(origin, dirPb, sorted)
+}
+
+func (e *encoder) linkCid(b *dgrblock.Header) []byte {
+	cid := b.Cid()
+	if e.LegacyCIDv0Links &&
+		!b.IsCidInlined() &&
+		b.SizeCumulativePayload() != b.SizeCumulativeDag() {
+		cid = cid[2:]
+	}
+	return cid
+}
+
+// Encodes a node with the supplied UnixFS data and a named link to every
+// entry, in the order given
+func (e *encoder) newDirBlock(origin dgrencoder.NodeOrigin, ufsData []byte, links []dgrencoder.DirectoryEntry) (*dgrblock.Header, error) {
+
+	segmentsPerLink := 10
+	if e.NonstandardLeanLinks {
+		segmentsPerLink = 8
+	}
+
+	var totalPayload, subDagSize uint64
+	linkSection := zcpstring.NewWithSegmentCap(segmentsPerLink * len(links))
+
+	for i := range links {
+
+		b := links[i].Block
+		cid := e.linkCid(b)
+
+		cidLenVI := encoding.VarintSlice(uint64(len(cid)))
+		nameLenVI := encoding.VarintSlice(uint64(len(links[i].Name)))
+		frameLen := uint64(1 + len(cidLenVI) + len(cid) + 1 + len(nameLenVI) + len(links[i].Name))
+
+		var dagSizeVI []byte
+		if !e.NonstandardLeanLinks {
+			dagSizeVI = encoding.VarintSlice(b.SizeCumulativeDag())
+			frameLen += uint64(1 + len(dagSizeVI))
+		}
+
+		linkSection.AddByte(pbHdrF2LD)
+		linkSection.AddSlice(encoding.VarintSlice(frameLen))
+
+		linkSection.AddByte(pbHdrF1LD)
+		linkSection.AddSlice(cidLenVI)
+		linkSection.AddSlice(cid)
+
+		linkSection.AddByte(pbHdrF2LD)
+		linkSection.AddSlice(nameLenVI)
+		linkSection.AddSlice([]byte(links[i].Name))
+
+		if !e.NonstandardLeanLinks {
+			linkSection.AddByte(pbHdrF3VI)
+			linkSection.AddSlice(dagSizeVI)
+		}
+
+		totalPayload += b.SizeCumulativePayload()
+		subDagSize += b.SizeCumulativeDag()
+	}
+
+	if linkSection.Size()+len(ufsData) > constants.MaxBlockWireSize {
+		return nil, fmt.Errorf(
+			"directory with %d entries does not fit in a single block of %d bytes",
+			len(links),
+			constants.MaxBlockWireSize,
+		)
+	}
+
+	dirBlock := zcpstring.NewWithSegmentCap(segmentsPerLink*len(links) + 1)
+	if e.CompatPb {
+		dirBlock.AddZcp(linkSection)
+		dirBlock.AddSlice(ufsData)
+	} else {
+		dirBlock.AddSlice(ufsData)
+		dirBlock.AddZcp(linkSection)
+	}
+
+	h := e.BlockMaker(
+		dirBlock,
+		dgrblock.CodecPB,
+		totalPayload,
+		subDagSize,
+	)
+
+	e.NewLinkBlockCallback(origin, h, nil)
+	return h, nil
+}
+
 // represents the protobuf
 // 1 {
 // 	1: 2
@@ -177,6 +296,8 @@ const (
 	pbHdrF2VI
 	pbHdrF3VI
 	pbHdrF4VI
+	pbHdrF5VI
+	pbHdrF6VI
 )
 const (
 	pbHdrF1LD = 2 | ((iota + 1) << 3)
@@ -0,0 +1,138 @@
+package dagger
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// There is no go-ipfs counterpart to compare the fastcdc chunker against, so
+// the root CIDs of a fixed pseudo-random payload are pinned instead: any change
+// of the gear tables or of the boundary selection alters them
+var fastcdcFixtures = []struct {
+	chunker string
+	root    string
+	leaves  int // distinct ones
+}{
+	{
+		"fastcdc_gear-table=SHA256_state-mask-bits=13_normalization-level=2_min-size=2048_avg-size=8192_max-size=65536",
+		"bafybeic4ojbjmng7bvo4qxhe5grjjxmwupeiaintawpnohqjfljok54hka",
+		414,
+	},
+	{
+		"fastcdc_gear-table=SplitMix64_state-mask-bits=13_normalization-level=2_min-size=2048_avg-size=8192_max-size=65536",
+		"bafybeihjvdalduauqc33llrs7cq6leafsh3kceji2a6ckspwyzav7rbwue",
+		427,
+	},
+	{
+		"fastcdc_gear-table=SHA256_state-mask-bits=16_normalization-level=0_min-size=4096_avg-size=65536_max-size=262144",
+		"bafybeigivfaq6uoif42iodrjgs4hxnksfefv67tkfdsyqff365wzcvcbge",
+		65,
+	},
+	{
+		"fastcdc_gear-table=SplitMix64_state-target=5_state-mask-bits=14_normalization-level=1_min-size=0_avg-size=16384_max-size=131072",
+		"bafybeid7qrgyjbayuxkhg3ylkvul4z47d4v7zdchb7fxdebjjxnadep4te",
+		236,
+	},
+}
+
+func TestFastCDCPinned(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	payload := make([]byte, 4<<20)
+	rnd.Read(payload)
+
+	// a stretch of repeating text, where the gear state cycles
+	for i := 1 << 20; i < 1<<20+300000; i++ {
+		payload[i] = "DAGger"[i%6]
+	}
+
+	prefix := make([]byte, 12345)
+	rnd.Read(prefix)
+
+	for _, fx := range fastcdcFixtures {
+
+		run := runFastCDC(t, fx.chunker, bytes.NewReader(payload))
+		if run.root != fx.root || len(run.leaves) != fx.leaves {
+			t.Fatalf(
+				"Chunker %s: expected root CID %s over %d leaves, but instead generated %s over %d leaves",
+				fx.chunker,
+				fx.root,
+				fx.leaves,
+				run.root,
+				len(run.leaves),
+			)
+		}
+
+		// boundaries must not depend on how the reads are split
+		if rerun := runFastCDC(t, fx.chunker, &oddSizedReader{r: bytes.NewReader(payload)}); rerun.root != run.root {
+			t.Fatalf("Chunker %s: reading in odd-sized pieces resulted in root %s instead of %s", fx.chunker, rerun.root, run.root)
+		}
+
+		// and past the first few chunks must not depend on what precedes the data
+		prefixed := runFastCDC(t, fx.chunker, io.MultiReader(bytes.NewReader(prefix), bytes.NewReader(payload)))
+		var missing int
+		for l := range run.leaves {
+			if _, found := prefixed.leaves[l]; !found {
+				missing++
+			}
+		}
+		if missing > 3 {
+			t.Fatalf(
+				"Chunker %s: %d out of %d leaves of the unprefixed input not formed after a %d byte prefix",
+				fx.chunker,
+				missing,
+				len(run.leaves),
+				len(prefix),
+			)
+		}
+	}
+}
+
+type oddSizedReader struct {
+	r    io.Reader
+	call int
+}
+
+func (o *oddSizedReader) Read(p []byte) (int, error) {
+	o.call++
+	if max := 1 + (o.call*7919)%65521; len(p) > max {
+		p = p[:max]
+	}
+	return o.r.Read(p)
+}
+
+type fastcdcRun struct {
+	root   string
+	leaves map[string]struct{}
+}
+
+func runFastCDC(t *testing.T, chunkerSpec string, input io.Reader) *fastcdcRun {
+
+	out := testRun(
+		t,
+		[]string{
+			"--ipfs-add-compatible-command=--cid-version=1",
+			"--chunkers=" + chunkerSpec,
+			"--collectors=fixed-outdegree_max-outdegree=174",
+		},
+		input,
+		emRootsJsonl, emCarV0PinlessStream,
+	)
+
+	run := &fastcdcRun{
+		root:   testRootCids(t, out[emRootsJsonl])[0],
+		leaves: make(map[string]struct{}),
+	}
+
+	// [CIDv1 sha2-256][block] sections past the header
+	for _, sec := range testCarSections(t, out[emCarV0PinlessStream]) {
+		if sec[0] == 0x01 && sec[1] == 0x55 {
+			run.leaves[string(sec[:36])] = struct{}{}
+		}
+	}
+
+	return run
+}
@@ -0,0 +1,108 @@
+package dagger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"hash"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ribasushi/DAGger/internal/util/blake3"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/sha3"
+)
+
+// Unless --hash-bits says otherwise every hash function is truncated to 256
+// bits, including within --ipfs-add-compatible-command. The root CIDs of a
+// fixed pseudo-random payload are pinned for both the default and the full
+// digest size, so that neither can change unnoticed
+var hasherFixtures = []struct {
+	hash     string
+	hashBits int
+	root     string
+}{
+	{"sha2-256", 0, "bafybeicws4abaiieqnuqndufpgaetva7en4iljxh34vnt642qk7mmkm5sm"},
+	{"sha2-512", 0, "bafybgibj2ilzsealo6kjpxjatjqdnikchbnzj64l7chjntl5zwec4wzcne"},
+	{"sha2-512", 512, "bafybgqhldjcof2h7726e5idceh7jz2e3rqjgasagis6pouiu4l6hsgrxovfy6tctnylozcwik2xts53f7xtqc7okekfh5xvold6qsj5bcqiiq"},
+	{"sha3-512", 0, "bafybiihqps6tguntl7cpufnannc7i7gxnz4g4gpkqqwfn7blvhkvydl4yq"},
+	{"sha3-512", 512, "bafybiqeapftcqrivpbu23au2su5xdg3v56frv2ztvmsi4rjlm6errtdotug6pjm2pbtpycogrckq5v3aiok4jgbxgmlz4v4tbcpdzzcjkdmay"},
+	{"blake2b-256", 0, "bafykbzacebhm7ip3i72t44fmrx6mamrd3vkd366nktphw2y7awhhpgdsnxtt4"},
+	{"blake2b-512", 0, "bafymbzacechyhgiym37fnoupgawuilv7j7o34vdfschjrc5wyn3zig3wthdao"},
+	{"blake2b-512", 512, "bafymbzacib4zwlnae2xdhdvairz5mrdz2gyic7dmpsufvmpbat6cc4thv5q2uwpm3prvzl2il6fbthkhwpdepbcj6if64zevlb6moacwqg3v3ije"},
+	{"blake2s-256", 0, "bafyobzacedzdjz2sd3ik7dwkp7dkrqscyb4kvoroxpylcxtesimisncf3llmu"},
+	{"blake3", 0, "bafyb4ibt47qrrsupvfnxyswuk2co4jko2atqxb2yladycbbjw7f4mnnngy"},
+	{"blake3", 128, "bafyb4ee2iky2myr5lvukioozls2o5yxn"},
+}
+
+func TestHashersPinned(t *testing.T) {
+
+	payload := make([]byte, 1<<20+12345)
+	rand.New(rand.NewSource(42)).Read(payload)
+
+	for _, fx := range hasherFixtures {
+		args := []string{"--ipfs-add-compatible-command=--cid-version=1 --hash=" + fx.hash}
+		if fx.hashBits != 0 {
+			args = append(args, "--hash-bits="+strconv.Itoa(fx.hashBits))
+		}
+
+		root := testRootCids(t, testRun(t, args, bytes.NewReader(payload), emRootsJsonl)[emRootsJsonl])[0]
+		if root != fx.root {
+			t.Errorf("Hash %s with --hash-bits=%d: expected root CID %s, but instead generated %s", fx.hash, fx.hashBits, fx.root, root)
+		}
+	}
+}
+
+// A payload fitting in a single leaf is a raw block: its CID can be derived
+// independently of any of the DAGger hashing machinery
+func TestHashersRawLeaf(t *testing.T) {
+
+	payload := make([]byte, 123456)
+	rand.New(rand.NewSource(42)).Read(payload)
+
+	for _, h := range []struct {
+		name  string
+		code  uint64
+		maker func() hash.Hash
+	}{
+		{"sha2-256", 0x12, sha256.New},
+		{"sha2-512", 0x13, sha512.New},
+		{"sha3-512", 0x14, sha3.New512},
+		{"blake2b-256", 0xb220, func() hash.Hash { hm, _ := blake2b.New256(nil); return hm }},
+		{"blake2b-512", 0xb240, func() hash.Hash { hm, _ := blake2b.New512(nil); return hm }},
+		{"blake2s-256", 0xb260, func() hash.Hash { hm, _ := blake2s.New256(nil); return hm }},
+		{"blake3", 0x1e, blake3.New},
+	} {
+		hm := h.maker()
+		hm.Write(payload)
+		digest := hm.Sum(nil)
+
+		root := testRootCids(t, testRun(
+			t,
+			[]string{
+				"--ipfs-add-compatible-command=--cid-version=1 --hash=" + h.name,
+				"--hash-bits=" + strconv.Itoa(8*len(digest)),
+			},
+			bytes.NewReader(payload),
+			emRootsJsonl,
+		)[emRootsJsonl])[0]
+
+		if expected := rawCidV1(h.code, digest); root != expected {
+			t.Errorf("Hash %s: expected raw leaf CID %s, but instead generated %s", h.name, expected, root)
+		}
+	}
+}
+
+func rawCidV1(mhCode uint64, digest []byte) string {
+	cid := []byte{0x01, 0x55}
+	var vi [binary.MaxVarintLen64]byte
+	cid = append(cid, vi[:binary.PutUvarint(vi[:], mhCode)]...)
+	cid = append(cid, vi[:binary.PutUvarint(vi[:], uint64(len(digest)))]...)
+	cid = append(cid, digest...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(cid))
+}
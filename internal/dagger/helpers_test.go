@@ -0,0 +1,68 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+// Runs input through a Dagger configured with args ( without argv[0] ), and
+// returns what each of the requested emitters wrote out. The summary is always
+// output, so that requesting emStatsJsonl is enough to get the stats
+func testRun(t *testing.T, args []string, input io.Reader, emitters ...string) map[string][]byte {
+
+	bufs := make(map[string]*bytes.Buffer, len(emitters))
+	targets := make(map[string]io.Writer, len(emitters))
+	for _, em := range emitters {
+		bufs[em] = new(bytes.Buffer)
+		targets[em] = bufs[em]
+	}
+
+	dgr, err := NewFromArgvNoExit(append([]string{"dolphin-dongs"}, args...), targets)
+	if err != nil {
+		t.Fatalf("Unexpected initialization error: %s", err)
+	}
+	defer dgr.Destroy()
+
+	if err := dgr.ProcessReader(input, nil); err != nil {
+		t.Fatalf("Unexpected stream processing error: %s", err)
+	}
+	if err := dgr.OutputSummary(); err != nil {
+		t.Fatalf("Unexpected summary error: %s", err)
+	}
+
+	out := make(map[string][]byte, len(bufs))
+	for em, b := range bufs {
+		out[em] = b.Bytes()
+	}
+	return out
+}
+
+// The CIDs of every line of emRootsJsonl, in order
+func testRootCids(t *testing.T, rootsJsonl []byte) (cids []string) {
+	s := bufio.NewScanner(bytes.NewReader(rootsJsonl))
+	for s.Scan() {
+		var r struct{ Cid string }
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("Unexpected root unmarshal error: %s", err)
+		}
+		cids = append(cids, r.Cid)
+	}
+	return
+}
+
+// The [varint length][section] sections of a car stream, header included
+func testCarSections(t *testing.T, car []byte) (sections [][]byte) {
+	for len(car) > 0 {
+		secLen, n := binary.Uvarint(car)
+		if n <= 0 || uint64(len(car)-n) < secLen {
+			t.Fatalf("Malformed car section")
+		}
+		sections = append(sections, car[n:n+int(secLen)])
+		car = car[n+int(secLen):]
+	}
+	return
+}
@@ -6,7 +6,6 @@ import (
 	"io"
 	"log"
 	"os"
-	"sort"
 	"sync/atomic"
 	"time"
 
@@ -16,6 +15,7 @@ import (
 
 	"github.com/ribasushi/DAGger/chunker"
 	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
 	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
 
 	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
@@ -86,6 +86,14 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 			close(dgr.carDataQueue)     // signal data-write stop
 			addErr(<-dgr.carWriteError) // wait for data-write stop
 
+			// Write the index and fill in the real headers, unless we already failed
+			if dgr.carFile != nil && len(deferErrors) == 0 {
+				addErr(dgr.finalizeCarFile())
+			}
+			if dgr.carSplit != nil {
+				addErr(dgr.finalizeCarSplit(len(deferErrors) == 0))
+			}
+
 			// This means we are using fifos, which in turn
 			// means we got to close them in sequence and cleanup
 			// (we got to close only things we opened, not STDOUT/ERR)
@@ -95,7 +103,7 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 
 				// If we are already in error, or there are no cars: write the dummy header
 				// ( and hope for the best / that we won't hang ... )
-				if len(deferErrors) > 0 || len(dgr.seenRoots) == 0 {
+				if len(deferErrors) > 0 || dgr.seenRootCount() == 0 {
 					// FIXME - go-ipfs should accept a zero-len without an error...?
 					// i.e. just closing should be ok some day
 					io.WriteString(dgr.carFifoPins, dgrblock.NulRootCarHeader)
@@ -106,6 +114,25 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 				addErr(dgr.carFifoPins.Close())
 				addErr(os.RemoveAll(dgr.carFifoDirectory))
 			}
+
+			// Only record what we know made it into the car output
+			if dgr.dedupIndex != nil {
+				if len(deferErrors) == 0 {
+					addErr(dgr.appendDedupIndex())
+				}
+				addErr(dgr.dedupIndex.close())
+				dgr.dedupIndex = nil
+			}
+		}
+
+		// the final report reflects everything that made it to the car output
+		if dgr.progress != nil {
+			addErr(dgr.progress.finish())
+		}
+
+		// describes outputs that are complete
+		if dgr.recipe != nil && len(deferErrors) == 0 {
+			addErr(dgr.outputRecipe())
 		}
 
 		if err == nil && len(deferErrors) > 0 {
@@ -122,26 +149,39 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 		}
 
 		dgr.statSummary.SysStats.ElapsedNsecs = time.Since(t0).Nanoseconds()
+
+		// outside of the timing above, same as the rest of the summary
+		if dgr.seenBlocks != nil {
+			if err == nil && dgr.summaryRequested() {
+				err = dgr.aggregateBlockStats()
+			}
+			if closeErr := dgr.seenBlocks.close(); err == nil {
+				err = closeErr
+			}
+		}
 	}()
 
 	dgr.externalEventBus = optionalEventChan
 	defer func() {
 		if err != nil {
 
-			var buffered int
-			if dgr.qrb != nil {
-				dgr.qrb.Lock()
-				buffered = dgr.qrb.Buffered()
-				dgr.qrb.Unlock()
-			}
+			// parallel workers provide this context on their own
+			if dgr.parallelWorkers == nil {
+				var buffered int
+				if dgr.qrb != nil {
+					dgr.qrb.Lock()
+					buffered = dgr.qrb.Buffered()
+					dgr.qrb.Unlock()
+				}
 
-			err = fmt.Errorf(
-				"failure at byte offset %s of sub-stream #%d with %s bytes buffered/unprocessed: %s",
-				text.Commify64(dgr.curStreamOffset),
-				dgr.statSummary.Streams,
-				text.Commify(buffered),
-				err,
-			)
+				err = fmt.Errorf(
+					"failure at byte offset %s of sub-stream #%d with %s bytes buffered/unprocessed: %s",
+					text.Commify64(dgr.curStreamOffset),
+					dgr.statSummary.Streams,
+					text.Commify(buffered),
+					err,
+				)
+			}
 
 			dgr.maybeSendEvent(ErrorString, err.Error())
 		}
@@ -152,18 +192,43 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 	}
 	t0 = time.Now()
 
-	dgr.qrb, err = qringbuf.NewFromReader(inputReader, qringbuf.Config{
-		// MinRegion must be twice the maxchunk, otherwise chunking chains won't work (hi, Claude Shannon)
-		MinRegion:   2 * constants.MaxLeafPayloadSize,
-		MinRead:     dgr.cfg.RingBufferMinRead,
-		MaxCopy:     2 * constants.MaxLeafPayloadSize, // SANCHECK having it equal to the MinRegion may be daft...
-		BufferSize:  dgr.cfg.RingBufferSize,
-		SectorSize:  dgr.cfg.RingBufferSectSize,
-		Stats:       &dgr.statSummary.SysStats.Stats,
-		TrackTiming: ((dgr.cfg.StatsActive & statsRingbuf) == statsRingbuf),
-	})
-	if err != nil {
-		return
+	// the compressed size says nothing about the remaining payload, progress
+	// reporting sees the decompressed stream instead
+	if dgr.cfg.Decompress != decompressNone {
+		var releaseDecompressor func()
+		if inputReader, releaseDecompressor, err = dgr.decompressingReader(inputReader); err != nil {
+			return
+		}
+		defer releaseDecompressor()
+	}
+
+	// a sparse file on stdin is still what progress reporting looks at
+	rawInputReader := inputReader
+	inputReader = dgr.sparseAwareReader(inputReader)
+
+	// everything past this point reads the content of the tar members
+	if dgr.tarInput != nil {
+		inputReader = dgr.tarInput.reader(inputReader)
+	}
+
+	// with --multipart-parallel every worker has a qrb of its own
+	if dgr.parallelWorkers == nil {
+		dgr.qrb, err = qringbuf.NewFromReader(inputReader, qringbuf.Config{
+			// MinRegion must be twice the maxchunk, otherwise chunking chains won't work (hi, Claude Shannon)
+			MinRegion:   2 * constants.MaxLeafPayloadSize,
+			MinRead:     dgr.cfg.RingBufferMinRead,
+			MaxCopy:     2 * constants.MaxLeafPayloadSize, // SANCHECK having it equal to the MinRegion may be daft...
+			BufferSize:  dgr.cfg.RingBufferSize,
+			SectorSize:  dgr.cfg.RingBufferSectSize,
+			Stats:       &dgr.statSummary.SysStats.Stats,
+			TrackTiming: ((dgr.cfg.StatsActive & statsRingbuf) == statsRingbuf),
+		})
+		if err != nil {
+			return
+		}
+		if dgr.progress != nil {
+			dgr.progress.addRing(dgr.qrb)
+		}
 	}
 
 	// Spew the nul-delimited names and close
@@ -186,8 +251,19 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 	// We got that far - got to write out the data portion prequel
 	// .oO( The machine of a dream, such a clean machine
 	//      With the pistons a pumpin', and the hubcaps all gleam )
-	if dgr.carDataWriter != nil {
-		if _, err = io.WriteString(dgr.carDataWriter, dgrblock.NulRootCarHeader); err != nil {
+	if dgr.carDataWriter != nil || dgr.carSplit != nil {
+		if dgr.carSplit != nil {
+			// files are opened on-demand by the data writer
+		} else if dgr.carFile != nil {
+			// zero-filled placeholder for the header(s), written out by
+			// finalizeCarFile() once all roots are known
+			_, err = dgr.carDataWriter.Write(make([]byte, dgr.carFile.blocksStart))
+			dgr.addProgressCarBytes(dgr.carFile.blocksStart)
+		} else {
+			_, err = io.WriteString(dgr.carDataWriter, dgrblock.NulRootCarHeader)
+			dgr.addProgressCarBytes(int64(len(dgrblock.NulRootCarHeader)))
+		}
+		if err != nil {
 			return
 		}
 
@@ -195,50 +271,78 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 		dgr.carDataQueue = make(chan carUnit, carQueueSize)
 		dgr.carWriteError = make(chan error, 1)
 		go dgr.backgroundCarDataWriter()
+
+		if dgr.recipe != nil && dgr.recipe.block != nil && !dgr.recipe.block.IsCidInlined() {
+			dgr.carDataQueue <- carUnit{hdr: dgr.recipe.block}
+		}
 	}
 
 	if (dgr.cfg.StatsActive & statsBlocks) == statsBlocks {
-		dgr.seenBlocks = make(seenBlocks, 1024) // SANCHECK: somewhat arbitrary, but eh...
+		dgr.statSummary.SeenBlocks = &seenBlocksStats{}
+		dgr.seenBlocks = newSeenBlocks(dgr.cfg.SeenBlocksMaxMemory, dgr.statSummary.SeenBlocks)
 		dgr.seenRoots = make(seenRoots, 32)
+		dgr.seenInlinedRoots = make(map[string]seenRoot)
+	}
+
+	if dgr.progress != nil {
+		dgr.progress.start(rawInputReader)
+	}
+
+	flushRoots := dgr.generateRoots || dgr.seenRoots != nil || dgr.externalEventBus != nil || dgr.dirTree != nil
+
+	if dgr.parallelWorkers != nil {
+		if err = dgr.processParallel(inputReader, flushRoots); err != nil {
+			return
+		}
+		if dgr.dirTree != nil {
+			return dgr.emitDirectories()
+		}
+		return
 	}
 
 	// use 64bits everywhere
 	var substreamSize int64
+	var substreamPath string
 
 	// outer stream loop: read() syscalls happen only here and in the qrb.collector()
 	for {
 		if dgr.cfg.MultipartStream {
 
-			err := binary.Read(
-				inputReader,
-				binary.BigEndian,
-				&substreamSize,
-			)
-			dgr.statSummary.SysStats.ReadCalls++
-
-			if err == io.EOF {
+			var eof bool
+			var hdrErr error
+			if substreamSize, substreamPath, eof, hdrErr = dgr.readMultipartHeader(inputReader); hdrErr != nil {
+				return hdrErr
+			} else if eof {
 				// no new multipart coming - bail
 				break
-			} else if err != nil {
-				return fmt.Errorf(
-					"error reading next 8-byte multipart substream size: %s",
-					err,
-				)
+			}
+
+			if dgr.dirTree != nil && substreamSize < 0 {
+				if err := dgr.dirTree.addDir(substreamPath); err != nil {
+					return err
+				}
+				continue
 			}
 
 			if substreamSize == 0 && dgr.cfg.SkipNulInputs {
 				continue
 			}
 
-			dgr.statSummary.Streams++
+			atomic.AddInt64(&dgr.statSummary.Streams, 1)
 			dgr.curStreamOffset = 0
 			dgr.latestLeafInlined = false
+
+			if dgr.progress != nil {
+				dgr.progress.beginSubstream(substreamSize)
+			}
 		}
 
 		if dgr.cfg.MultipartStream && substreamSize == 0 {
 			// If we got here: cfg.ProcessNulInputs is true
 			// Special case for a one-time zero-CID emission
-			dgr.streamAppend(nil)
+			if err := dgr.streamAppend(nil); err != nil {
+				return err
+			}
 		} else if err := dgr.processStream(substreamSize); err != nil {
 			if err == io.ErrUnexpectedEOF {
 				return fmt.Errorf(
@@ -252,11 +356,13 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 			} else if dgr.curStreamOffset == 0 && !dgr.cfg.SkipNulInputs {
 				// we did try to process a stream and ended up with an EOF + 0
 				// emit a zero-CID like above
-				dgr.streamAppend(nil)
+				if err := dgr.streamAppend(nil); err != nil {
+					return err
+				}
 			}
 		}
 
-		if dgr.generateRoots || dgr.seenRoots != nil || dgr.externalEventBus != nil {
+		if flushRoots {
 
 			// cascading flush across the chain
 			var rootBlock *dgrblock.Header
@@ -264,59 +370,153 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader, optionalEventChan chan<-
 				rootBlock = c.FlushState()
 			}
 
-			var rootPayloadSize, rootDagSize uint64
-			if rootBlock != nil {
-				rootPayloadSize = rootBlock.SizeCumulativePayload()
-				rootDagSize = rootBlock.SizeCumulativeDag()
+			if err := dgr.emitStreamRoot(rootBlock, dgr.statSummary.Streams, substreamPath, dgr.currentTarMember()); err != nil {
+				return err
+			}
+		}
 
-				if dgr.seenRoots != nil {
-					dgr.mu.Lock()
+		// we are in EOF-state: if we are not expecting multiparts - we are done
+		if !dgr.cfg.MultipartStream {
+			break
+		}
+	}
 
-					var rootSeen bool
-					if sk := seenKey(rootBlock); sk != nil {
-						if _, rootSeen = dgr.seenRoots[*sk]; !rootSeen {
-							dgr.seenRoots[*sk] = seenRoot{
-								order: len(dgr.seenRoots),
-								cid:   rootBlock.Cid(),
-							}
-						}
-					}
+	if dgr.dirTree != nil {
+		return dgr.emitDirectories()
+	}
 
-					dgr.statSummary.Roots = append(dgr.statSummary.Roots, rootStats{
-						Cid:         dgr.formattedCid(rootBlock),
-						SizePayload: rootBlock.SizeCumulativePayload(),
-						SizeDag:     rootBlock.SizeCumulativeDag(),
-						Dup:         rootSeen,
-					})
+	return
+}
 
-					dgr.mu.Unlock()
-				}
-			}
+// Reads the next --multipart(-paths) header, eof is set once no more
+// substreams are coming
+func (dgr *Dagger) readMultipartHeader(r io.Reader) (substreamSize int64, substreamPath string, eof bool, err error) {
 
-			jsonl := fmt.Sprintf(
-				"{\"event\":   \"root\", \"payload\":%12d, \"stream\":%7d, %-67s, \"wiresize\":%12d }\n",
-				rootPayloadSize,
-				dgr.statSummary.Streams,
-				fmt.Sprintf(`"cid":"%s"`, dgr.formattedCid(rootBlock)),
-				rootDagSize,
-			)
-			dgr.maybeSendEvent(NewRootJsonl, jsonl)
-			if rootBlock != nil && dgr.cfg.emitters[emRootsJsonl] != nil {
-				if _, err := io.WriteString(dgr.cfg.emitters[emRootsJsonl], jsonl); err != nil {
-					return fmt.Errorf("emitting '%s' failed: %s", emRootsJsonl, err)
-				}
-			}
+	if dgr.tarInput != nil {
+		return dgr.readTarHeader()
+	}
+
+	if dgr.dirTree != nil {
+		if substreamPath, err = dgr.readMultipartPath(r); err == io.EOF {
+			return 0, "", true, nil
+		} else if err != nil {
+			return
 		}
+	}
 
-		// we are in EOF-state: if we are not expecting multiparts - we are done
-		if !dgr.cfg.MultipartStream {
-			break
+	err = binary.Read(
+		r,
+		binary.BigEndian,
+		&substreamSize,
+	)
+	dgr.statSummary.SysStats.ReadCalls++
+
+	if err == io.EOF && dgr.dirTree == nil {
+		return 0, "", true, nil
+	} else if err != nil {
+		err = fmt.Errorf(
+			"error reading next 8-byte multipart substream size: %s",
+			err,
+		)
+	} else if dgr.dirTree != nil && substreamSize < -1 {
+		err = fmt.Errorf("invalid multipart substream size %d for path '%s'", substreamSize, substreamPath)
+	} else if dgr.progress != nil {
+		framing := int64(8)
+		if dgr.dirTree != nil {
+			framing += 8 + int64(len(substreamPath))
 		}
+		atomic.AddInt64(&dgr.progress.framingBytes, framing)
 	}
 
 	return
 }
 
+func (dgr *Dagger) emitStreamRoot(rootBlock *dgrblock.Header, streamNum int64, substreamPath string, member *tarMember) error {
+
+	var rootPayloadSize, rootDagSize uint64
+	if rootBlock != nil {
+		rootPayloadSize = rootBlock.SizeCumulativePayload()
+		rootDagSize = rootBlock.SizeCumulativeDag()
+
+		// with --multipart-paths only the assembled top-level entries are roots
+		if dgr.dirTree != nil {
+			if err := dgr.dirTree.addFile(substreamPath, rootBlock); err != nil {
+				return err
+			}
+		} else {
+			dgr.registerRoot(rootBlock)
+		}
+
+		if dgr.carSplit != nil && seenKey(rootBlock) != nil {
+			dgr.carSplitQueueRoot(rootBlock, streamNum)
+		}
+	}
+
+	var pathField string
+	if dgr.dirTree != nil || member != nil {
+		pathField = `, "path":` + jsonString(substreamPath)
+	}
+	if member != nil {
+		pathField += fmt.Sprintf(`, "mode":"%04o", "mtime":%d`, member.mode, member.mtime)
+	}
+
+	jsonl := fmt.Sprintf(
+		"{\"event\":   \"root\", \"payload\":%12d, \"stream\":%7d, %-67s, \"wiresize\":%12d%s }\n",
+		rootPayloadSize,
+		streamNum,
+		fmt.Sprintf(`"cid":"%s"`, dgr.formattedCid(rootBlock)),
+		rootDagSize,
+		pathField,
+	)
+	dgr.maybeSendEvent(NewRootJsonl, jsonl)
+	if rootBlock != nil && dgr.cfg.emitters[emRootsJsonl] != nil {
+		if _, err := io.WriteString(dgr.cfg.emitters[emRootsJsonl], jsonl); err != nil {
+			return fmt.Errorf("emitting '%s' failed: %s", emRootsJsonl, err)
+		}
+	}
+
+	return nil
+}
+
+func (dgr *Dagger) registerRoot(rootBlock *dgrblock.Header) {
+	if dgr.seenRoots == nil {
+		return
+	}
+
+	dgr.mu.Lock()
+	defer dgr.mu.Unlock()
+
+	var rootSeen bool
+	sk := seenKey(rootBlock)
+	if sk != nil {
+		if _, rootSeen = dgr.seenRoots[*sk]; !rootSeen {
+			dgr.seenRoots[*sk] = seenRoot{
+				order: dgr.seenRootCount(),
+				cid:   rootBlock.Cid(),
+			}
+		}
+	} else if rootBlock.IsCidInlined() {
+		// not tracked by seenBlocks: keyed by the entire CID instead
+		if _, rootSeen = dgr.seenInlinedRoots[string(rootBlock.Cid())]; !rootSeen {
+			dgr.seenInlinedRoots[string(rootBlock.Cid())] = seenRoot{
+				order: dgr.seenRootCount(),
+				cid:   rootBlock.Cid(),
+			}
+		}
+	}
+
+	if dgr.carFile != nil && (sk != nil || rootBlock.IsCidInlined()) {
+		dgr.carFile.streamRoots = append(dgr.carFile.streamRoots, rootBlock.Cid())
+	}
+
+	dgr.statSummary.Roots = append(dgr.statSummary.Roots, rootStats{
+		Cid:         dgr.formattedCid(rootBlock),
+		SizePayload: rootBlock.SizeCumulativePayload(),
+		SizeDag:     rootBlock.SizeCumulativeDag(),
+		Dup:         rootSeen,
+	})
+}
+
 func (dgr *Dagger) backgroundCarDataWriter() {
 	defer close(dgr.carWriteError)
 
@@ -329,15 +529,54 @@ func (dgr *Dagger) backgroundCarDataWriter() {
 			return
 		}
 
+		if carUnit.streamRoot != nil {
+			if err = dgr.carSplitAddRoot(carUnit.streamRoot, carUnit.streamNum, carUnit.splitStream); err != nil {
+				dgr.maybeSendEvent(ErrorString, err.Error())
+				dgr.carWriteError <- err
+				return
+			}
+			continue
+		}
+
 		cid = carUnit.hdr.Cid()
 		sizeVI = encoding.AppendVarint(
 			sizeVI[:0],
 			uint64(len(cid)+carUnit.hdr.SizeBlock()),
 		)
 
-		if _, err = dgr.carDataWriter.Write(sizeVI); err == nil {
-			if _, err = dgr.carDataWriter.Write(cid); err == nil {
-				_, err = carUnit.hdr.Content().WriteTo(dgr.carDataWriter)
+		blockWiresize := int64(len(sizeVI) + len(cid) + carUnit.hdr.SizeBlock())
+
+		cf := dgr.carFile
+		if dgr.carSplit != nil {
+			// may roll over to a new file, switching dgr.carDataWriter
+			err = dgr.carSplitReserve(blockWiresize)
+			cf = dgr.carSplit.cur
+		}
+
+		if err == nil {
+			if cf != nil {
+				if cf.version == 2 {
+					cf.blockOffsets = append(cf.blockOffsets, carBlockOffset{
+						cid:    cid,
+						offset: uint64(cf.blocksSize),
+					})
+				}
+				cf.blocksSize += blockWiresize
+			}
+
+			if _, err = dgr.carDataWriter.Write(sizeVI); err == nil {
+				if _, err = dgr.carDataWriter.Write(cid); err == nil {
+					if c := carUnit.hdr.Content(); c != nil {
+						_, err = c.WriteTo(dgr.carDataWriter)
+					}
+				}
+			}
+		}
+
+		if err == nil {
+			dgr.addProgressCarBytes(blockWiresize)
+			if carUnit.splitClaim != nil {
+				dgr.carSplitBlockWritten(carUnit.splitClaim)
 			}
 		}
 
@@ -355,79 +594,11 @@ func (dgr *Dagger) backgroundCarDataWriter() {
 }
 
 func (dgr *Dagger) writeoutCarPins() (err error) {
-	if len(dgr.seenRoots) == 0 {
+	if dgr.seenRootCount() == 0 {
 		log.Panic("called with 0 seen roots, not possible")
 	}
 
-	var cidCumulativeLength uint64
-
-	sortedRoots := make([]seenRoot, 0, len(dgr.seenRoots))
-
-	for _, sr := range dgr.seenRoots {
-		sortedRoots = append(sortedRoots, sr)
-		cidCumulativeLength += uint64(
-			2 + // prefixed tag 42
-				encoding.CborHeaderWiresize(uint64(len(sr.cid))+1) + // that many raw bytes follow
-				1 + // the \x00 cid prefix
-				len(sr.cid),
-		)
-	}
-
-	sort.Slice(sortedRoots, func(i, j int) bool {
-		return sortedRoots[i].order < sortedRoots[j].order
-	})
-
-	//
-	// Writeout starts here
-	//
-
-	// Roots preamble as varint length
-	if _, err = dgr.carFifoPins.Write(encoding.VarintSlice(
-		7 +
-			uint64(encoding.CborHeaderWiresize(uint64(len(sortedRoots)))) +
-			cidCumulativeLength +
-			9,
-	)); err != nil {
-		return
-	}
-
-	// See definition of NulRootCarHeader for detailed description of each byte
-	if _, err = io.WriteString(dgr.carFifoPins, "\xA2\x65roots"); err != nil {
-		return
-	}
-
-	// Writeout root array header
-	if err = encoding.CborHeaderWrite(
-		dgr.carFifoPins,
-		4,
-		uint64(len(sortedRoots)),
-	); err != nil {
-		return
-	}
-
-	for i := range sortedRoots {
-		if _, err = dgr.carFifoPins.Write([]byte{0xd8, 0x2a}); err != nil {
-			return
-		}
-
-		if err = encoding.CborHeaderWrite(
-			dgr.carFifoPins,
-			2,
-			uint64(1+len(sortedRoots[i].cid)),
-		); err != nil {
-			return
-		}
-
-		if _, err = dgr.carFifoPins.Write([]byte{0}); err != nil {
-			return
-		}
-		if _, err = dgr.carFifoPins.Write(sortedRoots[i].cid); err != nil {
-			return
-		}
-	}
-
-	// Version header outro
-	_, err = io.WriteString(dgr.carFifoPins, "\x67version\x01")
+	_, err = dgr.carFifoPins.Write(carV1Header(dgr.sortedRootCids()))
 	return
 }
 
@@ -509,6 +680,13 @@ chunking error: %s%s`,
 		processedFromReader = 0
 		streamEndInView = (readErr == io.EOF)
 
+		// only the top chunker sees the region as a whole
+		if dgr.sparseInput != nil {
+			if hinter, canHint := dgr.chainedChunkers[0].instance.(dgrchunker.ZeroRangeHinter); canHint {
+				hinter.HintZeroRanges(dgr.sparseInput.zeroRangesWithin(streamOffset, availableFromReader))
+			}
+		}
+
 		rescursiveSplitResults := make(chan *recursiveSplitResult, chunkQueueSizeTop)
 		go dgr.recursivelySplitBuffer(
 			// The entire reserved buffer to split recursively
@@ -526,6 +704,11 @@ chunking error: %s%s`,
 			errHandler,
 		)
 
+		// An emission error does not abort the receive loop right away:
+		// we keep draining the current region, so that no chunking goroutine
+		// is left blocked on its result channel
+		var emitErr error
+
 	receiveChunks:
 		for {
 			select {
@@ -535,29 +718,39 @@ chunking error: %s%s`,
 				if !chanOpen {
 					break receiveChunks
 				}
-				processedFromReader += dgr.gatherRecursiveResults(res)
+				processed, err := dgr.gatherRecursiveResults(res)
+				processedFromReader += processed
+				if err != nil && emitErr == nil {
+					emitErr = err
+				}
 			}
 		}
 
-		dgr.statSummary.Dag.Payload += int64(processedFromReader)
+		atomic.AddInt64(&dgr.blockSink().statSummary.Dag.Payload, int64(processedFromReader))
+
+		if emitErr != nil {
+			return emitErr
+		}
 	}
 }
 
-func (dgr *Dagger) gatherRecursiveResults(result *recursiveSplitResult) int {
+func (dgr *Dagger) gatherRecursiveResults(result *recursiveSplitResult) (substreamSize int, err error) {
 	if result.subSplits != nil {
-		var substreamSize int
 		for {
 			subRes, channelOpen := <-result.subSplits
 			if !channelOpen {
-				return substreamSize
+				return
+			}
+			subSize, subErr := dgr.gatherRecursiveResults(subRes)
+			substreamSize += subSize
+			if subErr != nil && err == nil {
+				err = subErr
 			}
-			substreamSize += dgr.gatherRecursiveResults(subRes)
 		}
 	}
 
 	result.chunkBufRegion.Reserve()
-	dgr.streamAppend(result)
-	return result.chunk.Size
+	return result.chunk.Size, dgr.streamAppend(result)
 }
 
 func (dgr *Dagger) recursivelySplitBuffer(
@@ -646,7 +839,7 @@ func (dgr *Dagger) recursivelySplitBuffer(
 	close(recursiveResultsReturn)
 }
 
-func (dgr *Dagger) streamAppend(res *recursiveSplitResult) {
+func (dgr *Dagger) streamAppend(res *recursiveSplitResult) (err error) {
 
 	var ds dgrblock.DataSource
 	var dr *qringbuf.Region
@@ -683,9 +876,9 @@ func (dgr *Dagger) streamAppend(res *recursiveSplitResult) {
 		)
 		dgr.maybeSendEvent(NewChunkJsonl, jsonl)
 
-		if _, err := io.WriteString(dgr.cfg.emitters[emChunksJsonl], jsonl); err != nil {
-			dgr.maybeSendEvent(ErrorString, err.Error())
-			log.Fatalf("Emitting '%s' failed: %s", emChunksJsonl, err)
+		if _, writeErr := io.WriteString(dgr.cfg.emitters[emChunksJsonl], jsonl); writeErr != nil {
+			// do not return yet: the block still needs to be post-processed below
+			err = fmt.Errorf("emitting '%s' failed: %s", emChunksJsonl, writeErr)
 		}
 	}
 
@@ -694,15 +887,19 @@ func (dgr *Dagger) streamAppend(res *recursiveSplitResult) {
 	// The leaf block processing is entirely decoupled from the collector chain,
 	// in order to not leak the Region lifetime management outside the framework
 	// Collectors call that same processor on intermediate link nodes they produce
-	dgr.asyncWG.Add(1)
-	go dgr.postProcessBlock(
+	sink := dgr.blockSink()
+	sink.asyncWG.Add(1)
+	go sink.postProcessBlock(
 		dgrencoder.NodeOrigin{
 			OriginatingLayer: -1,
 			LocalSubLayer:    leafLevel,
 		},
 		hdr,
 		dr,
+		sink.carSplitTrackBlock(),
 	)
+
+	return
 }
 
 // This function is called as multiple "fire and forget" goroutines
@@ -711,8 +908,12 @@ func (dgr *Dagger) postProcessBlock(
 	blockOrigin dgrencoder.NodeOrigin,
 	hdr *dgrblock.Header,
 	dataRegion *qringbuf.Region,
+	splitStream *carSplitStream,
 ) {
 	defer dgr.asyncWG.Done()
+	if splitStream != nil {
+		defer splitStream.pending.Done()
+	}
 
 	if constants.PerformSanityChecks {
 		if hdr == nil {
@@ -733,36 +934,82 @@ func (dgr *Dagger) postProcessBlock(
 		if k := seenKey(hdr); k != nil {
 
 			var postprocSlot *blockPostProcessResult
+			var emittedBefore bool
+			var claim, awaitClaim *carSplitClaim
 
 			dgr.mu.Lock()
 
-			if s, exists := dgr.seenBlocks[*k]; exists {
-				s.seenAt[blockOrigin]++
-			} else {
-				postprocSlot = &blockPostProcessResult{}
-				dgr.seenBlocks[*k] = uniqueBlockStats{
-					sizeBlock:              hdr.SizeBlock(),
-					seenAt:                 seenTimesAt{blockOrigin: 1},
-					blockPostProcessResult: postprocSlot,
+			if postprocSlot = dgr.seenBlocks.observe(k, hdr.SizeBlock(), blockOrigin); postprocSlot != nil {
+				if dgr.dedupIndex != nil && dgr.dedupIndex.seenBefore(k, hdr) {
+					emittedBefore = true
+					dgr.statSummary.DedupIndex.SkippedBlocks++
+					dgr.statSummary.DedupIndex.SkippedSize += int64(hdr.SizeBlock())
+				} else if splitStream != nil {
+					claim = &carSplitClaim{
+						key:     *k,
+						stream:  splitStream,
+						written: make(chan struct{}),
+					}
+					dgr.carSplitStreams.inFlight[*k] = claim
 				}
+			} else if splitStream != nil {
+				awaitClaim = dgr.carSplitStreams.inFlight[*k]
 			}
 
 			dgr.mu.Unlock()
 
+			// Claimed by a stream processed concurrently: our stream is not
+			// complete until the block is written out
+			if awaitClaim != nil {
+				<-awaitClaim.written
+				dgr.mu.Lock()
+				splitStream.noteFile(awaitClaim.fileIdx)
+				dgr.mu.Unlock()
+			}
+
 			if postprocSlot != nil {
 
+				if dgr.progress != nil {
+					atomic.AddInt64(&dgr.progress.uniqueBlocks, 1)
+					atomic.AddInt64(&dgr.progress.uniqueSize, int64(hdr.SizeBlock()))
+				}
+
 				//
 				// FIXME compressor stuff goes here
 				//
 
-				if dgr.carDataQueue != nil {
-					dgr.carDataQueue <- carUnit{hdr: hdr, region: dataRegion}
+				if dgr.carDataQueue != nil && !emittedBefore {
+					dgr.carDataQueue <- carUnit{hdr: hdr, region: dataRegion, splitClaim: claim}
 					return
 				}
 			}
 		}
 	}
 
+	// The empty block is not tracked in seenBlocks, yet a root referring to it
+	// must still be resolvable within a car file. The car-v0 streams are left
+	// as they always were
+	if hdr.SizeBlock() == 0 && (dgr.carFile != nil || dgr.carSplit != nil) && !hdr.IsCidInlined() && !hdr.DummyHashed() {
+		dgr.mu.Lock()
+		queueNul := !dgr.carNulBlockQueued
+		dgr.carNulBlockQueued = true
+		dgr.mu.Unlock()
+
+		if queueNul {
+			// nobody waits on this claim: it only records where the block ended up
+			var claim *carSplitClaim
+			if splitStream != nil {
+				claim = &carSplitClaim{
+					key:     *seenKey(hdr),
+					stream:  splitStream,
+					written: make(chan struct{}),
+				}
+			}
+			dgr.carDataQueue <- carUnit{hdr: hdr, region: dataRegion, splitClaim: claim}
+			return
+		}
+	}
+
 	// NOTE - these 3 steps will be done by the car emitter ( early return above )
 	// if that's what the options ask for
 	{
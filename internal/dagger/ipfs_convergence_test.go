@@ -1,9 +1,12 @@
 package dagger
 
 import (
+	"archive/tar"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -25,6 +28,13 @@ func TestGoIpfsConvergence(t *testing.T) {
 		// avoid parallelization surprises
 		cmd := cmd
 
+		// directory fixtures are tarballs, added via `ipfs add -r`
+		var pathsMode bool
+		for _, path := range matrix[cmd] {
+			pathsMode = strings.HasSuffix(path, ".tar.zst")
+			break
+		}
+
 		// the base convergence args are always the same
 		args := []string{
 			"dolphin-dongs",
@@ -33,6 +43,9 @@ func TestGoIpfsConvergence(t *testing.T) {
 			"--cid-multibase=base32",
 			"--multipart",
 		}
+		if pathsMode {
+			args[len(args)-1] = "--multipart-paths"
+		}
 		baselen := len(args)
 
 		args = append(args, "--ipfs-add-compatible-command")
@@ -50,8 +63,9 @@ func TestGoIpfsConvergence(t *testing.T) {
 
 				for cid, path := range matrix[cmd] {
 
-					// what to skip
-					if (!constants.LongTests && strings.Contains(path, "rand_")) ||
+					// what to skip: dir_hamt_small is the one sharded directory
+					// cheap enough for the default run
+					if (!constants.LongTests && (strings.Contains(path, "rand_") || strings.Contains(path, "dir_hamt_flat") || strings.Contains(path, "dir_hamt_nested"))) ||
 						(!constants.VeryLongTests && strings.Contains(path, "large_repeat_")) ||
 						!fileExists(path) {
 						continue
@@ -76,15 +90,21 @@ func TestGoIpfsConvergence(t *testing.T) {
 					}
 				}()
 
+				var input io.Reader = dataIn
+				if pathsMode {
+					input = tarsToMultipartPaths(dataIn)
+				}
+
 				events := make(chan IngestionEvent, 128)
 
 				go NewFromArgv(args).ProcessReader(
-					dataIn,
+					input,
 					events,
 				)
 
 				type rootEvent struct {
-					Cid string
+					Cid  string
+					Path string
 				}
 				var cidNum int
 				for {
@@ -99,6 +119,11 @@ func TestGoIpfsConvergence(t *testing.T) {
 							t.Fatalf("Unexpected event unmarshal error: %s", err)
 						}
 
+						// only the top-level directory is listed as the result
+						if pathsMode && strings.Contains(r.Path, "/") {
+							continue
+						}
+
 						if r.Cid != tuples.expectedCIDs[cidNum] {
 							t.Fatalf(
 								"Expected root CID %s for %s, but instead generated %s",
@@ -116,6 +141,71 @@ func TestGoIpfsConvergence(t *testing.T) {
 	}
 }
 
+// Converts a stream of size-prefixed tarballs into the framing expected by
+// --multipart-paths
+func tarsToMultipartPaths(in io.Reader) io.Reader {
+	r, w := io.Pipe()
+
+	writeRecord := func(path string, size int64) (err error) {
+		if err = binary.Write(w, binary.BigEndian, int64(len(path))); err == nil {
+			if _, err = io.WriteString(w, path); err == nil {
+				err = binary.Write(w, binary.BigEndian, size)
+			}
+		}
+		return
+	}
+
+	go func() {
+		for {
+			var size int64
+			if err := binary.Read(in, binary.BigEndian, &size); err == io.EOF {
+				w.Close()
+				return
+			} else if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+
+			tarStream := io.LimitReader(in, size)
+			tr := tar.NewReader(tarStream)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					w.CloseWithError(err)
+					return
+				}
+
+				path := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+				if path == "" || path == "." {
+					continue
+				}
+
+				if hdr.Typeflag == tar.TypeDir {
+					err = writeRecord(path, -1)
+				} else if hdr.Typeflag == tar.TypeReg {
+					if err = writeRecord(path, hdr.Size); err == nil {
+						_, err = io.Copy(w, tr)
+					}
+				}
+				if err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+
+			// the end-of-archive padding
+			if _, err := io.Copy(ioutil.Discard, tarStream); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
 func fileExists(fn string) bool {
 	stat, _ := os.Stat(fn)
 	return stat != nil && stat.Mode().IsRegular()
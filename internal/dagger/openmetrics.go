@@ -0,0 +1,221 @@
+package dagger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ribasushi/DAGger/internal/constants"
+)
+
+// Upper bounds of the block size histogram buckets: powers of 2 up to the
+// first one covering constants.MaxBlockWireSize
+var openMetricsSizeBuckets = func() (b []int) {
+	for s := 32; ; s *= 2 {
+		b = append(b, s)
+		if s > constants.MaxBlockWireSize {
+			return
+		}
+	}
+}()
+
+// Everything is a gauge or a histogram: the values describe a single run, and
+// are overwritten by the next one. This also keeps the output valid for both
+// OpenMetrics and the older prometheus text format read by node_exporter
+type openMetricsBuf struct {
+	bytes.Buffer
+}
+
+func (b *openMetricsBuf) family(name, typ, help string) {
+	fmt.Fprintf(b, "# TYPE dagger_%s %s\n# HELP dagger_%s %s\n", name, typ, name, help)
+}
+
+func (b *openMetricsBuf) sample(name string, val interface{}, labelPairs ...string) {
+	b.WriteString("dagger_" + name)
+	if len(labelPairs) > 0 {
+		labels := make([]string, 0, len(labelPairs)/2)
+		for i := 0; i+1 < len(labelPairs); i += 2 {
+			labels = append(labels, labelPairs[i]+"="+openMetricsLabelValue(labelPairs[i+1]))
+		}
+		b.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+
+	switch v := val.(type) {
+	case float64:
+		b.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+	default:
+		fmt.Fprintf(b, " %d\n", v)
+	}
+}
+
+func (b *openMetricsBuf) gauge(name, help string, val interface{}, labelPairs ...string) {
+	b.family(name, "gauge", help)
+	b.sample(name, val, labelPairs...)
+}
+
+func openMetricsLabelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func (dgr *Dagger) openMetricsSummary() []byte {
+
+	smr := &dgr.statSummary
+	sys := &smr.SysStats
+	nsecs := func(n int64) float64 { return float64(n) / 1000000000 }
+
+	b := &openMetricsBuf{}
+
+	b.gauge("build_info", "Build and runtime information of the stream-dagger binary", 1,
+		"go_version", sys.GoVersion,
+		"os", sys.Os,
+	)
+	b.gauge("last_run_timestamp_seconds", "When the summary of the last run was produced", float64(time.Now().UnixNano())/1000000000)
+	b.gauge("elapsed_seconds", "Wall-clock duration of the processing", nsecs(sys.ElapsedNsecs))
+
+	b.gauge("substreams", "Amount of processed substreams", smr.Streams)
+	b.gauge("payload_bytes", "Amount of ingested payload", smr.Dag.Payload)
+	b.gauge("logical_dag_nodes", "Amount of nodes in the logical DAG, duplicates included", smr.Dag.Nodes)
+	b.gauge("logical_dag_wire_bytes", "On-wire size of the logical DAG, duplicates included", smr.Dag.Size)
+
+	if len(smr.Roots) > 0 {
+		var dups int64
+		for _, r := range smr.Roots {
+			if r.Dup {
+				dups++
+			}
+		}
+		b.gauge("roots", "Amount of stream roots, duplicates included", int64(len(smr.Roots)))
+		b.gauge("duplicate_roots", "Amount of stream roots identical to an earlier one", dups)
+	}
+
+	if len(smr.Layers) > 0 {
+		tot := &smr.uniqueTotals
+		b.gauge("unique_blocks", "Amount of distinct blocks", tot.count)
+		b.gauge("unique_wire_bytes", "On-wire size of the distinct blocks", tot.weight)
+		b.gauge("unique_leaf_blocks", "Amount of distinct data and padding blocks", tot.leafCount)
+		b.gauge("unique_leaf_wire_bytes", "On-wire size of the distinct data and padding blocks", tot.leafWeight)
+		if smr.Dag.Payload > 0 {
+			b.gauge("dedup_ratio", "On-wire size of the distinct blocks divided by the payload size", float64(tot.weight)/float64(smr.Dag.Payload))
+		}
+
+		b.family("layer_root_blocks", "gauge", "Amount of distinct blocks of a layer that are a stream root")
+		for _, l := range smr.Layers {
+			var roots int64
+			for _, c := range l.BlockSizeCounts {
+				roots += c.CountRootBlocksAtSize
+			}
+			b.sample("layer_root_blocks", roots, "layer", l.LongLabel)
+		}
+
+		b.family("layer_block_size_bytes", "histogram", "On-wire sizes of the distinct blocks of a layer")
+		for _, l := range smr.Layers {
+			var count, sum int64
+			sizes := l.BlockSizeCounts // sorted by aggregateBlockStats()
+			for _, bound := range openMetricsSizeBuckets {
+				for len(sizes) > 0 && sizes[0].SizeBlock <= bound {
+					count += sizes[0].CountUniqueBlocksAtSize
+					sum += sizes[0].CountUniqueBlocksAtSize * int64(sizes[0].SizeBlock)
+					sizes = sizes[1:]
+				}
+				b.sample("layer_block_size_bytes_bucket", count, "layer", l.LongLabel, "le", strconv.Itoa(bound))
+			}
+			b.sample("layer_block_size_bytes_bucket", count, "layer", l.LongLabel, "le", "+Inf")
+			b.sample("layer_block_size_bytes_sum", sum, "layer", l.LongLabel)
+			b.sample("layer_block_size_bytes_count", count, "layer", l.LongLabel)
+		}
+	}
+
+	if di := smr.DedupIndex; di != nil {
+		b.gauge("dedup_index_known_blocks", "Amount of blocks in the dedup index before the run", di.KnownBlocks)
+		b.gauge("dedup_index_skipped_blocks", "Amount of blocks not written out as they were found in the dedup index", di.SkippedBlocks)
+		b.gauge("dedup_index_skipped_wire_bytes", "On-wire size of the blocks found in the dedup index", di.SkippedSize)
+		b.gauge("dedup_index_added_blocks", "Amount of blocks added to the dedup index", di.AddedBlocks)
+	}
+
+	if sb := smr.SeenBlocks; sb != nil {
+		var spilled int
+		if sb.Mode == seenBlocksModeSpill {
+			spilled = 1
+		}
+		b.gauge("seen_blocks_spilled", "Whether tracking the distinct blocks spilled to disk", spilled)
+		b.gauge("seen_blocks_spilled_runs", "Amount of sorted runs spilled to disk", sb.SpilledRuns)
+		b.gauge("seen_blocks_disk_lookups", "Amount of block lookups performed against the spilled runs", sb.DiskLookups)
+	}
+
+	b.gauge("cpu_user_seconds", "User CPU time of the process", nsecs(sys.CpuUserNsecs))
+	b.gauge("cpu_system_seconds", "System CPU time of the process", nsecs(sys.CpuSysNsecs))
+	b.gauge("max_rss_bytes", "Peak resident memory of the process", sys.MaxRssBytes)
+	b.gauge("minor_faults", "Page faults serviced without IO", sys.MinFlt)
+	b.gauge("major_faults", "Page faults requiring IO", sys.MajFlt)
+	b.family("context_switches", "gauge", "Context switches of the process")
+	b.sample("context_switches", sys.CtxSwYield, "kind", "voluntary")
+	b.sample("context_switches", sys.CtxSwForced, "kind", "involuntary")
+
+	b.gauge("ringbuf_read_calls", "Amount of read() calls against the input", sys.ReadCalls)
+	b.gauge("ringbuf_next_region_calls", "Amount of regions requested from the ring buffer", sys.NextRegionCalls)
+	b.gauge("ringbuf_collector_yields", "Times the ring buffer collector waited for free space", sys.CollectorYields)
+	b.gauge("ringbuf_emitter_yields", "Times the chunkers waited for the ring buffer collector", sys.EmitterYields)
+	if (dgr.cfg.StatsActive & statsRingbuf) == statsRingbuf {
+		b.gauge("ringbuf_collector_wait_seconds", "Time the ring buffer collector waited for free space", nsecs(sys.CollectorWaitNanoseconds))
+		b.gauge("ringbuf_emitter_wait_seconds", "Time the chunkers waited for the ring buffer collector", nsecs(sys.EmitterWaitNanoseconds))
+	}
+
+	b.WriteString("# EOF\n")
+	return b.Bytes()
+}
+
+func (dgr *Dagger) outputOpenMetrics() error {
+
+	metrics := dgr.openMetricsSummary()
+
+	if out := dgr.cfg.emitters[emStatsOpenMetrics]; out != nil {
+		if _, err := out.Write(metrics); err != nil {
+			return fmt.Errorf("emitting '%s' failed: %s", emStatsOpenMetrics, err)
+		}
+	}
+
+	if dgr.cfg.StatsOpenMetricsFile != "" {
+		if err := writeFileAtomically(dgr.cfg.StatsOpenMetricsFile, metrics); err != nil {
+			return fmt.Errorf("writing --stats-openmetrics-file failed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Readers of path (e.g. the node_exporter textfile collector) see either the
+// previous or the new content, never a partial write. The temporary name does
+// not end in .prom, so that it is never picked up itself
+func writeFileAtomically(path string, content []byte) (err error) {
+
+	fh, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+		}
+	}()
+
+	if _, err = fh.Write(content); err != nil {
+		return
+	}
+	// TempFile creates 0600: the collector likely runs as a different user
+	if err = fh.Chmod(0644); err != nil {
+		return
+	}
+	if err = fh.Sync(); err != nil {
+		return
+	}
+	if err = fh.Close(); err != nil {
+		return
+	}
+	return os.Rename(fh.Name(), path)
+}
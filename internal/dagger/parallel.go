@@ -0,0 +1,333 @@
+package dagger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipfs/go-qringbuf"
+	"github.com/ribasushi/DAGger/internal/constants"
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	"github.com/ribasushi/DAGger/internal/util/text"
+)
+
+// Amount of data handed to a worker at a time, and how many such pieces can be
+// in flight for a single substream
+const (
+	parallelPieceSize    = 1 << 20
+	parallelPiecesQueued = 4
+)
+
+// A multipart entry in input order: either a substream to be chunked by
+// whichever worker is free, or a --multipart-paths directory
+type parallelJob struct {
+	_         constants.Incomparabe
+	streamNum int64
+	size      int64
+	path      string
+	member    *tarMember
+	isDir     bool
+	pieces    chan []byte
+	result    chan parallelResult
+}
+
+type parallelResult struct {
+	_         constants.Incomparabe
+	rootBlock *dgrblock.Header
+	chunkLog  []byte
+	err       error
+}
+
+// Workers are Dagger instances with their own chunker/collector chain, node
+// encoder and ring buffer, sharing the blockmaker and all block tracking and
+// output with their parent
+func (dgr *Dagger) setupParallelWorkers() (argErrs []string) {
+
+	if !dgr.cfg.MultipartStream {
+		return []string{"--multipart-parallel requires --multipart or --multipart-paths"}
+	}
+	if dgr.cfg.emitters[emCarSplitManifest] != nil {
+		return []string{fmt.Sprintf("--multipart-parallel can not be combined with the '%s' emitter", emCarSplitManifest)}
+	}
+
+	dgr.parallelWorkers = make([]*Dagger, dgr.cfg.MultipartParallel)
+	for i := range dgr.parallelWorkers {
+		w := &Dagger{
+			parent:       dgr,
+			cfg:          dgr.cfg,
+			emitChunks:   dgr.emitChunks,
+			formattedCid: dgr.formattedCid,
+			blockMaker:   dgr.blockMaker,
+		}
+		// collected per substream, emitted in order by the parent
+		w.cfg.emitters = emissionTargets{}
+
+		// the initializers are factories: re-running them clones the chains
+		nodeEnc, encErrs := w.setupNodeEncoder()
+		argErrs = append(argErrs, encErrs...)
+		argErrs = append(argErrs, w.setupChunkerChain()...)
+		argErrs = append(argErrs, w.setupCollectorChain(nodeEnc)...)
+		if len(argErrs) > 0 {
+			return
+		}
+
+		dgr.parallelWorkers[i] = w
+	}
+
+	return
+}
+
+// The Dagger owning the block tracking and all output
+func (dgr *Dagger) blockSink() *Dagger {
+	if dgr.parent != nil {
+		return dgr.parent
+	}
+	return dgr
+}
+
+// Pieces of the currently processed substream, read by the qrb of a worker
+type substreamFeed struct {
+	pieces <-chan []byte
+	cur    []byte
+}
+
+func (f *substreamFeed) Read(p []byte) (int, error) {
+	for len(f.cur) == 0 {
+		next, chanOpen := <-f.pieces
+		if !chanOpen {
+			return 0, io.EOF
+		}
+		f.cur = next
+	}
+	n := copy(p, f.cur)
+	f.cur = f.cur[n:]
+	return n, nil
+}
+
+func (dgr *Dagger) processParallel(inputReader io.Reader, flushRoots bool) (err error) {
+
+	jobs := make(chan *parallelJob, len(dgr.parallelWorkers))
+	pending := make(chan *parallelJob, 4*len(dgr.parallelWorkers))
+	failed := make(chan struct{})
+	var emitErr error
+
+	var workersWG sync.WaitGroup
+	workerStats := make([]qringbuf.Stats, len(dgr.parallelWorkers))
+	for i, w := range dgr.parallelWorkers {
+		feed := &substreamFeed{}
+		if w.qrb, err = qringbuf.NewFromReader(feed, qringbuf.Config{
+			MinRegion:   2 * constants.MaxLeafPayloadSize,
+			MinRead:     dgr.cfg.RingBufferMinRead,
+			MaxCopy:     2 * constants.MaxLeafPayloadSize,
+			BufferSize:  dgr.cfg.RingBufferSize,
+			SectorSize:  dgr.cfg.RingBufferSectSize,
+			Stats:       &workerStats[i],
+			TrackTiming: ((dgr.cfg.StatsActive & statsRingbuf) == statsRingbuf),
+		}); err != nil {
+			return
+		}
+		if dgr.progress != nil {
+			dgr.progress.addRing(w.qrb)
+		}
+
+		workersWG.Add(1)
+		go func(w *Dagger) {
+			defer workersWG.Done()
+
+			// the qrb of a failed worker is in an undefined state: stop using it
+			var broken bool
+			for job := range jobs {
+				if broken {
+					for range job.pieces {
+					}
+					job.result <- parallelResult{err: fmt.Errorf("substream #%d not processed due to a previous error", job.streamNum)}
+					continue
+				}
+
+				feed.pieces = job.pieces
+				res := w.processParallelJob(job, flushRoots)
+				broken = (res.err != nil)
+				job.result <- res
+			}
+		}(w)
+	}
+
+	// emit results in input order, keep draining after an error
+	emitterDone := make(chan struct{})
+	go func() {
+		defer close(emitterDone)
+		for job := range pending {
+			res := <-job.result
+			if emitErr != nil {
+				continue
+			}
+			if res.err == nil {
+				res.err = dgr.emitParallelResult(job, res, flushRoots)
+			}
+			if res.err != nil {
+				emitErr = res.err
+				close(failed)
+			}
+		}
+	}()
+
+	defer func() {
+		close(jobs)
+		close(pending)
+		workersWG.Wait()
+		<-emitterDone
+
+		for _, w := range dgr.parallelWorkers {
+			w.qrb = nil
+		}
+		for i := range workerStats {
+			s := &dgr.statSummary.SysStats.Stats
+			s.ReadCalls += workerStats[i].ReadCalls
+			s.CollectorYields += workerStats[i].CollectorYields
+			s.CollectorWaitNanoseconds += workerStats[i].CollectorWaitNanoseconds
+			s.NextRegionCalls += workerStats[i].NextRegionCalls
+			s.EmitterYields += workerStats[i].EmitterYields
+			s.EmitterWaitNanoseconds += workerStats[i].EmitterWaitNanoseconds
+		}
+
+		// otherwise an emission error is the reason we stopped early
+		if err == nil {
+			err = emitErr
+		}
+	}()
+
+	for {
+		select {
+		case <-failed:
+			return
+		default:
+		}
+
+		var substreamSize int64
+		var substreamPath string
+		var eof bool
+		if substreamSize, substreamPath, eof, err = dgr.readMultipartHeader(inputReader); err != nil || eof {
+			return
+		}
+
+		job := &parallelJob{
+			size:   substreamSize,
+			path:   substreamPath,
+			member: dgr.currentTarMember(),
+			result: make(chan parallelResult, 1),
+		}
+
+		if dgr.dirTree != nil && substreamSize < 0 {
+			job.isDir = true
+			job.result <- parallelResult{}
+			pending <- job
+			continue
+		}
+
+		if substreamSize == 0 && dgr.cfg.SkipNulInputs {
+			continue
+		}
+
+		job.streamNum = atomic.AddInt64(&dgr.statSummary.Streams, 1)
+		job.pieces = make(chan []byte, parallelPiecesQueued)
+
+		pending <- job
+		jobs <- job
+
+		for remaining := substreamSize; remaining > 0; {
+			pieceSize := int64(parallelPieceSize)
+			if remaining < pieceSize {
+				pieceSize = remaining
+			}
+			piece := make([]byte, pieceSize)
+			n, readErr := io.ReadFull(inputReader, piece)
+			dgr.statSummary.SysStats.ReadCalls++
+			if n > 0 {
+				job.pieces <- piece[:n]
+			}
+			if readErr != nil {
+				close(job.pieces)
+				return fmt.Errorf(
+					"unexpected end of substream #%s after %s bytes (stream expected to be %s bytes long)",
+					text.Commify64(job.streamNum),
+					text.Commify64(substreamSize-remaining+int64(n)),
+					text.Commify64(substreamSize),
+				)
+			}
+			remaining -= pieceSize
+		}
+		close(job.pieces)
+	}
+}
+
+// Runs on the worker Dagger
+func (dgr *Dagger) processParallelJob(job *parallelJob, flushRoots bool) (res parallelResult) {
+
+	var chunkLog bytes.Buffer
+	if dgr.emitChunks {
+		dgr.cfg.emitters[emChunksJsonl] = &chunkLog
+	}
+	dgr.curStreamOffset = 0
+
+	if job.size == 0 {
+		res.err = dgr.streamAppend(nil)
+	} else if res.err = dgr.processStream(job.size); res.err == io.EOF {
+		res.err = nil
+	}
+
+	if res.err != nil {
+		// make sure the parent is not blocked feeding us
+		for range job.pieces {
+		}
+
+		dgr.qrb.Lock()
+		buffered := dgr.qrb.Buffered()
+		dgr.qrb.Unlock()
+
+		res.err = fmt.Errorf(
+			"failure at byte offset %s of sub-stream #%d with %s bytes buffered/unprocessed: %s",
+			text.Commify64(dgr.curStreamOffset),
+			job.streamNum,
+			text.Commify(buffered),
+			res.err,
+		)
+		return
+	}
+
+	if flushRoots {
+		for _, c := range dgr.chainedCollectors {
+			res.rootBlock = c.FlushState()
+		}
+	}
+	res.chunkLog = chunkLog.Bytes()
+	return
+}
+
+// Runs on the parent, in input order
+func (dgr *Dagger) emitParallelResult(job *parallelJob, res parallelResult, flushRoots bool) error {
+
+	if job.isDir {
+		return dgr.dirTree.addDir(job.path)
+	}
+
+	if len(res.chunkLog) > 0 {
+		if dgr.externalEventBus != nil {
+			for _, l := range strings.SplitAfter(string(res.chunkLog), "\n") {
+				if l != "" {
+					dgr.maybeSendEvent(NewChunkJsonl, l)
+				}
+			}
+		}
+		if _, err := dgr.cfg.emitters[emChunksJsonl].Write(res.chunkLog); err != nil {
+			return fmt.Errorf("emitting '%s' failed: %s", emChunksJsonl, err)
+		}
+	}
+
+	if flushRoots {
+		return dgr.emitStreamRoot(res.rootBlock, job.streamNum, job.path, job.member)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Chunking substreams on several workers, each with a node encoder instance
+// of its own, must result in the same roots, in the same order, as processing
+// them one after another
+func TestParallelMatchesSerial(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	var input bytes.Buffer
+	for _, size := range []int{3<<20 + 7, 0, 12345, 1 << 20, 5 << 20, 1, 2<<20 + 1} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		binary.Write(&input, binary.BigEndian, int64(size))
+		input.Write(b)
+	}
+
+	for _, chain := range [][]string{
+		{"--ipfs-add-compatible-command=--cid-version=1"},
+		{"--ipfs-add-compatible-command=--cid-version=1 --trickle"},
+		{
+			"--hash=sha2-256",
+			"--inline-max-size=36",
+			"--chunkers=fixed-size_65536",
+			"--collectors=fixed-outdegree_max-outdegree=7",
+			"--node-encoder=dagcbor_link-dag-sizes_link-payload-sizes",
+		},
+	} {
+		args := append(chain, "--multipart")
+
+		serial := testRootCids(t, testRun(t, args, bytes.NewReader(input.Bytes()), emRootsJsonl)[emRootsJsonl])
+		if len(serial) != 7 {
+			t.Fatalf("%v: expected 7 roots, got %d", chain, len(serial))
+		}
+
+		parallel := testRootCids(t, testRun(
+			t,
+			append(args, "--multipart-parallel=4"),
+			bytes.NewReader(input.Bytes()),
+			emRootsJsonl,
+		)[emRootsJsonl])
+
+		if !reflect.DeepEqual(parallel, serial) {
+			t.Fatalf("%v: --multipart-parallel resulted in roots %v instead of %v", chain, parallel, serial)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package dagger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-qringbuf"
+	"github.com/ribasushi/DAGger/internal/util/stream"
+	"github.com/ribasushi/DAGger/internal/util/text"
+)
+
+// Periodic reporting for the progress-{jsonl,text} emitters. Every counter
+// is either one of the atomically updated statSummary.Dag fields, or lives
+// here and is updated atomically as well: reporting never takes dgr.mu
+type progressTracker struct {
+	dgr      *Dagger
+	interval time.Duration
+
+	jsonlOut io.Writer
+	textOut  io.Writer
+	textTTY  bool // redraw a single line instead of printing one per tick
+
+	inputSize      int64 // -1 when not known upfront
+	framingBytes   int64 // multipart sizes and paths
+	uniqueBlocks   int64
+	uniqueSize     int64
+	carBytes       int64
+	substreamSize  int64 // -1 when not known, or when several are in flight
+	substreamStart int64 // the value of Dag.Payload when the current substream started
+
+	mu    sync.Mutex
+	rings []*qringbuf.QuantizedRingBuffer
+	err   error // first emission error, no output is attempted after it
+
+	t0   time.Time
+	stop chan struct{}
+	done chan struct{}
+}
+
+type progressReport struct {
+	EventType        string   `json:"event"`
+	ElapsedNsecs     int64    `json:"elapsedNanoseconds"`
+	Ingested         int64    `json:"ingested"`
+	Payload          int64    `json:"payload"`
+	Streams          int64    `json:"subStream"`
+	Nodes            int64    `json:"nodes"`
+	Size             int64    `json:"wireSize"`
+	UniqueBlocks     *int64   `json:"uniqueBlocks,omitempty"`
+	UniqueSize       *int64   `json:"uniqueWireSize,omitempty"`
+	CarBytes         *int64   `json:"carBytesWritten,omitempty"`
+	BytesPerSec      int64    `json:"bytesPerSecond"`
+	RingBufferFill   float64  `json:"ringBufferFill"`
+	InputSize        *int64   `json:"inputSize,omitempty"`
+	SubstreamSize    *int64   `json:"subStreamSize,omitempty"`
+	SubstreamPayload *int64   `json:"subStreamPayload,omitempty"`
+	EtaSecs          *float64 `json:"etaSeconds,omitempty"`
+	EtaScope         string   `json:"etaScope,omitempty"`
+	Final            bool     `json:"final,omitempty"`
+}
+
+func (dgr *Dagger) setupProgress() (argErrs []string) {
+
+	if dgr.cfg.emitters[emProgressJsonl] == nil && dgr.cfg.emitters[emProgressText] == nil {
+		return
+	}
+
+	if dgr.cfg.ProgressIntervalMsecs <= 0 {
+		return []string{"The value of --progress-interval must be positive"}
+	}
+
+	dgr.progress = &progressTracker{
+		dgr:      dgr,
+		interval: time.Duration(dgr.cfg.ProgressIntervalMsecs) * time.Millisecond,
+		jsonlOut: dgr.cfg.emitters[emProgressJsonl],
+		textOut:  dgr.cfg.emitters[emProgressText],
+		textTTY:  stream.IsTTY(dgr.cfg.emitters[emProgressText]),
+	}
+	return
+}
+
+// The total is known only when reading a regular file: the remainder from the
+// current position is what ProcessReader will consume
+func inputSizeOf(r io.Reader) int64 {
+	if f, isFile := r.(*os.File); isFile {
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			if pos, err := f.Seek(0, io.SeekCurrent); err == nil && pos <= st.Size() {
+				return st.Size() - pos
+			}
+		}
+	}
+	return -1
+}
+
+func (p *progressTracker) start(inputReader io.Reader) {
+	p.inputSize = inputSizeOf(inputReader)
+	p.substreamSize = -1
+	p.t0 = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-t.C:
+				p.emit(false)
+			}
+		}
+	}()
+}
+
+// Stops the periodic reporting and emits one last report, covering every block
+// written out. Safe to call when start() never happened
+func (p *progressTracker) finish() error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+
+	p.emit(true)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rings = nil
+	return p.err
+}
+
+func (p *progressTracker) addRing(qrb *qringbuf.QuantizedRingBuffer) {
+	p.mu.Lock()
+	p.rings = append(p.rings, qrb)
+	p.mu.Unlock()
+}
+
+// Called by the sequential ingestion loop only: with --multipart-parallel
+// several substreams are in flight, and only the overall numbers are reported
+func (p *progressTracker) beginSubstream(size int64) {
+	atomic.StoreInt64(&p.substreamStart, atomic.LoadInt64(&p.dgr.statSummary.Dag.Payload))
+	atomic.StoreInt64(&p.substreamSize, size)
+}
+
+func (dgr *Dagger) addProgressCarBytes(n int64) {
+	if dgr.progress != nil {
+		atomic.AddInt64(&dgr.progress.carBytes, n)
+	}
+}
+
+func (p *progressTracker) snapshot(final bool) (r progressReport) {
+	dgr := p.dgr
+	elapsed := time.Since(p.t0)
+
+	r.EventType = "progress"
+	r.Final = final
+	r.ElapsedNsecs = elapsed.Nanoseconds()
+	r.Payload = atomic.LoadInt64(&dgr.statSummary.Dag.Payload)
+	r.Ingested = r.Payload + atomic.LoadInt64(&p.framingBytes)
+	r.Streams = atomic.LoadInt64(&dgr.statSummary.Streams)
+	r.Nodes = atomic.LoadInt64(&dgr.statSummary.Dag.Nodes)
+	r.Size = atomic.LoadInt64(&dgr.statSummary.Dag.Size)
+
+	if dgr.seenBlocks != nil {
+		ub, us := atomic.LoadInt64(&p.uniqueBlocks), atomic.LoadInt64(&p.uniqueSize)
+		r.UniqueBlocks, r.UniqueSize = &ub, &us
+	}
+	if dgr.carDataQueue != nil {
+		cb := atomic.LoadInt64(&p.carBytes)
+		r.CarBytes = &cb
+	}
+
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.BytesPerSec = int64(float64(r.Ingested) / secs)
+	}
+
+	p.mu.Lock()
+	if len(p.rings) > 0 {
+		var buffered int
+		for _, qrb := range p.rings {
+			qrb.Lock()
+			buffered += qrb.Buffered()
+			qrb.Unlock()
+		}
+		r.RingBufferFill = float64(buffered) / float64(len(p.rings)*dgr.cfg.RingBufferSize)
+	}
+	p.mu.Unlock()
+
+	eta := func(remaining int64) *float64 {
+		if r.BytesPerSec == 0 || remaining < 0 {
+			return nil
+		}
+		e := float64(remaining) / float64(r.BytesPerSec)
+		return &e
+	}
+
+	if p.inputSize >= 0 {
+		is := p.inputSize
+		r.InputSize = &is
+		if r.EtaSecs = eta(is - r.Ingested); r.EtaSecs != nil {
+			r.EtaScope = "input"
+		}
+	}
+
+	if ss := atomic.LoadInt64(&p.substreamSize); ss >= 0 && !final {
+		sp := r.Payload - atomic.LoadInt64(&p.substreamStart)
+		r.SubstreamSize, r.SubstreamPayload = &ss, &sp
+		if r.EtaSecs == nil {
+			if r.EtaSecs = eta(ss - sp); r.EtaSecs != nil {
+				r.EtaScope = "substream"
+			}
+		}
+	}
+
+	if final {
+		r.EtaSecs, r.EtaScope = nil, ""
+	}
+
+	return
+}
+
+func (p *progressTracker) emit(final bool) {
+
+	p.mu.Lock()
+	failed := (p.err != nil)
+	p.mu.Unlock()
+	if failed {
+		return
+	}
+
+	r := p.snapshot(final)
+
+	var err error
+	if p.jsonlOut != nil {
+		var jsonl []byte
+		if jsonl, err = json.Marshal(r); err != nil {
+			err = fmt.Errorf("encoding '%s' failed: %s", emProgressJsonl, err)
+		} else if _, err = fmt.Fprintf(p.jsonlOut, "%s\n", jsonl); err != nil {
+			err = fmt.Errorf("emitting '%s' failed: %s", emProgressJsonl, err)
+		}
+	}
+
+	if err == nil && p.textOut != nil {
+		line := r.textLine()
+		if p.textTTY {
+			// redraw in place, leave the last state on screen
+			line = "\r" + line + "\x1b[K"
+			if final {
+				line += "\n"
+			}
+		} else {
+			line += "\n"
+		}
+		if _, err = io.WriteString(p.textOut, line); err != nil {
+			err = fmt.Errorf("emitting '%s' failed: %s", emProgressText, err)
+		}
+	}
+
+	if err != nil {
+		p.mu.Lock()
+		if p.err == nil {
+			p.err = err
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (r *progressReport) textLine() string {
+
+	parts := make([]string, 0, 8)
+
+	ingested := fmt.Sprintf("%s bytes", text.Commify64(r.Ingested))
+	if r.InputSize != nil && *r.InputSize > 0 {
+		ingested += fmt.Sprintf(" (%0.1f%%)", 100*float64(r.Ingested)/float64(*r.InputSize))
+	}
+	parts = append(parts, fmt.Sprintf(
+		"[%s] %s @ %0.2f MiB/s",
+		formatSeconds(float64(r.ElapsedNsecs)/1000000000),
+		ingested,
+		float64(r.BytesPerSec)/(1024*1024),
+	))
+
+	parts = append(parts, fmt.Sprintf("substream #%s", text.Commify64(r.Streams)))
+	parts = append(parts, fmt.Sprintf("%s nodes", text.Commify64(r.Nodes)))
+
+	if r.UniqueSize != nil {
+		parts = append(parts, fmt.Sprintf("%s unique bytes", text.Commify64(*r.UniqueSize)))
+	}
+	if r.CarBytes != nil {
+		parts = append(parts, fmt.Sprintf("%s car bytes", text.Commify64(*r.CarBytes)))
+	}
+
+	parts = append(parts, fmt.Sprintf("ring %0.0f%%", 100*r.RingBufferFill))
+
+	if r.EtaSecs != nil {
+		parts = append(parts, fmt.Sprintf("ETA %s (%s)", formatSeconds(*r.EtaSecs), r.EtaScope))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func formatSeconds(s float64) string {
+	secs := int64(s)
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+}
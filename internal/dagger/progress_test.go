@@ -0,0 +1,102 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Reports never go backwards, and the final one accounts for every byte of
+// a regular file input and every byte of car output, matching the summary
+func TestProgressFinalReport(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	var input bytes.Buffer
+	for _, size := range []int{3<<20 + 7, 0, 12345, 5 << 20} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		binary.Write(&input, binary.BigEndian, int64(size))
+		input.Write(b)
+	}
+
+	fh, err := ioutil.TempFile("", "dagger-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempfile error: %s", err)
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+	if _, err := fh.Write(input.Bytes()); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Unexpected seek error: %s", err)
+	}
+
+	out := testRun(
+		t,
+		[]string{
+			"--ipfs-add-compatible-command=--cid-version=1",
+			"--multipart",
+			"--progress-interval=1",
+		},
+		fh,
+		emProgressJsonl, emProgressText, emStatsJsonl, emCarV0PinlessStream,
+	)
+
+	var reports []progressReport
+	s := bufio.NewScanner(bytes.NewReader(out[emProgressJsonl]))
+	for s.Scan() {
+		var r progressReport
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("Unexpected progress unmarshal error: %s", err)
+		}
+		if len(reports) > 0 {
+			if prev := reports[len(reports)-1]; prev.Final || r.Ingested < prev.Ingested || r.Nodes < prev.Nodes || *r.CarBytes < *prev.CarBytes {
+				t.Fatalf("Progress report\n%s\nfollowing\n%+v", s.Bytes(), prev)
+			}
+		}
+		reports = append(reports, r)
+	}
+	if len(reports) == 0 {
+		t.Fatalf("No progress reports emitted")
+	}
+
+	var stats struct {
+		LogicalDag struct {
+			Nodes    int64
+			WireSize int64
+			Payload  int64
+		}
+		SubStreams int64
+	}
+	if err := json.Unmarshal(out[emStatsJsonl], &stats); err != nil {
+		t.Fatalf("Unexpected stats unmarshal error: %s", err)
+	}
+
+	final := reports[len(reports)-1]
+	if !final.Final ||
+		final.InputSize == nil || *final.InputSize != int64(input.Len()) ||
+		final.Ingested != int64(input.Len()) ||
+		final.Payload != stats.LogicalDag.Payload ||
+		final.Nodes != stats.LogicalDag.Nodes ||
+		final.Size != stats.LogicalDag.WireSize ||
+		final.Streams != stats.SubStreams ||
+		final.CarBytes == nil || *final.CarBytes != int64(len(out[emCarV0PinlessStream])) ||
+		final.EtaSecs != nil {
+		t.Fatalf("Final progress report\n%+v\ninconsistent with %d bytes of input, %d bytes of car and the summary\n%s", final, input.Len(), len(out[emCarV0PinlessStream]), out[emStatsJsonl])
+	}
+
+	if lines := strings.Split(strings.TrimSuffix(string(out[emProgressText]), "\n"), "\n"); len(lines) != len(reports) {
+		t.Fatalf("Emitted %d text progress lines for %d reports", len(lines), len(reports))
+	} else if !strings.Contains(lines[len(lines)-1], "(100.0%)") {
+		t.Fatalf("Final text progress line does not account for the entire input: %s", lines[len(lines)-1])
+	}
+}
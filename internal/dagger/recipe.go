@@ -0,0 +1,263 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	"github.com/ribasushi/DAGger/internal/dagger/util/encoding"
+	"github.com/ribasushi/DAGger/internal/zcpstring"
+)
+
+const (
+	daggerModulePath = "github.com/ribasushi/DAGger"
+
+	// bumped on any change of the recipe structure
+	recipeVersion = 1
+)
+
+// All cid-determining options, in the predefined order they are listed in
+// both the expanded argv of the summary and in the recipe
+var cidDeterminingOpts = []string{
+	"inline-max-size",
+	"hash",
+	"hash-bits",
+	"chunkers",
+	"collectors",
+	"node-encoder",
+}
+
+// Options that do not change any individual CID, but determine which roots
+// the input is split into
+var framingOpts = []string{
+	"decompress",
+	"input-format",
+	"multipart",
+	"multipart-paths",
+	"skip-nul-inputs",
+	"tar-directory-root",
+}
+
+// A canonical description of how the CIDs of a run came to be: everything
+// needed by someone holding the data to reproduce them exactly
+type recipeState struct {
+	doc   map[string]interface{}
+	block *dgrblock.Header // only with --recipe-car-block
+}
+
+type recipeEnvelope struct {
+	EventType   string                 `json:"event"`
+	CarBlockCid string                 `json:"carBlockCid,omitempty"`
+	Recipe      map[string]interface{} `json:"recipe"`
+}
+
+func (dgr *Dagger) setupRecipe() (argErrs []string) {
+
+	cfg := &dgr.cfg
+
+	if cfg.emitters[emRecipeJsonl] == nil && cfg.RecipeFile == "" && !cfg.RecipeCarBlock {
+		return
+	}
+
+	if cfg.RecipeCarBlock &&
+		cfg.emitters[emCarV1File] == nil &&
+		cfg.emitters[emCarV2File] == nil {
+		return []string{fmt.Sprintf(
+			"--recipe-car-block requires one of the '%s' or '%s' emitters",
+			emCarV1File,
+			emCarV2File,
+		)}
+	}
+
+	optList := func(names []string) []interface{} {
+		l := make([]interface{}, len(names))
+		for i, n := range names {
+			l[i] = fmt.Sprintf("--%s=%s", n, cfg.optSet.GetValue(n))
+		}
+		return l
+	}
+
+	chunkerNames := strings.Split(cfg.requestedChunkers, "__")
+	chunkers := make([]interface{}, len(dgr.chainedChunkers))
+	for i, c := range dgr.chainedChunkers {
+		ident := map[string]interface{}{
+			"chunker": strings.SplitN(chunkerNames[i], "_", 2)[0],
+		}
+		for k, v := range c.constants.Identities {
+			ident[k] = v
+		}
+		chunkers[i] = ident
+	}
+
+	dgr.recipe = &recipeState{
+		doc: map[string]interface{}{
+			"recipeVersion":     recipeVersion,
+			"tool":              recipeTool(),
+			"cidOptions":        optList(cidDeterminingOpts),
+			"framingOptions":    optList(framingOpts),
+			"chunkerIdentities": chunkers,
+		},
+	}
+
+	if cfg.RecipeCarBlock {
+		b := new(bytes.Buffer)
+		writeCanonicalCbor(b, dgr.recipe.doc)
+		dgr.recipe.block = dgr.blockMaker(
+			zcpstring.WrapSlice(b.Bytes()),
+			dgrblock.CodecCBOR,
+			0,
+			0,
+		)
+	}
+
+	return
+}
+
+// The recipe block is listed after the roots of the input
+func (dgr *Dagger) recipeRoots() [][]byte {
+	if dgr.recipe == nil || dgr.recipe.block == nil {
+		return nil
+	}
+	return [][]byte{dgr.recipe.block.Cid()}
+}
+
+// The version of this module within the running binary, be it stream-dagger
+// itself or a program using it as a library
+func recipeTool() map[string]interface{} {
+
+	t := map[string]interface{}{
+		"module":    daggerModulePath,
+		"version":   "unknown",
+		"goVersion": runtime.Version(),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return t
+	}
+
+	if bi.Main.Path == daggerModulePath {
+		if bi.Main.Version != "" {
+			t["version"] = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				t["vcsRevision"] = s.Value
+			case "vcs.modified":
+				t["vcsModified"] = (s.Value == "true")
+			}
+		}
+		return t
+	}
+
+	for _, m := range bi.Deps {
+		if m.Path == daggerModulePath {
+			if m.Replace != nil {
+				m = m.Replace
+			}
+			if m.Version != "" {
+				t["version"] = m.Version
+			}
+			if m.Sum != "" {
+				t["sum"] = m.Sum
+			}
+			break
+		}
+	}
+
+	return t
+}
+
+// Emitted only once every output of the run is complete
+func (dgr *Dagger) outputRecipe() error {
+
+	env := recipeEnvelope{
+		EventType: "recipe",
+		Recipe:    dgr.recipe.doc,
+	}
+	if dgr.recipe.block != nil {
+		env.CarBlockCid = dgr.formattedCid(dgr.recipe.block)
+	}
+
+	// encoding/json sorts the keys of every map: the output is canonical
+	jsonl, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("encoding the recipe failed: %s", err)
+	}
+	jsonl = append(jsonl, '\n')
+
+	if out := dgr.cfg.emitters[emRecipeJsonl]; out != nil {
+		if _, err := out.Write(jsonl); err != nil {
+			return fmt.Errorf("emitting '%s' failed: %s", emRecipeJsonl, err)
+		}
+	}
+
+	if dgr.cfg.RecipeFile != "" {
+		if err := writeFileAtomically(dgr.cfg.RecipeFile, jsonl); err != nil {
+			return fmt.Errorf("writing --recipe-file failed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Covers the value types a recipe is built from. Map keys are ordered
+// length-first, then bytewise, as mandated by DAG-CBOR
+func writeCanonicalCbor(w io.Writer, v interface{}) {
+	const (
+		cborUint   = 0
+		cborNegInt = 1
+		cborText   = 3
+		cborArray  = 4
+		cborMap    = 5
+	)
+
+	switch t := v.(type) {
+	case string:
+		encoding.CborHeaderWrite(w, cborText, uint64(len(t)))
+		io.WriteString(w, t)
+	case bool:
+		if t {
+			w.Write([]byte{0xF5})
+		} else {
+			w.Write([]byte{0xF4})
+		}
+	case int:
+		if t < 0 {
+			encoding.CborHeaderWrite(w, cborNegInt, uint64(-1-t))
+		} else {
+			encoding.CborHeaderWrite(w, cborUint, uint64(t))
+		}
+	case []interface{}:
+		encoding.CborHeaderWrite(w, cborArray, uint64(len(t)))
+		for _, e := range t {
+			writeCanonicalCbor(w, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		encoding.CborHeaderWrite(w, cborMap, uint64(len(t)))
+		for _, k := range keys {
+			writeCanonicalCbor(w, k)
+			writeCanonicalCbor(w, t[k])
+		}
+	default:
+		log.Panicf("unexpected recipe value type %T", v)
+	}
+}
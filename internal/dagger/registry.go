@@ -0,0 +1,102 @@
+package dagger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ribasushi/DAGger/chunker"
+	dgrchunker "github.com/ribasushi/DAGger/internal/dagger/chunker"
+	dgrcollector "github.com/ribasushi/DAGger/internal/dagger/collector"
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+
+	"github.com/ribasushi/DAGger/internal/dagger/util/argparser"
+)
+
+// Guards availableChunkers, availableCollectors and availableNodeEncoders:
+// registrations may happen at any time, concurrently with instantiation
+var registryMu sync.RWMutex
+
+// RegisterChunker makes a third-party chunker available under the given name
+// for use in --chunkers=..., and lists it with the supplied helptext in the
+// output of --help-all
+func RegisterChunker(name string, init dgrchunker.Initializer, helpText string) error {
+	if err := validateRegistration("chunker", name, init == nil); err != nil {
+		return err
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := availableChunkers[name]; exists {
+		return fmt.Errorf("a chunker named '%s' is already registered", name)
+	}
+
+	availableChunkers[name] = func(args []string, cfg *dgrchunker.DaggerConfig) (chunker.Chunker, dgrchunker.InstanceConstants, []string) {
+		// on nil-args the "error" is the help text to be incorporated into
+		// the larger help display
+		if args == nil {
+			return nil, dgrchunker.InstanceConstants{}, argparser.SubHelp(helpText, nil)
+		}
+		return init(args, cfg)
+	}
+	return nil
+}
+
+// RegisterCollector makes a third-party collector available under the given
+// name for use in --collectors=..., and lists it with the supplied helptext in
+// the output of --help-all
+func RegisterCollector(name string, init dgrcollector.Initializer, helpText string) error {
+	if err := validateRegistration("collector", name, init == nil); err != nil {
+		return err
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := availableCollectors[name]; exists {
+		return fmt.Errorf("a collector named '%s' is already registered", name)
+	}
+
+	availableCollectors[name] = func(args []string, cfg *dgrcollector.DaggerConfig) (dgrcollector.Collector, []string) {
+		if args == nil {
+			return nil, argparser.SubHelp(helpText, nil)
+		}
+		return init(args, cfg)
+	}
+	return nil
+}
+
+// RegisterNodeEncoder makes a third-party node encoder available under the
+// given name for use in --node-encoder=..., and lists it with the supplied
+// helptext in the output of --help-all
+func RegisterNodeEncoder(name string, init dgrencoder.Initializer, helpText string) error {
+	if err := validateRegistration("node encoder", name, init == nil); err != nil {
+		return err
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := availableNodeEncoders[name]; exists {
+		return fmt.Errorf("a node encoder named '%s' is already registered", name)
+	}
+
+	availableNodeEncoders[name] = func(args []string, cfg *dgrencoder.DaggerConfig) (dgrencoder.NodeEncoder, []string) {
+		if args == nil {
+			return nil, argparser.SubHelp(helpText, nil)
+		}
+		return init(args, cfg)
+	}
+	return nil
+}
+
+func validateRegistration(kind, name string, nilInit bool) error {
+	if name == "" || strings.ContainsAny(name, "_, ") {
+		return fmt.Errorf("invalid %s name '%s': must be non-empty and contain no underscores, commas or spaces", kind, name)
+	}
+	if nilInit {
+		return fmt.Errorf("nil initializer supplied for %s '%s'", kind, name)
+	}
+	return nil
+}
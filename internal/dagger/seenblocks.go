@@ -0,0 +1,368 @@
+package dagger
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
+)
+
+const (
+	// Rough cost of a single in-memory entry, including map overhead
+	seenBlockMemEstimate = 80
+
+	// key + SizeBlock uint32 + OriginatingLayer int16 + LocalSubLayer int16
+	spillRecordSize = seenHashSize + 8
+
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+
+	seenBlocksModeMemory = "in-memory"
+	seenBlocksModeSpill  = "disk-spill"
+)
+
+type seenBlocksStats struct {
+	Mode           string `json:"mode"`
+	MaxMemory      int64  `json:"maxMemory,omitempty"`
+	SpilledRuns    int    `json:"spilledRuns,omitempty"`
+	SpilledEntries int64  `json:"spilledEntries,omitempty"`
+	DiskLookups    int64  `json:"diskLookups,omitempty"`
+}
+
+// Tracks every distinct block of a run. Once maxEntries is reached the
+// in-memory entries are written out as a sorted run to a temporary file, and
+// only a bloom filter of the run is retained. A block not found in memory is
+// looked up on disk within every run whose filter matches, which keeps both
+// the car deduplication and the stats exact
+type seenBlocks struct {
+	mem        map[[seenHashSize]byte]uniqueBlockStats
+	maxEntries int // 0: unbounded
+	runs       []*spillRun
+	err        error // first spill/lookup error, surfaced at the end of the run
+	stats      *seenBlocksStats
+}
+
+// A sorted run of fixed-size records, each starting with its key
+type spillRun struct {
+	fh      *os.File
+	recSize int64
+	entries int64
+	filter  bloomFilter
+}
+
+func newSeenBlocks(maxMemory int64, stats *seenBlocksStats) *seenBlocks {
+	sb := &seenBlocks{
+		maxEntries: int(maxMemory / seenBlockMemEstimate),
+		stats:      stats,
+	}
+	sb.stats.Mode = seenBlocksModeMemory
+	sb.stats.MaxMemory = maxMemory
+
+	sb.mem = make(map[[seenHashSize]byte]uniqueBlockStats, sb.initialSize())
+	return sb
+}
+
+func (sb *seenBlocks) initialSize() int {
+	if sb.maxEntries > 0 && sb.maxEntries < 1024 {
+		return sb.maxEntries
+	}
+	return 1024 // SANCHECK: somewhat arbitrary, but eh...
+}
+
+// Whether origin a takes precedence when an identical block is emitted by
+// multiple generators ( e.g. trickle could ). Same order as sortGenerators()
+func originPrecedes(a, b dgrencoder.NodeOrigin) bool {
+	if a.OriginatingLayer != b.OriginatingLayer {
+		return a.OriginatingLayer > b.OriginatingLayer
+	}
+	return a.LocalSubLayer > b.LocalSubLayer
+}
+
+// Returns the stats slot of a block seen for the first time, nil otherwise.
+// Must be called under dgr.mu
+func (sb *seenBlocks) observe(k *[seenHashSize]byte, sizeBlock int, origin dgrencoder.NodeOrigin) *blockPostProcessResult {
+
+	if s, exists := sb.mem[*k]; exists {
+		if originPrecedes(origin, s.origin) {
+			s.origin = origin
+			sb.mem[*k] = s
+		}
+		return nil
+	}
+
+	s := uniqueBlockStats{
+		sizeBlock: sizeBlock,
+		origin:    origin,
+	}
+	// the entry is recorded even when spilled earlier: it may carry a
+	// preceding origin, reconciled during the final merge
+	if !sb.inRuns(k) {
+		s.blockPostProcessResult = &blockPostProcessResult{}
+	}
+	sb.mem[*k] = s
+
+	if sb.maxEntries > 0 && len(sb.mem) >= sb.maxEntries && sb.err == nil {
+		if err := sb.spill(); err != nil {
+			sb.err = fmt.Errorf("spilling seen blocks failed: %s", err)
+		} else {
+			sb.mem = make(map[[seenHashSize]byte]uniqueBlockStats, sb.initialSize())
+		}
+	}
+
+	return s.blockPostProcessResult
+}
+
+func (sb *seenBlocks) inRuns(k *[seenHashSize]byte) bool {
+	for _, r := range sb.runs {
+		if !r.filter.mayContain(k) {
+			continue
+		}
+		sb.stats.DiskLookups++
+		found, err := r.lookup(k)
+		if err != nil {
+			// treating the block as new is the safe choice for the car output
+			if sb.err == nil {
+				sb.err = fmt.Errorf("looking up spilled seen blocks failed: %s", err)
+			}
+			return false
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (sb *seenBlocks) spill() error {
+
+	keys := make([][seenHashSize]byte, 0, len(sb.mem))
+	for k := range sb.mem {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	fh, err := ioutil.TempFile("", "dagger-seen-blocks-")
+	if err != nil {
+		return err
+	}
+	r := &spillRun{
+		fh:      fh,
+		recSize: spillRecordSize,
+		entries: int64(len(keys)),
+		filter:  newBloomFilter(len(keys)),
+	}
+	// register right away, so that close() cleans up after a failure
+	sb.runs = append(sb.runs, r)
+
+	w := bufio.NewWriterSize(fh, 1<<20)
+	var rec [spillRecordSize]byte
+	for i := range keys {
+		s := sb.mem[keys[i]]
+		copy(rec[:], keys[i][:])
+		binary.BigEndian.PutUint32(rec[seenHashSize:], uint32(s.sizeBlock))
+		binary.BigEndian.PutUint16(rec[seenHashSize+4:], uint16(int16(s.origin.OriginatingLayer)))
+		binary.BigEndian.PutUint16(rec[seenHashSize+6:], uint16(int16(s.origin.LocalSubLayer)))
+		if _, err := w.Write(rec[:]); err != nil {
+			return err
+		}
+		r.filter.add(&keys[i])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	sb.stats.Mode = seenBlocksModeSpill
+	sb.stats.SpilledRuns++
+	sb.stats.SpilledEntries += r.entries
+	return nil
+}
+
+// Calls cb exactly once for every distinct block, with the preceding origin
+// it was seen at. Spills whatever remains in memory when runs are present
+func (sb *seenBlocks) forEach(cb func(k *[seenHashSize]byte, s uniqueBlockStats)) error {
+
+	if sb.err != nil {
+		return sb.err
+	}
+
+	if len(sb.runs) == 0 {
+		for k, s := range sb.mem {
+			k := k
+			cb(&k, s)
+		}
+		return nil
+	}
+
+	if len(sb.mem) > 0 {
+		if err := sb.spill(); err != nil {
+			return fmt.Errorf("spilling seen blocks failed: %s", err)
+		}
+		sb.mem = nil
+	}
+
+	// k-way merge of the sorted runs, collapsing identical keys
+	mh := make(runMergeHeap, 0, len(sb.runs))
+	for _, r := range sb.runs {
+		c := &runCursor{
+			r: bufio.NewReaderSize(io.NewSectionReader(r.fh, 0, r.entries*spillRecordSize), 64<<10),
+		}
+		if ok, err := c.next(); err != nil {
+			return fmt.Errorf("merging spilled seen blocks failed: %s", err)
+		} else if ok {
+			mh = append(mh, c)
+		}
+	}
+	heap.Init(&mh)
+
+	var curKey [seenHashSize]byte
+	var cur uniqueBlockStats
+	var haveCur bool
+
+	for len(mh) > 0 {
+		c := mh[0]
+
+		if haveCur && c.key == curKey {
+			if originPrecedes(c.stats.origin, cur.origin) {
+				cur.origin = c.stats.origin
+			}
+		} else {
+			if haveCur {
+				cb(&curKey, cur)
+			}
+			curKey, cur, haveCur = c.key, c.stats, true
+		}
+
+		if ok, err := c.next(); err != nil {
+			return fmt.Errorf("merging spilled seen blocks failed: %s", err)
+		} else if ok {
+			heap.Fix(&mh, 0)
+		} else {
+			heap.Pop(&mh)
+		}
+	}
+	if haveCur {
+		cb(&curKey, cur)
+	}
+
+	return nil
+}
+
+func (sb *seenBlocks) close() (err error) {
+	err = sb.err
+	for _, r := range sb.runs {
+		if e := r.remove(); e != nil && err == nil {
+			err = e
+		}
+	}
+	sb.runs = nil
+	sb.mem = nil
+	return
+}
+
+func (r *spillRun) remove() error {
+	err := r.fh.Close()
+	if e := os.Remove(r.fh.Name()); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (r *spillRun) lookup(k *[seenHashSize]byte) (bool, error) {
+	var key [seenHashSize]byte
+	lo, hi := int64(0), r.entries
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if _, err := r.fh.ReadAt(key[:], mid*r.recSize); err != nil {
+			return false, err
+		}
+		switch c := bytes.Compare(key[:], k[:]); {
+		case c == 0:
+			return true, nil
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+type runCursor struct {
+	r     *bufio.Reader
+	key   [seenHashSize]byte
+	stats uniqueBlockStats
+}
+
+func (c *runCursor) next() (bool, error) {
+	var rec [spillRecordSize]byte
+	if _, err := io.ReadFull(c.r, rec[:]); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	copy(c.key[:], rec[:seenHashSize])
+	c.stats = uniqueBlockStats{
+		sizeBlock: int(binary.BigEndian.Uint32(rec[seenHashSize:])),
+		origin: dgrencoder.NodeOrigin{
+			OriginatingLayer: int(int16(binary.BigEndian.Uint16(rec[seenHashSize+4:]))),
+			LocalSubLayer:    int(int16(binary.BigEndian.Uint16(rec[seenHashSize+6:]))),
+		},
+	}
+	return true, nil
+}
+
+type runMergeHeap []*runCursor
+
+func (h runMergeHeap) Len() int            { return len(h) }
+func (h runMergeHeap) Less(i, j int) bool  { return bytes.Compare(h[i].key[:], h[j].key[:]) < 0 }
+func (h runMergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runMergeHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runMergeHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// The keys are tails of cryptographic hashes: their halves serve directly as
+// the two hashes of a double-hashing scheme
+type bloomFilter []uint64
+
+func newBloomFilter(entries int) bloomFilter {
+	return make(bloomFilter, (entries*bloomBitsPerKey+63)/64)
+}
+
+func (bf bloomFilter) positions(k *[seenHashSize]byte, cb func(word int, mask uint64) bool) bool {
+	nbits := uint64(len(bf)) * 64
+	h1 := binary.LittleEndian.Uint64(k[:8])
+	h2 := binary.LittleEndian.Uint64(k[8:]) | 1
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		if !cb(int(bit/64), 1<<(bit%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (bf bloomFilter) add(k *[seenHashSize]byte) {
+	bf.positions(k, func(word int, mask uint64) bool {
+		bf[word] |= mask
+		return true
+	})
+}
+
+func (bf bloomFilter) mayContain(k *[seenHashSize]byte) bool {
+	return len(bf) > 0 && bf.positions(k, func(word int, mask uint64) bool {
+		return bf[word]&mask != 0
+	})
+}
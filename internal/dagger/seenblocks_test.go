@@ -0,0 +1,91 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Spilling the seen blocks to disk must not alter anything but the
+// seenBlocks section of the stats: the input repeats itself, so that blocks
+// already spilled in earlier runs are encountered again
+func TestSeenBlocksSpill(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	payload := make([]byte, 24<<20)
+	rnd.Read(payload)
+	input := append(append([]byte{}, payload...), payload[:12<<20]...)
+
+	memStats, memCar := runSeenBlocks(t, input, "0")
+	spillStats, spillCar := runSeenBlocks(t, input, "1048576")
+
+	if memStats.SeenBlocks.Mode != seenBlocksModeMemory {
+		t.Fatalf("Unexpected mode %s of the unbounded run", memStats.SeenBlocks.Mode)
+	}
+	if spillStats.SeenBlocks.Mode != seenBlocksModeSpill || spillStats.SeenBlocks.SpilledRuns < 3 {
+		t.Fatalf(
+			"Expected a %s run with at least 3 spilled runs, got a %s one with %d",
+			seenBlocksModeSpill,
+			spillStats.SeenBlocks.Mode,
+			spillStats.SeenBlocks.SpilledRuns,
+		)
+	}
+
+	for _, s := range []*seenBlocksTestStats{memStats, spillStats} {
+		s.SeenBlocks = nil
+	}
+	if !reflect.DeepEqual(memStats, spillStats) {
+		mj, _ := json.Marshal(memStats)
+		sj, _ := json.Marshal(spillStats)
+		t.Fatalf("Stats differ between the in-memory and the spilled run:\n%s\n%s", mj, sj)
+	}
+
+	// the order of the car sections is not deterministic, their set is
+	if !reflect.DeepEqual(memCar, spillCar) {
+		t.Fatalf("Car sections differ between the in-memory and the spilled run")
+	}
+}
+
+type seenBlocksTestStats struct {
+	Dag        json.RawMessage  `json:"logicalDag"`
+	Streams    int64            `json:"subStreams"`
+	Roots      json.RawMessage  `json:"roots"`
+	Layers     json.RawMessage  `json:"layers"`
+	SeenBlocks *seenBlocksStats `json:"seenBlocks"`
+}
+
+func runSeenBlocks(t *testing.T, input []byte, maxMemory string) (*seenBlocksTestStats, map[string]struct{}) {
+
+	out := testRun(
+		t,
+		[]string{
+			"--ipfs-add-compatible-command=--cid-version=1",
+			"--chunkers=fixed-size_512",
+			"--collectors=fixed-outdegree_max-outdegree=8",
+			"--seen-blocks-max-memory=" + maxMemory,
+		},
+		bytes.NewReader(input),
+		emStatsJsonl, emCarV0PinlessStream,
+	)
+
+	s := new(seenBlocksTestStats)
+	if err := json.Unmarshal(out[emStatsJsonl], s); err != nil {
+		t.Fatalf("Unexpected stats unmarshal error: %s", err)
+	}
+	if s.SeenBlocks == nil {
+		t.Fatalf("Stats lack the seenBlocks section")
+	}
+
+	sections := make(map[string]struct{})
+	for _, sec := range testCarSections(t, out[emCarV0PinlessStream]) {
+		if _, seen := sections[string(sec)]; seen {
+			t.Fatalf("Car section written out more than once")
+		}
+		sections[string(sec)] = struct{}{}
+	}
+
+	return s, sections
+}
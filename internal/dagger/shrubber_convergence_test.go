@@ -0,0 +1,132 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+// The content-defined shrubber subgroups must not depend on what precedes the
+// data: every variant below shares all link nodes of the unprefixed one, save
+// for the leading subgroups formed before the chunker resyncs, and the single
+// fixed-outdegree root above them all
+var shrubberConvergenceArgs = []string{
+	"--ipfs-add-compatible-command=--cid-version=1",
+	"--chunkers=pad-finder_max-pad-run=1048576_static-pad-literal-max=65536_pad-static-hex=00_static-pad-min-repeats=1000" +
+		"__buzhash_hash-table=GoIPFSv0_state-target=0_state-mask-bits=14_min-size=4096_max-size=65536",
+	"--collectors=shrubber_max-payload=0_static-pad-repeater-nodes=4_cid-subgroup-mask-bits=3_cid-subgroup-target=5_cid-subgroup-min-nodes=2" +
+		"__fixed-outdegree_max-outdegree=174",
+}
+
+var shrubberConvergenceFixtures = []struct {
+	prefixLen int
+	root      string
+}{
+	{0, "bafybeiaiib4eno4ozf6nt2ub7pidk7e4f6jx2yl2ctozghhqgxbc5cabae"},
+	{1, "bafybeietzqt6aa7ir6omamm7oicby5w4qkfqm5p4cwrfw6x6urvrskmqjq"},
+	{4093, "bafybeicjedufezx5eunlssoqrttegzs5cq625cm6skcfxkmqvozcnrnoci"},
+	{1<<20 + 7, "bafybeiftmhk5w3wzhgafseqvzqk4svpxpkhxclmyvww2qloru7z5juxpp4"},
+}
+
+type shrubberRun struct {
+	root       string
+	linkBlocks map[string]struct{}
+	layers     map[string]bool
+}
+
+func TestShrubberConvergence(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	// random data with a run of zeros, collapsed into a padding cluster
+	payload := make([]byte, 8<<20)
+	rnd.Read(payload)
+	for i := 3 << 20; i < 6<<20+123; i++ {
+		payload[i] = 0
+	}
+
+	prefix := make([]byte, 1<<20+7)
+	rnd.Read(prefix)
+
+	var base *shrubberRun
+
+	for _, fx := range shrubberConvergenceFixtures {
+
+		input := append(append([]byte{}, prefix[:fx.prefixLen]...), payload...)
+
+		run := runShrubberConvergence(t, input)
+		if rerun := runShrubberConvergence(t, input); rerun.root != run.root || len(rerun.linkBlocks) != len(run.linkBlocks) {
+			t.Fatalf("Prefix of %d bytes: repeated run resulted in root %s instead of %s", fx.prefixLen, rerun.root, run.root)
+		}
+
+		if run.root != fx.root {
+			t.Fatalf("Prefix of %d bytes: expected root CID %s, but instead generated %s", fx.prefixLen, fx.root, run.root)
+		}
+
+		for _, l := range []string{"ShrubberCidSubgroups", "ShrubberGroups", "PaddingClusters", "PaddingSuperblocks"} {
+			if !run.layers[l] {
+				t.Fatalf("Prefix of %d bytes: layer %s missing from the stats", fx.prefixLen, l)
+			}
+		}
+
+		if base == nil {
+			base = run
+			if len(base.linkBlocks) < 32 {
+				t.Fatalf("Only %d link nodes formed, too few to be meaningful", len(base.linkBlocks))
+			}
+			continue
+		}
+
+		var missing int
+		for c := range base.linkBlocks {
+			if _, found := run.linkBlocks[c]; !found {
+				missing++
+			}
+		}
+		if missing > 3 {
+			t.Fatalf(
+				"Prefix of %d bytes: %d out of %d link nodes of the unprefixed input not formed",
+				fx.prefixLen,
+				missing,
+				len(base.linkBlocks),
+			)
+		}
+	}
+}
+
+func runShrubberConvergence(t *testing.T, input []byte) *shrubberRun {
+
+	out := testRun(
+		t,
+		shrubberConvergenceArgs,
+		bytes.NewReader(input),
+		emRootsJsonl, emStatsJsonl, emCarV0PinlessStream,
+	)
+
+	run := &shrubberRun{
+		root:       testRootCids(t, out[emRootsJsonl])[0],
+		linkBlocks: make(map[string]struct{}),
+		layers:     make(map[string]bool),
+	}
+
+	var s struct {
+		Layers []struct{ Label string }
+	}
+	if err := json.Unmarshal(out[emStatsJsonl], &s); err != nil {
+		t.Fatalf("Unexpected stats unmarshal error: %s", err)
+	}
+	for _, l := range s.Layers {
+		run.layers[l.Label] = true
+	}
+
+	// [CIDv1 sha2-256][block] sections: the header is the only one not
+	// starting with a CIDv1
+	for _, sec := range testCarSections(t, out[emCarV0PinlessStream]) {
+		if sec[0] == 0x01 && sec[1] == 0x70 {
+			run.linkBlocks[string(sec[:36])] = struct{}{}
+		}
+	}
+
+	return run
+}
@@ -0,0 +1,79 @@
+package dagger
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ribasushi/DAGger/internal/util/stream"
+)
+
+type inputHolesStats struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// The holes of a sparse regular file on stdin, as [start, end) stream offsets.
+// Appended to by the ring buffer fill as they are located, and pruned by
+// processStream() once they are behind the current region
+type sparseInput struct {
+	mu    sync.Mutex
+	holes [][2]int64
+}
+
+// Only a single stream maps file offsets directly onto stream offsets: in
+// every other mode the input is read as usual
+func (dgr *Dagger) sparseAwareReader(inputReader io.Reader) io.Reader {
+
+	dgr.sparseInput = nil
+	if dgr.cfg.MultipartStream || dgr.tarInput != nil || dgr.cfg.Decompress != decompressNone {
+		return inputReader
+	}
+
+	sr := stream.NewSparseReader(inputReader)
+	if sr == nil {
+		return inputReader
+	}
+
+	si := &sparseInput{}
+	dgr.sparseInput = si
+	dgr.statSummary.InputHoles = &inputHolesStats{}
+	holeStats := dgr.statSummary.InputHoles
+
+	sr.OnHole = func(offset, length int64) {
+		atomic.AddInt64(&holeStats.Count, 1)
+		atomic.AddInt64(&holeStats.Bytes, length)
+		si.mu.Lock()
+		si.holes = append(si.holes, [2]int64{offset, offset + length})
+		si.mu.Unlock()
+	}
+
+	return sr
+}
+
+// The holes overlapping a region, relative to its start
+func (si *sparseInput) zeroRangesWithin(regionOffset int64, regionSize int) (ranges [][2]int) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	for len(si.holes) > 0 && si.holes[0][1] <= regionOffset {
+		si.holes = si.holes[1:]
+	}
+
+	regionEnd := regionOffset + int64(regionSize)
+	for _, h := range si.holes {
+		if h[0] >= regionEnd {
+			break
+		}
+		start, end := h[0], h[1]
+		if start < regionOffset {
+			start = regionOffset
+		}
+		if end > regionEnd {
+			end = regionEnd
+		}
+		ranges = append(ranges, [2]int{int(start - regionOffset), int(end - regionOffset)})
+	}
+
+	return
+}
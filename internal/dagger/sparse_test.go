@@ -0,0 +1,122 @@
+package dagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Taking the holes of a sparse file as-is must result in the same DAG as
+// scanning the very same bytes for zeros. Runs of zeros are placed next to
+// the holes, with lengths not divisible by the multi-byte atom
+func TestSparseInputConvergence(t *testing.T) {
+
+	fh, err := ioutil.TempFile("", "dagger-sparse-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempfile error: %s", err)
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	rnd := rand.New(rand.NewSource(42))
+	data := func(size, leadingZeros, trailingZeros int) []byte {
+		b := make([]byte, size)
+		rnd.Read(b)
+		for i := 0; i < leadingZeros; i++ {
+			b[i] = 0
+		}
+		for i := 0; i < trailingZeros; i++ {
+			b[size-1-i] = 0
+		}
+		return b
+	}
+
+	// [size of data or of a hole, zeros at the start of the data, zeros at its end]
+	for _, seg := range [][3]int{
+		{3<<20 + 4096, 0, 4099},
+		{-(5 << 20), 0, 0},
+		{1 << 20, 1002, 3},
+		{-(1<<20 + 8192), 0, 0},
+		{4096, 6, 0},
+		{-(3 << 20), 0, 0},
+	} {
+		if seg[0] < 0 {
+			if _, err := fh.Seek(int64(-seg[0]), io.SeekCurrent); err != nil {
+				t.Fatalf("Unexpected seek error: %s", err)
+			}
+		} else if _, err := fh.Write(data(seg[0], seg[1], seg[2])); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+	}
+	// a hole at the very end
+	end, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatalf("Unexpected seek error: %s", err)
+	}
+	if err := fh.Truncate(end); err != nil {
+		t.Fatalf("Unexpected truncate error: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(fh.Name())
+	if err != nil {
+		t.Fatalf("Unexpected read error: %s", err)
+	}
+
+	for _, atom := range []string{"00", "00000000"} {
+		chunkers := "--chunkers=pad-finder_max-pad-run=1048576_static-pad-literal-max=65536_pad-static-hex=" + atom + "_static-pad-min-repeats=256" +
+			"__buzhash_hash-table=GoIPFSv0_state-target=0_state-mask-bits=14_min-size=4096_max-size=65536"
+
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("Unexpected seek error: %s", err)
+		}
+		sparseRoot, sparseStats := runSparseInput(t, chunkers, fh)
+		if sparseStats.InputHoles == nil || sparseStats.InputHoles.Count == 0 {
+			t.Skipf("The filesystem of %s does not report holes", fh.Name())
+		}
+
+		plainRoot, plainStats := runSparseInput(t, chunkers, bytes.NewReader(contents))
+		if plainStats.InputHoles != nil {
+			t.Fatalf("Atom %s: holes reported for a regular reader", atom)
+		}
+
+		if sparseRoot != plainRoot {
+			t.Fatalf("Atom %s: reading the sparse file resulted in root %s instead of %s", atom, sparseRoot, plainRoot)
+		}
+
+		sl, _ := json.Marshal(sparseStats.Layers)
+		pl, _ := json.Marshal(plainStats.Layers)
+		if !bytes.Equal(sl, pl) {
+			t.Fatalf("Atom %s: layer stats differ between the sparse and the regular read:\n%s\n%s", atom, sl, pl)
+		}
+	}
+}
+
+type sparseTestStats struct {
+	InputHoles *inputHolesStats `json:"inputHoles"`
+	Layers     json.RawMessage  `json:"layers"`
+}
+
+func runSparseInput(t *testing.T, chunkers string, input io.Reader) (string, *sparseTestStats) {
+
+	out := testRun(
+		t,
+		[]string{
+			"--ipfs-add-compatible-command=--cid-version=1",
+			chunkers,
+			"--collectors=fixed-outdegree_max-outdegree=174",
+		},
+		input,
+		emRootsJsonl, emStatsJsonl,
+	)
+
+	s := new(sparseTestStats)
+	if err := json.Unmarshal(out[emStatsJsonl], s); err != nil {
+		t.Fatalf("Unexpected stats unmarshal error: %s", err)
+	}
+
+	return testRootCids(t, out[emRootsJsonl])[0], s
+}
@@ -3,12 +3,12 @@ package dagger
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"sort"
 	"strings"
 
 	"github.com/ipfs/go-qringbuf"
 	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+	dgrcollector "github.com/ribasushi/DAGger/internal/dagger/collector"
 	dgrencoder "github.com/ribasushi/DAGger/internal/dagger/encoder"
 
 	"github.com/ribasushi/DAGger/internal/constants"
@@ -33,7 +33,6 @@ type seenRoot struct {
 	cid   []byte
 }
 
-type seenBlocks map[[seenHashSize]byte]uniqueBlockStats
 type seenRoots map[[seenHashSize]byte]seenRoot
 
 func seenKey(b *dgrblock.Header) (id *[seenHashSize]byte) {
@@ -52,6 +51,13 @@ func seenKey(b *dgrblock.Header) (id *[seenHashSize]byte) {
 	return
 }
 
+type dedupIndexStats struct {
+	KnownBlocks   int64 `json:"knownBlocks"`
+	SkippedBlocks int64 `json:"skippedBlocks"`
+	SkippedSize   int64 `json:"skippedWireSize"`
+	AddedBlocks   int64 `json:"addedBlocks"`
+}
+
 type statSummary struct {
 	EventType string `json:"event"`
 	Dag       struct {
@@ -59,10 +65,14 @@ type statSummary struct {
 		Size    int64 `json:"wireSize"`
 		Payload int64 `json:"payload"`
 	} `json:"logicalDag"`
-	Streams  int64        `json:"subStreams"`
-	Roots    []rootStats  `json:"roots,omitempty"`
-	Layers   []layerStats `json:"layers,omitempty"`
-	SysStats struct {
+	Streams          int64            `json:"subStreams"`
+	InputCompression string           `json:"inputCompression,omitempty"`
+	InputHoles       *inputHolesStats `json:"inputHoles,omitempty"`
+	Roots            []rootStats      `json:"roots,omitempty"`
+	Layers           []layerStats     `json:"layers,omitempty"`
+	DedupIndex       *dedupIndexStats `json:"dedupIndex,omitempty"`
+	SeenBlocks       *seenBlocksStats `json:"seenBlocks,omitempty"`
+	SysStats         struct {
 		qringbuf.Stats
 		ElapsedNsecs int64 `json:"elapsedNanoseconds"`
 
@@ -97,6 +107,11 @@ type statSummary struct {
 		ArgvInitial  []string `json:"argvInitial"`
 		GoVersion    string   `json:"goVersion"`
 	} `json:"sys"`
+
+	// filled in by aggregateBlockStats()
+	uniqueTotals struct {
+		count, weight, leafCount, leafWeight int64
+	}
 }
 type layerStats struct {
 	label     string
@@ -119,100 +134,20 @@ type sameSizeBlockStats struct {
 }
 type uniqueBlockStats struct {
 	sizeBlock int
-	seenAt    seenTimesAt
+	origin    dgrencoder.NodeOrigin // the preceding one, when seen at several
 	*blockPostProcessResult
 }
-type seenTimesAt map[dgrencoder.NodeOrigin]int64
 
-func (dgr *Dagger) OutputSummary() {
+func (dgr *Dagger) OutputSummary() (err error) {
 
 	// no stats emitters - nowhere to output
-	if dgr.cfg.emitters[emStatsText] == nil && dgr.cfg.emitters[emStatsJsonl] == nil {
+	if !dgr.summaryRequested() {
 		return
 	}
 
 	smr := &dgr.statSummary
-	var totalUCount, totalUWeight, leafUWeight, leafUCount int64
-
-	if dgr.seenBlocks != nil && len(dgr.seenBlocks) > 0 {
-		layers := make(map[dgrencoder.NodeOrigin]*layerStats, 10) // if more than 10 layers - something odd is going on
-
-		for sk, b := range dgr.seenBlocks {
-			totalUCount++
-			totalUWeight += int64(b.sizeBlock)
-
-			// An identical block could be emitted by multiple generators ( e.g. trickle could )
-			// Take the lowest-sorting one
-			gens := make([]dgrencoder.NodeOrigin, 0, len(b.seenAt))
-			for g := range b.seenAt {
-				gens = append(gens, g)
-			}
-			sortGenerators(gens)
-
-			if _, exist := layers[gens[0]]; !exist {
-				layers[gens[0]] = &layerStats{
-					countTracker: make(map[int]*sameSizeBlockStats, 256), // SANCHECK: somewhat arbitrary
-				}
-			}
-			if _, exist := layers[gens[0]].countTracker[b.sizeBlock]; !exist {
-				layers[gens[0]].countTracker[b.sizeBlock] = &sameSizeBlockStats{
-					SizeBlock: b.sizeBlock,
-				}
-
-			}
-			layers[gens[0]].countTracker[b.sizeBlock].CountUniqueBlocksAtSize++
-
-			if _, root := dgr.seenRoots[sk]; root {
-				layers[gens[0]].countTracker[b.sizeBlock].CountRootBlocksAtSize++
-			}
-		}
-
-		var nonLinkLayers int
-		genInOrder := make([]dgrencoder.NodeOrigin, 0, len(layers))
-		for g := range layers {
-			genInOrder = append(genInOrder, g)
-			if g.OriginatingLayer == -1 {
-				nonLinkLayers++
-			}
-		}
-		sortGenerators(genInOrder)
-
-		for i, g := range genInOrder {
-			if g.OriginatingLayer == -1 {
-				if g.LocalSubLayer == 0 || g.LocalSubLayer == 1 {
-					for s, c := range layers[g].countTracker {
-						leafUWeight += c.CountUniqueBlocksAtSize * int64(s)
-						leafUCount += c.CountUniqueBlocksAtSize
-					}
-				}
-				if g.LocalSubLayer == 0 {
-					layers[g].LongLabel = "DataBlocks"
-					layers[g].label = "DB"
-				} else if g.LocalSubLayer == 1 {
-					layers[g].LongLabel = "PaddingBlocks"
-					layers[g].label = "PB"
-				} else if g.LocalSubLayer == 2 {
-					layers[g].LongLabel = "PaddingSuperblocks"
-					layers[g].label = "PS"
-				} else {
-					log.Fatalf("Unexpected leaf-local-layer '%d'", g.LocalSubLayer)
-				}
-			} else {
-				id := len(genInOrder) - i - nonLinkLayers
-				layers[g].LongLabel = fmt.Sprintf("LinkingLayer%d", id)
-				layers[g].label = fmt.Sprintf("L%d", id)
-			}
-
-			for _, c := range layers[g].countTracker {
-				layers[g].BlockSizeCounts = append(layers[g].BlockSizeCounts, *c)
-			}
-			sort.Slice(layers[g].BlockSizeCounts, func(i, j int) bool {
-				return layers[g].BlockSizeCounts[i].SizeBlock < layers[g].BlockSizeCounts[j].SizeBlock
-			})
-
-			smr.Layers = append(smr.Layers, *layers[g])
-		}
-	}
+	totalUCount, totalUWeight := smr.uniqueTotals.count, smr.uniqueTotals.weight
+	leafUCount, leafUWeight := smr.uniqueTotals.leafCount, smr.uniqueTotals.leafWeight
 
 	if statsJsonlOut := dgr.cfg.emitters[emStatsJsonl]; statsJsonlOut != nil {
 		// emit the JSON last, so that piping to e.g. `jq` works nicer
@@ -226,17 +161,29 @@ func (dgr *Dagger) OutputSummary() {
 				smr.Roots = []rootStats{}
 			}
 
-			jsonl, err := json.Marshal(smr)
+			// an error from the text emitter takes precedence
 			if err != nil {
-				log.Fatalf("Encoding '%s' failed: %s", emStatsJsonl, err)
+				return
+			}
+
+			jsonl, jsonErr := json.Marshal(smr)
+			if jsonErr != nil {
+				err = fmt.Errorf("encoding '%s' failed: %s", emStatsJsonl, jsonErr)
+				return
 			}
 
-			if _, err := fmt.Fprintf(statsJsonlOut, "%s\n", jsonl); err != nil {
-				log.Fatalf("Emitting '%s' failed: %s", emStatsJsonl, err)
+			if _, writeErr := fmt.Fprintf(statsJsonlOut, "%s\n", jsonl); writeErr != nil {
+				err = fmt.Errorf("emitting '%s' failed: %s", emStatsJsonl, writeErr)
 			}
 		}()
 	}
 
+	if dgr.cfg.emitters[emStatsOpenMetrics] != nil || dgr.cfg.StatsOpenMetricsFile != "" {
+		if err = dgr.outputOpenMetrics(); err != nil {
+			return
+		}
+	}
+
 	statsTextOut := dgr.cfg.emitters[emStatsText]
 	if statsTextOut == nil {
 		return
@@ -250,9 +197,13 @@ func (dgr *Dagger) OutputSummary() {
 		)
 	}
 
+	// keep the first error only, subsequent writes are no-ops
 	writeTextOutf := func(f string, args ...interface{}) {
-		if _, err := fmt.Fprintf(statsTextOut, f, args...); err != nil {
-			log.Fatalf("Emitting '%s' failed: %s", emStatsText, err)
+		if err != nil {
+			return
+		}
+		if _, writeErr := fmt.Fprintf(statsTextOut, f, args...); writeErr != nil {
+			err = fmt.Errorf("emitting '%s' failed: %s", emStatsText, writeErr)
 		}
 	}
 
@@ -295,6 +246,14 @@ func (dgr *Dagger) OutputSummary() {
 		)
 	}
 
+	if di := smr.DedupIndex; di != nil {
+		writeTextOutf(
+			"Previously emitted:  %17s bytes of %s blocks (index grew from %s to %s blocks)\n",
+			text.Commify64(di.SkippedSize), text.Commify64(di.SkippedBlocks),
+			text.Commify64(di.KnownBlocks), text.Commify64(di.KnownBlocks+di.AddedBlocks),
+		)
+	}
+
 	if len(smr.Layers) == 0 {
 		return
 	}
@@ -338,6 +297,109 @@ func (dgr *Dagger) OutputSummary() {
 	}
 
 	writeTextOutf("%s\n", strings.Join(descParts, ""))
+	return
+}
+
+func (dgr *Dagger) summaryRequested() bool {
+	return dgr.cfg.emitters[emStatsText] != nil ||
+		dgr.cfg.emitters[emStatsJsonl] != nil ||
+		dgr.cfg.emitters[emStatsOpenMetrics] != nil ||
+		dgr.cfg.StatsOpenMetricsFile != ""
+}
+
+// Folds seenBlocks into per-layer stats, called at the end of ProcessReader()
+// while any spilled runs are still available
+func (dgr *Dagger) aggregateBlockStats() error {
+	smr := &dgr.statSummary
+	tot := &smr.uniqueTotals
+
+	layers := make(map[dgrencoder.NodeOrigin]*layerStats, 10) // if more than 10 layers - something odd is going on
+
+	if err := dgr.seenBlocks.forEach(func(sk *[seenHashSize]byte, b uniqueBlockStats) {
+		tot.count++
+		tot.weight += int64(b.sizeBlock)
+
+		// An identical block could be emitted by multiple generators ( e.g. trickle could )
+		// seenBlocks retains the lowest-sorting one
+		g := b.origin
+
+		if _, exist := layers[g]; !exist {
+			layers[g] = &layerStats{
+				countTracker: make(map[int]*sameSizeBlockStats, 256), // SANCHECK: somewhat arbitrary
+			}
+		}
+		if _, exist := layers[g].countTracker[b.sizeBlock]; !exist {
+			layers[g].countTracker[b.sizeBlock] = &sameSizeBlockStats{
+				SizeBlock: b.sizeBlock,
+			}
+
+		}
+		layers[g].countTracker[b.sizeBlock].CountUniqueBlocksAtSize++
+
+		if _, root := dgr.seenRoots[*sk]; root {
+			layers[g].countTracker[b.sizeBlock].CountRootBlocksAtSize++
+		}
+	}); err != nil {
+		return err
+	}
+
+	labels := make(map[dgrencoder.NodeOrigin]dgrcollector.LayerLabel)
+	for _, c := range dgr.chainedCollectors {
+		if ll, isLabeler := c.(dgrcollector.LayerLabeler); isLabeler {
+			for g, l := range ll.LayerLabels() {
+				labels[g] = l
+			}
+		}
+	}
+
+	var genericLinkLayers int
+	genInOrder := make([]dgrencoder.NodeOrigin, 0, len(layers))
+	for g := range layers {
+		genInOrder = append(genInOrder, g)
+		if _, labeled := labels[g]; !labeled && g.OriginatingLayer != -1 {
+			genericLinkLayers++
+		}
+	}
+	sortGenerators(genInOrder)
+
+	for _, g := range genInOrder {
+		if g.OriginatingLayer == -1 && (g.LocalSubLayer == 0 || g.LocalSubLayer == 1) {
+			for s, c := range layers[g].countTracker {
+				tot.leafWeight += c.CountUniqueBlocksAtSize * int64(s)
+				tot.leafCount += c.CountUniqueBlocksAtSize
+			}
+		}
+
+		if l, labeled := labels[g]; labeled {
+			layers[g].LongLabel = l.Long
+			layers[g].label = l.Short
+		} else if g.OriginatingLayer == -1 {
+			if g.LocalSubLayer == 0 {
+				layers[g].LongLabel = "DataBlocks"
+				layers[g].label = "DB"
+			} else if g.LocalSubLayer == 1 {
+				layers[g].LongLabel = "PaddingBlocks"
+				layers[g].label = "PB"
+			} else {
+				return fmt.Errorf("unexpected leaf-local-layer '%d'", g.LocalSubLayer)
+			}
+		} else {
+			layers[g].LongLabel = fmt.Sprintf("LinkingLayer%d", genericLinkLayers)
+			layers[g].label = fmt.Sprintf("L%d", genericLinkLayers)
+			genericLinkLayers--
+		}
+
+		for _, c := range layers[g].countTracker {
+			layers[g].BlockSizeCounts = append(layers[g].BlockSizeCounts, *c)
+		}
+		sort.Slice(layers[g].BlockSizeCounts, func(i, j int) bool {
+			return layers[g].BlockSizeCounts[i].SizeBlock < layers[g].BlockSizeCounts[j].SizeBlock
+		})
+
+		smr.Layers = append(smr.Layers, *layers[g])
+	}
+
+	return nil
 }
 
 func sortGenerators(g []dgrencoder.NodeOrigin) {
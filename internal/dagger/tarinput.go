@@ -0,0 +1,162 @@
+package dagger
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	inputFormatStream = "stream"
+	inputFormatTar    = "tar"
+)
+
+// State of --input-format=tar: member headers are parsed by archive/tar, which
+// in turn serves the content of every regular member to the ring buffer as a
+// substream of its own, exactly like a --multipart size prefix would
+type tarInput struct {
+	tr  *tar.Reader
+	raw io.Reader
+
+	// everything read from the underlying input, to derive the amount of
+	// header and padding bytes for progress reporting
+	rawRead        int64
+	rawAccounted   int64
+	lastMemberSize int64
+
+	// the member whose content is currently being processed
+	cur *tarMember
+}
+
+// What roots-jsonl reports about the member a root was produced from
+type tarMember struct {
+	mode  int64
+	mtime int64
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (dgr *Dagger) setupTarInput() (argErrs []string) {
+
+	cfg := &dgr.cfg
+
+	switch cfg.InputFormat {
+	case inputFormatStream:
+		if cfg.TarDirectoryRoot {
+			argErrs = append(argErrs, fmt.Sprintf("--tar-directory-root requires --input-format=%s", inputFormatTar))
+		}
+		return
+	case inputFormatTar:
+		// handled below
+	default:
+		return []string{fmt.Sprintf(
+			"Invalid --input-format '%s', expecting one of '%s' or '%s'",
+			cfg.InputFormat,
+			inputFormatStream,
+			inputFormatTar,
+		)}
+	}
+
+	if cfg.MultipartStream || cfg.MultipartPaths {
+		return []string{fmt.Sprintf("--input-format=%s can not be combined with --multipart or --multipart-paths", inputFormatTar)}
+	}
+
+	// every member is a substream
+	cfg.MultipartStream = true
+	dgr.tarInput = &tarInput{}
+	return
+}
+
+// Called once per ProcessReader: the returned reader is what the ring buffer
+// and the header parser consume
+func (ti *tarInput) reader(inputReader io.Reader) io.Reader {
+	*ti = tarInput{}
+	ti.raw = countingReader{r: inputReader, n: &ti.rawRead}
+	ti.tr = tar.NewReader(ti.raw)
+	return ti.tr
+}
+
+func (dgr *Dagger) currentTarMember() *tarMember {
+	if dgr.tarInput == nil {
+		return nil
+	}
+	return dgr.tarInput.cur
+}
+
+// Advances to the next regular file, or with --tar-directory-root also to the
+// next directory, reported as a size of -1 same as with --multipart-paths.
+// Links, devices, fifos and the like have no content of their own: skipped
+func (dgr *Dagger) readTarHeader() (substreamSize int64, substreamPath string, eof bool, err error) {
+
+	ti := dgr.tarInput
+
+	for {
+		var hdr *tar.Header
+		hdr, err = ti.tr.Next()
+		dgr.statSummary.SysStats.ReadCalls++
+
+		// consume the end-of-archive blocks and the record padding
+		if err == io.EOF {
+			if _, drainErr := io.Copy(ioutil.Discard, ti.raw); drainErr != nil {
+				return 0, "", false, fmt.Errorf("error reading past the end of the tar archive: %s", drainErr)
+			}
+		}
+
+		if dgr.progress != nil {
+			raw := atomic.LoadInt64(&ti.rawRead)
+			atomic.AddInt64(&dgr.progress.framingBytes, raw-ti.rawAccounted-ti.lastMemberSize)
+			ti.rawAccounted = raw
+		}
+		ti.lastMemberSize = 0
+
+		if err == io.EOF {
+			return 0, "", true, nil
+		} else if err != nil {
+			return 0, "", false, fmt.Errorf("error reading next tar member header: %s", err)
+		}
+
+		substreamPath = strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if substreamPath == "" || substreamPath == "." {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			substreamSize = hdr.Size
+		case tar.TypeDir:
+			if dgr.dirTree == nil {
+				continue
+			}
+			substreamSize = -1
+		default:
+			continue
+		}
+
+		if dgr.dirTree != nil {
+			for _, c := range strings.Split(substreamPath, "/") {
+				if c == "" || c == "." || c == ".." {
+					return 0, "", false, fmt.Errorf("invalid tar member name '%s': empty, '.' and '..' components are not allowed", hdr.Name)
+				}
+			}
+		}
+
+		ti.lastMemberSize = hdr.Size
+		ti.cur = &tarMember{
+			mode:  hdr.Mode & 07777,
+			mtime: hdr.ModTime.Unix(),
+		}
+		return
+	}
+}
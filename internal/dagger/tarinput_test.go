@@ -0,0 +1,110 @@
+package dagger
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every regular member of a tar archive, in whichever of the formats, must
+// result in the same root as the equivalent --multipart substream, with every
+// other kind of member skipped
+func TestTarMatchesMultipart(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+	contents := make([][]byte, 3)
+	for i, size := range []int{3<<20 + 7, 12345, 1 << 20} {
+		contents[i] = make([]byte, size)
+		rnd.Read(contents[i])
+	}
+
+	type member struct {
+		hdr     tar.Header
+		content []byte
+	}
+	mtime := time.Unix(1600000000, 0)
+	members := []member{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0755}, nil},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "d/a", Mode: 0644}, contents[0]},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "empty", Mode: 0600}, nil},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "d/a", Mode: 0777}, nil},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "d/" + strings.Repeat("long", 30), Mode: 0755}, contents[1]},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "d/a-again", Mode: 0644}, contents[0]},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "c", Mode: 0644}, contents[2]},
+	}
+
+	var multipart bytes.Buffer
+	var expectedPaths []string
+	for _, m := range members {
+		if m.hdr.Typeflag == tar.TypeReg {
+			binary.Write(&multipart, binary.BigEndian, int64(len(m.content)))
+			multipart.Write(m.content)
+			expectedPaths = append(expectedPaths, m.hdr.Name)
+		}
+	}
+
+	args := []string{"--ipfs-add-compatible-command=--cid-version=1"}
+	expected := testRootCids(t, testRun(
+		t,
+		append(args, "--multipart"),
+		bytes.NewReader(multipart.Bytes()),
+		emRootsJsonl,
+	)[emRootsJsonl])
+
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for _, m := range members {
+			hdr := m.hdr
+			hdr.Format = format
+			hdr.ModTime = mtime
+			hdr.Size = int64(len(m.content))
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatalf("Unexpected tar header error: %s", err)
+			}
+			if _, err := tw.Write(m.content); err != nil {
+				t.Fatalf("Unexpected tar write error: %s", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Unexpected tar close error: %s", err)
+		}
+
+		rootsJsonl := testRun(
+			t,
+			append(args, "--input-format=tar"),
+			bytes.NewReader(archive.Bytes()),
+			emRootsJsonl,
+		)[emRootsJsonl]
+
+		if roots := testRootCids(t, rootsJsonl); !reflect.DeepEqual(roots, expected) {
+			t.Fatalf("%s archive resulted in roots %v instead of %v", format, roots, expected)
+		}
+
+		var paths []string
+		s := bufio.NewScanner(bytes.NewReader(rootsJsonl))
+		for s.Scan() {
+			var r struct {
+				Path  string
+				Mtime int64
+			}
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Fatalf("Unexpected root unmarshal error: %s", err)
+			}
+			if r.Mtime != mtime.Unix() {
+				t.Fatalf("%s archive member %s reported with mtime %d instead of %d", format, r.Path, r.Mtime, mtime.Unix())
+			}
+			paths = append(paths, r.Path)
+		}
+		if !reflect.DeepEqual(paths, expectedPaths) {
+			t.Fatalf("%s archive resulted in paths %v instead of %v", format, paths, expectedPaths)
+		}
+	}
+}
@@ -14,8 +14,9 @@ import (
 type config struct {
 	optSet *getopt.Set
 
-	SortDirs bool `getopt:"--sort-dir-contents           When recursing into directories sort their contents just like ioutil.ReadDir would. Default: [false]"`
-	Help     bool `getopt:"-h --help                     Display help"`
+	SortDirs  bool `getopt:"--sort-dir-contents           When recursing into directories sort their contents just like ioutil.ReadDir would. Default: [false]"`
+	EmitPaths bool `getopt:"--emit-paths                  Precede every size with a SInt64BE-length-prefixed path relative to the argument's parent, and emit each directory as a -1 size, as expected by 'stream-dagger --multipart-paths'. Default: [false]"`
+	Help      bool `getopt:"-h --help                     Display help"`
 }
 
 func NewFromArgs(argv []string) (rpk *Repacker, fnArgs []string) {
@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 	"sort"
+
+	"github.com/ribasushi/DAGger/internal/util/stream"
 )
 
 type Repacker struct {
@@ -25,11 +27,17 @@ type transformResult struct {
 type PathTuple struct {
 	Path  string
 	Lstat os.FileInfo
+
+	emitPath string // relative to the parent of the top-level argument
 }
 
 func (rpk *Repacker) RecursePaths(pts []PathTuple) error {
 
 	for _, pt := range pts {
+		if pt.emitPath == "" {
+			pt.emitPath = pt.Lstat.Name()
+		}
+
 		if pt.Lstat.Mode().IsRegular() {
 			if err := rpk.processFile(pt); err != nil {
 				return err
@@ -41,6 +49,13 @@ func (rpk *Repacker) RecursePaths(pts []PathTuple) error {
 				continue
 			}
 
+			if rpk.cfg.EmitPaths {
+				if err := rpk.writeRecordPrefix(pt.emitPath, -1); err != nil {
+					dh.Close()
+					return fmt.Errorf("Error streaming out directory record for %s: %s\n", pt.Path, err)
+				}
+			}
+
 			// directory recursion never produces errors, just logs "skips"
 			subPts := func() []PathTuple {
 				defer dh.Close()
@@ -60,8 +75,9 @@ func (rpk *Repacker) RecursePaths(pts []PathTuple) error {
 				subPts := make([]PathTuple, len(dirContents))
 				for i := range dirContents {
 					subPts[i] = PathTuple{
-						Path:  pt.Path + "/" + dirContents[i].Name(),
-						Lstat: dirContents[i],
+						Path:     pt.Path + "/" + dirContents[i].Name(),
+						Lstat:    dirContents[i],
+						emitPath: pt.emitPath + "/" + dirContents[i].Name(),
 					}
 				}
 				return subPts
@@ -90,13 +106,33 @@ func (rpk *Repacker) processFile(pt PathTuple) error {
 	}
 	defer fh.Close()
 
-	if err := binary.Write(os.Stdout, binary.BigEndian, pt.Lstat.Size()); err != nil {
+	if err := rpk.writeRecordPrefix(pt.emitPath, pt.Lstat.Size()); err != nil {
 		return fmt.Errorf("Error streaming out size prefix for %s: %s\n", pt.Path, err)
 	}
 
-	if _, err := io.Copy(os.Stdout, fh); err != nil {
+	// holes are zero-filled instead of being read
+	var content io.Reader = fh
+	if sr := stream.NewSparseReader(fh); sr != nil {
+		content = sr
+	}
+
+	if _, err := io.Copy(os.Stdout, content); err != nil {
 		return fmt.Errorf("Error streaming out data for %s: %s\n", pt.Path, err)
 	}
 
 	return nil
 }
+
+func (rpk *Repacker) writeRecordPrefix(emitPath string, size int64) error {
+
+	if rpk.cfg.EmitPaths {
+		if err := binary.Write(os.Stdout, binary.BigEndian, int64(len(emitPath))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(os.Stdout, emitPath); err != nil {
+			return err
+		}
+	}
+
+	return binary.Write(os.Stdout, binary.BigEndian, size)
+}
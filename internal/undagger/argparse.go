@@ -0,0 +1,80 @@
+package undagger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+)
+
+type config struct {
+	optSet *getopt.Set
+
+	MultipartStream  bool   `getopt:"--multipart Emit each root as a SInt64BE-size-prefixed stream, the inverse of stream-repack-multipart. The car-v1-file and car-v2-file emitters list the root of every stream, repeated ones included"`
+	CarSplitManifest string `getopt:"--car-split-manifest=path Instead of a single car on stdIN, process the entire set of .car files listed by this output of the car-split-manifest-jsonl emitter of stream-dagger. The roots are those of every stream in manifest order, repeated ones included"`
+	Verify           bool   `getopt:"--verify    Instead of reconstructing payloads, check that every block matches its CID, every link resolves within the car, and all declared Tsize/filesize/blocksizes (or dagSizes/payloadSizes of DAG-CBOR nodes) are accurate. Blocks of any other codec are reported as unverifiable. Each violation is reported as a JSONL line on stdOUT"`
+	Help             bool   `getopt:"-h --help   Display help"`
+}
+
+func NewFromArgs(argv []string) (udg *Undagger) {
+
+	udg = &Undagger{
+		cfg: config{
+			optSet: getopt.New(),
+		},
+	}
+
+	cfg := &udg.cfg
+
+	if err := options.RegisterSet("", cfg, cfg.optSet); err != nil {
+		log.Fatalf("option set registration failed: %s", err)
+	}
+	cfg.optSet.SetParameters("< {{car-file}}\n")
+
+	var argParseErrors []string
+	if err := cfg.optSet.Getopt(argv, nil); err != nil {
+		argParseErrors = append(argParseErrors, err.Error())
+	}
+
+	if len(cfg.optSet.Args()) > 0 {
+		argParseErrors = append(argParseErrors, fmt.Sprintf(
+			"program does not take free-form arguments: '%s'",
+			strings.Join(cfg.optSet.Args(), "', '"),
+		))
+	}
+
+	if cfg.Verify && cfg.MultipartStream {
+		argParseErrors = append(argParseErrors, "options --verify and --multipart are mutually exclusive")
+	}
+
+	if cfg.Help || len(argParseErrors) > 0 {
+		cfg.usageAndExit(argParseErrors)
+	}
+
+	return
+}
+
+func (cfg *config) usageAndExit(errorStrings []string) {
+
+	if len(errorStrings) > 0 {
+		fmt.Fprint(os.Stderr, "\nFatal error parsing arguments:\n\n")
+	}
+
+	cfg.optSet.PrintUsage(os.Stderr)
+
+	if len(errorStrings) > 0 {
+		sort.Strings(errorStrings)
+		fmt.Fprintf(
+			os.Stderr,
+			"\nFatal error parsing arguments:\n\t%s\n\n",
+			strings.Join(errorStrings, "\n\t"),
+		)
+		os.Exit(2)
+	}
+
+	os.Exit(0)
+}
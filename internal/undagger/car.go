@@ -0,0 +1,341 @@
+package undagger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	codecRaw     = 0x55
+	codecPB      = 0x70
+	codecCBOR    = 0x71
+	mhIdentity   = 0x00
+	mhSha2_256   = 0x12
+	carV2HdrSize = 40
+)
+
+type cidInfo struct {
+	raw       []byte
+	codec     uint64
+	mhCode    uint64
+	multihash []byte
+	digest    []byte
+}
+
+// location of a block's data within the car source
+type carBlock struct {
+	cid    cidInfo
+	src    io.ReaderAt
+	offset int64
+	size   int
+}
+
+type carContents struct {
+	version uint64
+	roots   []cidInfo
+
+	// keyed by the multihash: CIDv0 and CIDv1 links address the same block
+	blocks     map[string]carBlock
+	blockOrder []string
+}
+
+// Indexes every block in a CARv1 or CARv2. The block data itself is read
+// on-demand via the supplied io.ReaderAt
+func loadCar(src io.ReaderAt, srcSize int64) (car *carContents, err error) {
+
+	car = &carContents{
+		blocks: make(map[string]carBlock, 1024),
+	}
+
+	hdr, pos, err := readSection(src, 0, srcSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading car header failed: %s", err)
+	}
+	if car.version, car.roots, err = decodeCarHeader(hdr); err != nil {
+		return nil, fmt.Errorf("decoding car header failed: %s", err)
+	}
+
+	dataEnd := srcSize
+	if car.version == 2 {
+		var v2hdr [carV2HdrSize]byte
+		if _, err = src.ReadAt(v2hdr[:], pos); err != nil {
+			return nil, fmt.Errorf("reading CARv2 header failed: %s", err)
+		}
+		// skip 16 bytes of characteristics
+		dataOffset := int64(binary.LittleEndian.Uint64(v2hdr[16:]))
+		dataSize := int64(binary.LittleEndian.Uint64(v2hdr[24:]))
+		if dataOffset < pos+carV2HdrSize || dataSize < 0 || dataOffset+dataSize > srcSize {
+			return nil, fmt.Errorf("CARv2 header describes data payload [%d:%d] out of bounds", dataOffset, dataOffset+dataSize)
+		}
+		dataEnd = dataOffset + dataSize
+
+		if hdr, pos, err = readSection(src, dataOffset, dataEnd); err != nil {
+			return nil, fmt.Errorf("reading inner CARv1 header failed: %s", err)
+		}
+		var innerVersion uint64
+		if innerVersion, car.roots, err = decodeCarHeader(hdr); err != nil {
+			return nil, fmt.Errorf("decoding inner CARv1 header failed: %s", err)
+		} else if innerVersion != 1 {
+			return nil, fmt.Errorf("unexpected inner CAR version %d", innerVersion)
+		}
+	} else if car.version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", car.version)
+	}
+
+	for pos < dataEnd {
+		sectionStart := pos
+		var section []byte
+		if section, pos, err = readSection(src, pos, dataEnd); err != nil {
+			return nil, fmt.Errorf("reading block at offset %d failed: %s", sectionStart, err)
+		}
+
+		c, cidLen, err := parseCid(section)
+		if err != nil {
+			return nil, fmt.Errorf("block at offset %d: %s", sectionStart, err)
+		}
+
+		k := string(c.multihash)
+		if _, exists := car.blocks[k]; !exists {
+			car.blockOrder = append(car.blockOrder, k)
+		}
+		car.blocks[k] = carBlock{
+			cid:    c,
+			src:    src,
+			offset: pos - int64(len(section)) + int64(cidLen),
+			size:   len(section) - cidLen,
+		}
+	}
+
+	return car, nil
+}
+
+// Returns the data of a block, or the digest of an identity CID
+func (car *carContents) blockData(c cidInfo) ([]byte, error) {
+	if c.mhCode == mhIdentity {
+		return c.digest, nil
+	}
+
+	b, found := car.blocks[string(c.multihash)]
+	if !found {
+		return nil, fmt.Errorf("block %s not present in car", c)
+	}
+
+	data := make([]byte, b.size)
+	if _, err := b.src.ReadAt(data, b.offset); err != nil {
+		return nil, fmt.Errorf("reading block %s failed: %s", c, err)
+	}
+	return data, nil
+}
+
+// Reads a varint-length-prefixed section starting at pos, returning the
+// section content and the position immediately after it
+func readSection(src io.ReaderAt, pos, end int64) ([]byte, int64, error) {
+	var viBuf [binary.MaxVarintLen64]byte
+	n, err := src.ReadAt(viBuf[:], pos)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, pos, err
+	}
+
+	l, viLen := binary.Uvarint(viBuf[:n])
+	if viLen <= 0 {
+		return nil, pos, fmt.Errorf("invalid section length varint")
+	}
+	if l == 0 || l > math.MaxInt32 || pos+int64(viLen)+int64(l) > end {
+		return nil, pos, fmt.Errorf("section length %d out of bounds", l)
+	}
+
+	section := make([]byte, l)
+	if _, err = src.ReadAt(section, pos+int64(viLen)); err != nil {
+		return nil, pos, err
+	}
+	return section, pos + int64(viLen) + int64(l), nil
+}
+
+// Parses a binary CID at the start of b, returning it and its length
+func parseCid(b []byte) (c cidInfo, cidLen int, err error) {
+
+	// CIDv0 is a bare sha2-256 multihash
+	if len(b) >= 34 && b[0] == mhSha2_256 && b[1] == 32 {
+		return cidInfo{
+			raw:       b[:34],
+			codec:     codecPB,
+			mhCode:    mhSha2_256,
+			multihash: b[:34],
+			digest:    b[2:34],
+		}, 34, nil
+	}
+
+	var vals [4]uint64 // version, codec, multihash id, digest length
+	var mhStart int
+	for i := range vals {
+		if i == 2 {
+			mhStart = cidLen
+		}
+		v, n := binary.Uvarint(b[cidLen:])
+		if n <= 0 {
+			return c, 0, fmt.Errorf("malformed CID 0x%X", b)
+		}
+		vals[i] = v
+		cidLen += n
+	}
+
+	if vals[0] != 1 {
+		return c, 0, fmt.Errorf("unsupported CID version %d", vals[0])
+	}
+	if vals[3] > uint64(len(b)-cidLen) {
+		return c, 0, fmt.Errorf("malformed CID 0x%X: digest length %d out of bounds", b, vals[3])
+	}
+
+	digestStart := cidLen
+	cidLen += int(vals[3])
+
+	return cidInfo{
+		raw:       b[:cidLen],
+		codec:     vals[1],
+		mhCode:    vals[2],
+		multihash: b[mhStart:cidLen],
+		digest:    b[digestStart:cidLen],
+	}, cidLen, nil
+}
+
+// Minimal DAG-CBOR decoding, sufficient for a CAR header: a map with a
+// 'version' integer and an optional 'roots' array of tag-42 links
+func decodeCarHeader(b []byte) (version uint64, roots []cidInfo, err error) {
+
+	d := cborDecoder{buf: b}
+
+	major, mapLen := d.head()
+	if d.err == nil && major != 5 {
+		return 0, nil, fmt.Errorf("header is not a CBOR map")
+	}
+
+	for i := uint64(0); i < mapLen && d.err == nil; i++ {
+		kMajor, kLen := d.head()
+		if kMajor != 3 {
+			return 0, nil, fmt.Errorf("non-text map key")
+		}
+		switch string(d.take(kLen)) {
+
+		case "version":
+			if vMajor, v := d.head(); vMajor != 0 {
+				return 0, nil, fmt.Errorf("non-integer version")
+			} else {
+				version = v
+			}
+
+		case "roots":
+			aMajor, aLen := d.head()
+			if aMajor != 4 {
+				return 0, nil, fmt.Errorf("roots is not an array")
+			}
+			for j := uint64(0); j < aLen && d.err == nil; j++ {
+				if tMajor, tag := d.head(); tMajor != 6 || tag != 42 {
+					return 0, nil, fmt.Errorf("root is not a tag-42 link")
+				}
+				bMajor, bLen := d.head()
+				if bMajor != 2 || bLen < 2 {
+					return 0, nil, fmt.Errorf("root is not a byte-string")
+				}
+				cidBytes := d.take(bLen)
+				if d.err != nil {
+					break
+				}
+				// strip the \x00 multibase prefix
+				c, cidLen, err := parseCid(cidBytes[1:])
+				if err != nil {
+					return 0, nil, err
+				} else if cidLen != len(cidBytes)-1 {
+					return 0, nil, fmt.Errorf("trailing garbage after root CID")
+				}
+				roots = append(roots, c)
+			}
+
+		default:
+			d.skip()
+		}
+	}
+
+	if d.err == nil && d.pos != len(d.buf) {
+		d.err = fmt.Errorf("trailing garbage after header")
+	}
+
+	return version, roots, d.err
+}
+
+type cborDecoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *cborDecoder) take(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)-d.pos) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b
+}
+
+func (d *cborDecoder) head() (major byte, arg uint64) {
+	b := d.take(1)
+	if d.err != nil {
+		return 0xFF, 0
+	}
+
+	major = b[0] >> 5
+	switch info := b[0] & 0x1F; {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if v := d.take(1); d.err == nil {
+			arg = uint64(v[0])
+		}
+	case info == 25:
+		if v := d.take(2); d.err == nil {
+			arg = uint64(binary.BigEndian.Uint16(v))
+		}
+	case info == 26:
+		if v := d.take(4); d.err == nil {
+			arg = uint64(binary.BigEndian.Uint32(v))
+		}
+	case info == 27:
+		if v := d.take(8); d.err == nil {
+			arg = binary.BigEndian.Uint64(v)
+		}
+	default:
+		d.err = fmt.Errorf("indefinite-length or reserved CBOR item not supported")
+	}
+
+	if d.err != nil {
+		return 0xFF, 0
+	}
+	return
+}
+
+func (d *cborDecoder) skip() {
+	major, arg := d.head()
+	switch major {
+	case 2, 3:
+		d.take(arg)
+	case 4:
+		for i := uint64(0); i < arg && d.err == nil; i++ {
+			d.skip()
+		}
+	case 5:
+		for i := uint64(0); i < 2*arg && d.err == nil; i++ {
+			d.skip()
+		}
+	case 6:
+		d.skip()
+	}
+}
@@ -0,0 +1,120 @@
+package undagger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// The MultihashIndexSorted trailing a car-v2-file must list every block of the
+// data payload exactly once, sorted by digest, each pointing at the section
+// holding that very block
+func TestCarV2Index(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	var input bytes.Buffer
+	for _, size := range []int{3<<20 + 7, 0, 12345, 3<<20 + 7, 20} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		binary.Write(&input, binary.BigEndian, int64(size))
+		input.Write(b)
+	}
+
+	for _, hash := range []string{"sha2-256", "blake2b-256"} {
+		fh := testCarFile(t, input.Bytes(), "car-v2-file",
+			"--ipfs-add-compatible-command=--cid-version=1 --hash="+hash,
+			"--inline-max-size=36",
+			"--multipart",
+		)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		raw, err := ioutil.ReadFile(fh.Name())
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+
+		car, err := loadCar(bytes.NewReader(raw), int64(len(raw)))
+		if err != nil {
+			t.Fatalf("%s: unexpected car load error: %s", hash, err)
+		}
+		if car.version != 2 {
+			t.Fatalf("%s: expected a CARv2, got version %d", hash, car.version)
+		}
+
+		_, pos, err := readSection(bytes.NewReader(raw), 0, int64(len(raw)))
+		if err != nil {
+			t.Fatalf("%s: unexpected pragma read error: %s", hash, err)
+		}
+		v2hdr := raw[pos : pos+carV2HdrSize]
+		dataOffset := int64(binary.LittleEndian.Uint64(v2hdr[16:]))
+		dataEnd := dataOffset + int64(binary.LittleEndian.Uint64(v2hdr[24:]))
+		idx := raw[binary.LittleEndian.Uint64(v2hdr[32:]):]
+
+		if codec, n := binary.Uvarint(idx); n <= 0 || codec != 0x0401 {
+			t.Fatalf("%s: expected a MultihashIndexSorted, got index codec 0x%X", hash, codec)
+		} else {
+			idx = idx[n:]
+		}
+
+		take := func(n int) (b []byte) {
+			if len(idx) < n {
+				t.Fatalf("%s: index truncated", hash)
+			}
+			b, idx = idx[:n], idx[n:]
+			return
+		}
+
+		indexed := make(map[string]struct{}, len(car.blocks))
+		for mhCount := binary.LittleEndian.Uint32(take(4)); mhCount > 0; mhCount-- {
+			mhCode := binary.LittleEndian.Uint64(take(8))
+			for widthCount := binary.LittleEndian.Uint32(take(4)); widthCount > 0; widthCount-- {
+				width := int(binary.LittleEndian.Uint32(take(4)))
+				bucket := take(int(binary.LittleEndian.Uint64(take(8))))
+				if width <= 8 || len(bucket)%width != 0 {
+					t.Fatalf("%s: malformed index bucket of width %d", hash, width)
+				}
+
+				var prevDigest []byte
+				for ; len(bucket) > 0; bucket = bucket[width:] {
+					digest := bucket[:width-8]
+					if bytes.Compare(prevDigest, digest) >= 0 {
+						t.Fatalf("%s: index bucket not sorted by digest", hash)
+					}
+					prevDigest = digest
+
+					sectionStart := dataOffset + int64(binary.LittleEndian.Uint64(bucket[width-8:]))
+					section, _, err := readSection(bytes.NewReader(raw), sectionStart, dataEnd)
+					if err != nil {
+						t.Fatalf("%s: indexed offset %d does not point at a section: %s", hash, sectionStart, err)
+					}
+					c, _, err := parseCid(section)
+					if err != nil {
+						t.Fatalf("%s: indexed offset %d does not point at a block: %s", hash, sectionStart, err)
+					}
+					if c.mhCode != mhCode || !bytes.Equal(c.digest, digest) {
+						t.Fatalf("%s: indexed offset %d holds block %s instead of the indexed one", hash, sectionStart, c)
+					}
+
+					if _, dup := indexed[string(c.multihash)]; dup {
+						t.Fatalf("%s: block %s indexed more than once", hash, c)
+					}
+					indexed[string(c.multihash)] = struct{}{}
+				}
+			}
+		}
+
+		if len(idx) != 0 {
+			t.Fatalf("%s: %d unexpected bytes past the end of the index", hash, len(idx))
+		}
+		for k, b := range car.blocks {
+			if _, found := indexed[k]; !found {
+				t.Fatalf("%s: block %s missing from the index", hash, b.cid)
+			}
+		}
+	}
+}
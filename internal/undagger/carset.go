@@ -0,0 +1,143 @@
+package undagger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/multiformats/go-base36"
+)
+
+// A line of the car-split-manifest-jsonl emitter of stream-dagger: either a
+// 'carRoot' for every stream in order, or a 'carFile' for every file written
+type carSetManifestEntry struct {
+	Event   string `json:"event"`
+	Stream  int64  `json:"stream"`
+	Cid     string `json:"cid"`
+	Car     int    `json:"car"`
+	CarFile string `json:"carFile"`
+}
+
+// Indexes every block of every .car file listed in a split manifest, as if
+// they were a single car. The roots are those of every stream in manifest
+// order, repeated ones included. The returned files must be closed by the
+// caller, even on error
+func loadCarSet(manifestPath string) (car *carContents, files []*os.File, err error) {
+
+	mfh, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening manifest failed: %s", err)
+	}
+	defer mfh.Close()
+
+	carFiles := make(map[int]string)
+	var carRoots []carSetManifestEntry
+
+	scanner := bufio.NewScanner(mfh)
+	for line := 1; scanner.Scan(); line++ {
+		var e carSetManifestEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, nil, fmt.Errorf("manifest line %d: %s", line, err)
+		}
+		switch e.Event {
+		case "carFile":
+			carFiles[e.Car] = e.CarFile
+		case "carRoot":
+			carRoots = append(carRoots, e)
+		default:
+			return nil, nil, fmt.Errorf("manifest line %d: unexpected event '%s'", line, e.Event)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading manifest failed: %s", err)
+	}
+
+	fileIdxs := make([]int, 0, len(carFiles))
+	for idx := range carFiles {
+		fileIdxs = append(fileIdxs, idx)
+	}
+	sort.Ints(fileIdxs)
+
+	car = &carContents{
+		version: 1,
+		blocks:  make(map[string]carBlock, 1024),
+	}
+
+	// the roots declared in the header of each file
+	declared := make(map[int]map[string]struct{}, len(fileIdxs))
+
+	for i, idx := range fileIdxs {
+		if idx != i {
+			return nil, files, fmt.Errorf("manifest does not list car file #%d", i)
+		}
+
+		fh, err := os.Open(carFiles[idx])
+		if err != nil {
+			return nil, files, err
+		}
+		files = append(files, fh)
+
+		s, err := fh.Stat()
+		if err != nil {
+			return nil, files, err
+		}
+
+		part, err := loadCar(fh, s.Size())
+		if err != nil {
+			return nil, files, fmt.Errorf("%s: %s", carFiles[idx], err)
+		}
+
+		declared[idx] = make(map[string]struct{}, len(part.roots))
+		for _, r := range part.roots {
+			declared[idx][string(r.raw)] = struct{}{}
+		}
+
+		for _, k := range part.blockOrder {
+			if _, exists := car.blocks[k]; !exists {
+				car.blockOrder = append(car.blockOrder, k)
+				car.blocks[k] = part.blocks[k]
+			}
+		}
+	}
+
+	for _, e := range carRoots {
+		c, err := parseCidString(e.Cid)
+		if err != nil {
+			return nil, files, fmt.Errorf("manifest root of stream %d: %s", e.Stream, err)
+		}
+		if _, found := declared[e.Car][string(c.raw)]; !found {
+			return nil, files, fmt.Errorf("manifest root %s of stream %d is not listed in the header of car file #%d", e.Cid, e.Stream, e.Car)
+		}
+		car.roots = append(car.roots, c)
+	}
+
+	return car, files, nil
+}
+
+// Parses a CID as formatted by stream-dagger: multibase base32 or base36
+func parseCidString(s string) (c cidInfo, err error) {
+	if len(s) < 2 {
+		return c, fmt.Errorf("malformed CID '%s'", s)
+	}
+
+	var b []byte
+	switch s[0] {
+	case 'b':
+		b, err = b32Encoder.DecodeString(s[1:])
+	case 'k':
+		b, err = base36.DecodeString(s[1:])
+	default:
+		return c, fmt.Errorf("unsupported multibase of CID '%s'", s)
+	}
+	if err != nil {
+		return c, fmt.Errorf("malformed CID '%s': %s", s, err)
+	}
+
+	c, cidLen, err := parseCid(b)
+	if err == nil && cidLen != len(b) {
+		err = fmt.Errorf("malformed CID '%s': trailing bytes", s)
+	}
+	return c, err
+}
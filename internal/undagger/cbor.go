@@ -0,0 +1,131 @@
+package undagger
+
+import (
+	"fmt"
+)
+
+// CBOR tag 42 denotes a CID, stored as a byte string with a 0x00 prefix
+const cborTagCid = 42
+
+// Nesting deeper than this is not something stream-dagger ever produces
+const cborMaxDepth = 64
+
+type cborNode struct {
+	links           []cidInfo
+	dagSizes        []uint64
+	payloadSizes    []uint64
+	hasDagSizes     bool
+	hasPayloadSizes bool
+	isRecipe        bool
+}
+
+// Decodes a DAG-CBOR block, collecting every link within it in order of
+// appearance. The 'dagSizes' and 'payloadSizes' lists of the top-level map, as
+// produced by the dagcbor node encoder of stream-dagger, are returned as well,
+// along with whether it is a --recipe-car-block carrying a 'recipeVersion'
+func decodeCBOR(b []byte) (n cborNode, err error) {
+	d := &cborDecoder{buf: b}
+
+	major, arg := d.head()
+	if major != 5 {
+		d.walk(&n, major, arg, 0)
+	} else {
+		for i := uint64(0); i < arg && d.err == nil; i++ {
+			var key string
+			if km, ka := d.head(); km == 3 {
+				key = string(d.take(ka))
+			} else {
+				d.walk(&n, km, ka, 1)
+			}
+
+			switch key {
+			case "dagSizes":
+				n.dagSizes, n.hasDagSizes = d.uintList(), true
+			case "payloadSizes":
+				n.payloadSizes, n.hasPayloadSizes = d.uintList(), true
+			case "recipeVersion":
+				if vm, _ := d.head(); d.err == nil && vm != 0 {
+					d.err = fmt.Errorf("expected an unsigned integer recipeVersion, found major type %d", vm)
+				}
+				n.isRecipe = true
+			default:
+				vm, va := d.head()
+				d.walk(&n, vm, va, 1)
+			}
+		}
+	}
+
+	if d.err == nil && d.pos != len(b) {
+		d.err = fmt.Errorf("%d unexpected trailing bytes", len(b)-d.pos)
+	}
+	if d.err != nil {
+		err = fmt.Errorf("invalid DAG-CBOR node: %s", d.err)
+	}
+	return
+}
+
+// Consumes the remainder of an item whose head was already read, collecting
+// any links found along the way
+func (d *cborDecoder) walk(n *cborNode, major byte, arg uint64, depth int) {
+	if d.err != nil {
+		return
+	}
+	if depth > cborMaxDepth {
+		d.err = fmt.Errorf("nesting deeper than %d levels", cborMaxDepth)
+		return
+	}
+
+	switch major {
+	case 2, 3:
+		d.take(arg)
+	case 4, 5:
+		if major == 5 {
+			arg *= 2
+		}
+		for i := uint64(0); i < arg && d.err == nil; i++ {
+			m, a := d.head()
+			d.walk(n, m, a, depth+1)
+		}
+	case 6:
+		m, a := d.head()
+		if arg != cborTagCid {
+			d.walk(n, m, a, depth+1)
+			return
+		}
+		if m != 2 {
+			d.err = fmt.Errorf("tag 42 applied to major type %d instead of a byte string", m)
+			return
+		}
+		b := d.take(a)
+		if d.err != nil {
+			return
+		}
+		if len(b) == 0 || b[0] != 0 {
+			d.err = fmt.Errorf("CID byte string lacks the mandatory 0x00 prefix")
+			return
+		}
+		c, cidLen, err := parseCid(b[1:])
+		if err != nil {
+			d.err = err
+		} else if cidLen != len(b)-1 {
+			d.err = fmt.Errorf("%d unexpected bytes following CID", len(b)-1-cidLen)
+		} else {
+			n.links = append(n.links, c)
+		}
+	}
+}
+
+func (d *cborDecoder) uintList() (l []uint64) {
+	major, arg := d.head()
+	if d.err == nil && major != 4 {
+		d.err = fmt.Errorf("expected a list of unsigned integers, found major type %d", major)
+	}
+	for i := uint64(0); i < arg && d.err == nil; i++ {
+		m, a := d.head()
+		if d.err == nil && m != 0 {
+			d.err = fmt.Errorf("expected an unsigned integer, found major type %d", m)
+		}
+		l = append(l, a)
+	}
+	return
+}
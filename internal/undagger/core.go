@@ -0,0 +1,315 @@
+package undagger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type Undagger struct {
+	cfg config
+	car *carContents
+}
+
+// IsVerifying is true when the output is a verification report instead of a
+// reconstructed payload
+func (udg *Undagger) IsVerifying() bool { return udg.cfg.Verify }
+
+// ProcessReader indexes the CARv1 or CARv2 available from the reader, and
+// writes out the reconstructed payload of each of its roots, or the result of
+// --verify. When the input is not a regular file, it is first spooled to a
+// temporary file: the blocks are read back in DAG order, not in car order.
+// With --car-split-manifest the input is ignored in favor of the listed set.
+func (udg *Undagger) ProcessReader(in io.Reader, out io.Writer) (err error) {
+
+	if udg.cfg.CarSplitManifest != "" {
+		var files []*os.File
+		udg.car, files, err = loadCarSet(udg.cfg.CarSplitManifest)
+		for _, f := range files {
+			defer f.Close()
+		}
+		if err != nil {
+			return
+		}
+		return udg.processCar(out)
+	}
+
+	var src io.ReaderAt
+	var srcSize int64
+
+	if f, isFh := in.(*os.File); isFh {
+		if s, statErr := f.Stat(); statErr == nil && s.Mode().IsRegular() {
+			src, srcSize = f, s.Size()
+		}
+	}
+	if src == nil {
+		spool, spoolErr := ioutil.TempFile("", "undagger-input-")
+		if spoolErr != nil {
+			return fmt.Errorf("creating input spool failed: %s", spoolErr)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if srcSize, err = io.Copy(spool, in); err != nil {
+			return fmt.Errorf("reading input failed: %s", err)
+		}
+		src = spool
+	}
+
+	if udg.car, err = loadCar(src, srcSize); err != nil {
+		return
+	}
+
+	return udg.processCar(out)
+}
+
+func (udg *Undagger) processCar(out io.Writer) (err error) {
+
+	if udg.cfg.Verify {
+		return udg.car.verify(out)
+	}
+
+	roots := udg.car.roots
+	if len(roots) == 0 || isNulRoot(roots) {
+		// No information in the header: likely a car-v0-* stream
+		if roots, err = udg.car.unreferencedBlocks(); err != nil {
+			return
+		}
+	} else if udg.car.isRecipe(roots[len(roots)-1]) {
+		roots = roots[:len(roots)-1]
+	}
+
+	bw := bufio.NewWriterSize(out, 1<<20)
+
+	for _, r := range roots {
+		var expectedSize int64
+		if udg.cfg.MultipartStream {
+			if expectedSize, err = udg.payloadSize(r); err != nil {
+				return fmt.Errorf("root %s: %s", r, err)
+			}
+			if err = binary.Write(bw, binary.BigEndian, expectedSize); err != nil {
+				return
+			}
+		}
+
+		written, err := udg.writePayload(bw, r)
+		if err != nil {
+			return fmt.Errorf("root %s: %s", r, err)
+		}
+
+		if udg.cfg.MultipartStream && written != expectedSize {
+			return fmt.Errorf(
+				"root %s: declared payload size of %d bytes does not match the actually reconstructed %d bytes",
+				r,
+				expectedSize,
+				written,
+			)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// The description of how the CIDs came to be, stored by stream-dagger
+// --recipe-car-block, does not correspond to any payload. It is always listed
+// as the last root of the header, and its DAG-CBOR map carries a
+// 'recipeVersion'
+func (car *carContents) isRecipe(c cidInfo) bool {
+	if c.codec != codecCBOR {
+		return false
+	}
+	data, err := car.blockData(c)
+	if err != nil {
+		return false
+	}
+	n, err := decodeCBOR(data)
+	return err == nil && n.isRecipe
+}
+
+func isNulRoot(roots []cidInfo) bool {
+	for _, r := range roots {
+		if r.mhCode != mhIdentity || len(r.digest) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Every block that is not linked to from any other block, in car order
+func (car *carContents) unreferencedBlocks() ([]cidInfo, error) {
+	referenced := make(map[string]struct{}, len(car.blocks))
+
+	for _, k := range car.blockOrder {
+		b := car.blocks[k]
+		if b.cid.codec != codecPB && b.cid.codec != codecCBOR {
+			continue
+		}
+		data, err := car.blockData(b.cid)
+		if err != nil {
+			return nil, err
+		}
+		if b.cid.codec == codecCBOR {
+			n, err := decodeCBOR(data)
+			if err != nil {
+				return nil, fmt.Errorf("block %s: %s", b.cid, err)
+			}
+			for _, l := range n.links {
+				referenced[string(l.multihash)] = struct{}{}
+			}
+			continue
+		}
+		n, err := decodePB(data)
+		if err != nil {
+			return nil, fmt.Errorf("block %s: %s", b.cid, err)
+		}
+		for _, l := range n.links {
+			referenced[string(l.cid.multihash)] = struct{}{}
+		}
+	}
+
+	var roots []cidInfo
+	for _, k := range car.blockOrder {
+		if _, isReferenced := referenced[k]; !isReferenced {
+			roots = append(roots, car.blocks[k].cid)
+		}
+	}
+	return roots, nil
+}
+
+func (udg *Undagger) writePayload(w io.Writer, c cidInfo) (written int64, err error) {
+
+	data, err := udg.car.blockData(c)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.codec == codecRaw {
+		n, err := w.Write(data)
+		return int64(n), err
+	} else if c.codec == codecCBOR {
+		return udg.writeCBORPayload(w, c, data)
+	} else if c.codec != codecPB {
+		return 0, fmt.Errorf("block %s: unsupported codec 0x%X", c, c.codec)
+	}
+
+	n, fs, err := decodeUnixFSNode(data)
+	if err != nil {
+		return 0, fmt.Errorf("block %s: %s", c, err)
+	}
+	if fs.fsType != unixfsRaw && fs.fsType != unixfsFile {
+		return 0, fmt.Errorf("block %s: unsupported UnixFS type %d", c, fs.fsType)
+	}
+
+	dataWritten, err := w.Write(fs.data)
+	written += int64(dataWritten)
+	if err != nil {
+		return
+	}
+
+	for _, l := range n.links {
+		subWritten, err := udg.writePayload(w, l.cid)
+		written += subWritten
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return
+}
+
+// A DAG-CBOR node of the dagcbor encoder carries no data of its own: the
+// payload is the concatenation of everything it links to
+func (udg *Undagger) writeCBORPayload(w io.Writer, c cidInfo, data []byte) (written int64, err error) {
+
+	n, err := decodeCBOR(data)
+	if err != nil {
+		return 0, fmt.Errorf("block %s: %s", c, err)
+	}
+	if n.isRecipe {
+		return 0, fmt.Errorf("block %s: a recipe carries no payload", c)
+	}
+
+	for _, l := range n.links {
+		subWritten, err := udg.writePayload(w, l)
+		written += subWritten
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return
+}
+
+// The payload size as declared by the root block itself
+func (udg *Undagger) payloadSize(c cidInfo) (int64, error) {
+
+	if c.codec == codecRaw {
+		if c.mhCode == mhIdentity {
+			return int64(len(c.digest)), nil
+		}
+		if b, found := udg.car.blocks[string(c.multihash)]; found {
+			return int64(b.size), nil
+		}
+	}
+
+	data, err := udg.car.blockData(c)
+	if err != nil {
+		return 0, err
+	}
+	if c.codec == codecCBOR {
+		return udg.cborPayloadSize(c, data)
+	} else if c.codec != codecPB {
+		return 0, fmt.Errorf("block %s: unsupported codec 0x%X", c, c.codec)
+	}
+
+	_, fs, err := decodeUnixFSNode(data)
+	if err != nil {
+		return 0, fmt.Errorf("block %s: %s", c, err)
+	}
+	if fs.hasFileSize {
+		return int64(fs.fileSize), nil
+	}
+
+	size := int64(len(fs.data))
+	for _, bs := range fs.blockSizes {
+		size += int64(bs)
+	}
+	return size, nil
+}
+
+// Without --link-payload-sizes a DAG-CBOR node does not declare its payload:
+// it is then summed up from what the links declare in turn
+func (udg *Undagger) cborPayloadSize(c cidInfo, data []byte) (size int64, err error) {
+
+	n, err := decodeCBOR(data)
+	if err != nil {
+		return 0, fmt.Errorf("block %s: %s", c, err)
+	}
+
+	if n.hasPayloadSizes && len(n.payloadSizes) == len(n.links) {
+		for _, ps := range n.payloadSizes {
+			size += int64(ps)
+		}
+		return size, nil
+	}
+
+	for _, l := range n.links {
+		subSize, err := udg.payloadSize(l)
+		if err != nil {
+			return 0, err
+		}
+		size += subSize
+	}
+	return size, nil
+}
+
+func decodeUnixFSNode(data []byte) (n pbNode, fs unixfsNode, err error) {
+	if n, err = decodePB(data); err != nil {
+		return
+	}
+	fs, err = decodeUnixFS(n.data)
+	return
+}
@@ -0,0 +1,257 @@
+package undagger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ribasushi/DAGger/internal/dagger"
+)
+
+// stream-undagger --multipart must be the exact inverse of stream-dagger
+// --multipart, including repeated and zero-length streams, whether the car is
+// read from a regular file or from a pipe
+func TestMultipartRoundtrip(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+	streams := make([][]byte, 3)
+	for i, size := range []int{3<<20 + 7, 12345, 1 << 20} {
+		streams[i] = make([]byte, size)
+		rnd.Read(streams[i])
+	}
+
+	var input bytes.Buffer
+	for _, s := range [][]byte{streams[0], nil, streams[1], streams[0], nil, streams[2], streams[1]} {
+		binary.Write(&input, binary.BigEndian, int64(len(s)))
+		input.Write(s)
+	}
+
+	for _, emitter := range []string{"car-v1-file", "car-v2-file"} {
+		car := testCarFile(t, input.Bytes(), emitter,
+			"--ipfs-add-compatible-command=--cid-version=1",
+			"--multipart",
+		)
+		defer os.Remove(car.Name())
+		defer car.Close()
+
+		// the latter hides the regular file, as if reading from a pipe
+		for _, in := range []io.Reader{car, struct{ io.Reader }{car}} {
+			if _, err := car.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Unexpected seek error: %s", err)
+			}
+
+			var out bytes.Buffer
+			udg := &Undagger{cfg: config{MultipartStream: true}}
+			if err := udg.ProcessReader(in, &out); err != nil {
+				t.Fatalf("%s: unexpected reconstruction error: %s", emitter, err)
+			}
+			if !bytes.Equal(out.Bytes(), input.Bytes()) {
+				t.Fatalf("%s: reconstructed %d bytes differing from the %d bytes of input", emitter, out.Len(), input.Len())
+			}
+		}
+	}
+}
+
+// Streams linked by the dagcbor node encoder are reconstructed just the same,
+// whether or not the nodes declare the payload size under each link
+func TestDAGCBORRoundtrip(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	var input bytes.Buffer
+	for _, size := range []int{3<<20 + 7, 0, 12345, 20, 1 << 20} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		binary.Write(&input, binary.BigEndian, int64(size))
+		input.Write(b)
+	}
+
+	for _, enc := range []string{"dagcbor", "dagcbor_link-payload-sizes", "dagcbor_link-dag-sizes_link-payload-sizes"} {
+		car := testCarFile(t, input.Bytes(), "car-v1-file",
+			"--hash=sha2-256",
+			"--inline-max-size=36",
+			"--chunkers=fixed-size_65536",
+			"--collectors=fixed-outdegree_max-outdegree=7",
+			"--node-encoder="+enc,
+			"--multipart",
+		)
+		defer os.Remove(car.Name())
+		defer car.Close()
+
+		var out bytes.Buffer
+		udg := &Undagger{cfg: config{MultipartStream: true}}
+		if err := udg.ProcessReader(car, &out); err != nil {
+			t.Fatalf("%s: unexpected reconstruction error: %s", enc, err)
+		}
+		if !bytes.Equal(out.Bytes(), input.Bytes()) {
+			t.Fatalf("%s: reconstructed %d bytes differing from the %d bytes of input", enc, out.Len(), input.Len())
+		}
+	}
+}
+
+// Runs the input through stream-dagger, with the output of the given car
+// emitter going to a temporary file
+func testCarFile(t *testing.T, input []byte, emitter string, args ...string) *os.File {
+
+	fh, err := ioutil.TempFile("", "undagger-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempfile error: %s", err)
+	}
+
+	dgr, err := dagger.NewFromArgvNoExit(
+		append([]string{"dolphin-dongs"}, args...),
+		map[string]io.Writer{emitter: fh},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected initialization error: %s", err)
+	}
+	defer dgr.Destroy()
+
+	if err := dgr.ProcessReader(bytes.NewReader(input), nil); err != nil {
+		t.Fatalf("Unexpected stream processing error: %s", err)
+	}
+
+	return fh
+}
+
+// Only the set of .car files written along with a split manifest is complete:
+// as a whole it must verify, and reproduce the input exactly
+func TestCarSplitSet(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "undagger-test-")
+	if err != nil {
+		t.Fatalf("Unexpected tempdir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rnd := rand.New(rand.NewSource(42))
+	streams := make([][]byte, 3)
+	for i, size := range []int{6 << 20, 5<<20 + 3, 123} {
+		streams[i] = make([]byte, size)
+		rnd.Read(streams[i])
+	}
+
+	var input bytes.Buffer
+	for _, s := range [][]byte{streams[0], nil, streams[1], streams[2], streams[0], nil} {
+		binary.Write(&input, binary.BigEndian, int64(len(s)))
+		input.Write(s)
+	}
+
+	manifest, err := os.Create(filepath.Join(dir, "manifest.jsonl"))
+	if err != nil {
+		t.Fatalf("Unexpected manifest creation error: %s", err)
+	}
+	defer manifest.Close()
+
+	dgr, err := dagger.NewFromArgvNoExit(
+		[]string{
+			"dolphin-dongs",
+			"--ipfs-add-compatible-command=--cid-version=1",
+			"--multipart",
+			"--car-split-max-bytes=4194304",
+			"--car-split-path-template=" + filepath.Join(dir, "out_%02d.car"),
+		},
+		map[string]io.Writer{"car-split-manifest-jsonl": manifest},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected initialization error: %s", err)
+	}
+	defer dgr.Destroy()
+	if err := dgr.ProcessReader(bytes.NewReader(input.Bytes()), nil); err != nil {
+		t.Fatalf("Unexpected stream processing error: %s", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "out_*.car")); len(files) < 3 {
+		t.Fatalf("Expected the input to be split over at least 3 files, got %d", len(files))
+	}
+
+	var report bytes.Buffer
+	udg := &Undagger{cfg: config{Verify: true, CarSplitManifest: manifest.Name()}}
+	if err := udg.ProcessReader(nil, &report); err != nil {
+		t.Fatalf("Unexpected verification error: %s\n%s", err, report.Bytes())
+	}
+
+	var out bytes.Buffer
+	udg = &Undagger{cfg: config{MultipartStream: true, CarSplitManifest: manifest.Name()}}
+	if err := udg.ProcessReader(nil, &out); err != nil {
+		t.Fatalf("Unexpected reconstruction error: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), input.Bytes()) {
+		t.Fatalf("Reconstructed %d bytes differing from the %d bytes of input", out.Len(), input.Len())
+	}
+}
+
+// The --recipe-car-block is listed as the last header root, yet must not be
+// mistaken for a payload. Nor may a DAG-CBOR payload root in that same
+// position be mistaken for a recipe
+func TestRecipeBlockSkipped(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(42))
+
+	var input bytes.Buffer
+	for _, size := range []int{3<<20 + 7, 12345, 1 << 20} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		binary.Write(&input, binary.BigEndian, int64(size))
+		input.Write(b)
+	}
+
+	dagcbor := []string{
+		"--hash=sha2-256",
+		"--inline-max-size=36",
+		"--chunkers=fixed-size_65536",
+		"--collectors=fixed-outdegree_max-outdegree=7",
+		"--node-encoder=dagcbor_link-dag-sizes_link-payload-sizes",
+		"--multipart",
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		args   []string
+		recipe bool
+	}{
+		{"unixfs with recipe", []string{"--ipfs-add-compatible-command=--cid-version=1", "--multipart", "--recipe-car-block"}, true},
+		{"dagcbor with recipe", append([]string{"--recipe-car-block"}, dagcbor...), true},
+		{"dagcbor without recipe", dagcbor, false},
+	} {
+		car := testCarFile(t, input.Bytes(), "car-v1-file", tc.args...)
+		defer os.Remove(car.Name())
+		defer car.Close()
+
+		s, err := car.Stat()
+		if err != nil {
+			t.Fatalf("Unexpected stat error: %s", err)
+		}
+		contents, err := loadCar(car, s.Size())
+		if err != nil {
+			t.Fatalf("%s: unexpected car load error: %s", tc.desc, err)
+		}
+
+		expectedRoots := 3
+		if tc.recipe {
+			expectedRoots++
+		}
+		if len(contents.roots) != expectedRoots {
+			t.Fatalf("%s: expected %d header roots, got %d", tc.desc, expectedRoots, len(contents.roots))
+		}
+		for i, r := range contents.roots {
+			if isLast := (i == len(contents.roots)-1); contents.isRecipe(r) != (isLast && tc.recipe) {
+				t.Fatalf("%s: header root #%d %s misidentified", tc.desc, i, r)
+			}
+		}
+
+		var out bytes.Buffer
+		udg := &Undagger{cfg: config{MultipartStream: true}, car: contents}
+		if err := udg.processCar(&out); err != nil {
+			t.Fatalf("%s: unexpected reconstruction error: %s", tc.desc, err)
+		}
+		if !bytes.Equal(out.Bytes(), input.Bytes()) {
+			t.Fatalf("%s: reconstructed %d bytes differing from the %d bytes of input", tc.desc, out.Len(), input.Len())
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package undagger
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+)
+
+var b32Encoder = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// CIDv0 is displayed in its upgraded CIDv1 form, same as stream-dagger does
+func (c cidInfo) String() string {
+	raw := c.raw
+	if len(raw) == 34 && raw[0] == mhSha2_256 {
+		raw = append([]byte{1, codecPB}, raw...)
+	}
+	return "b" + b32Encoder.EncodeToString(raw)
+}
+
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+	unixfsMetadata  = 3
+	unixfsSymlink   = 4
+	unixfsHAMTShard = 5
+)
+
+type pbLink struct {
+	cid      cidInfo
+	name     string
+	tSize    uint64
+	hasTSize bool
+}
+
+type pbNode struct {
+	links []pbLink
+	data  []byte
+}
+
+type unixfsNode struct {
+	fsType      uint64
+	data        []byte
+	fileSize    uint64
+	hasFileSize bool
+	blockSizes  []uint64
+}
+
+// Decodes a DAG-PB block, accepting both the canonical and the go-ipfs
+// compat field order
+func decodePB(b []byte) (n pbNode, err error) {
+	err = pbFields(b, func(field, wireType int, vi uint64, ld []byte) error {
+		switch {
+		case field == 1 && wireType == 2:
+			n.data = ld
+		case field == 2 && wireType == 2:
+			l, err := decodePBLink(ld)
+			if err != nil {
+				return err
+			}
+			n.links = append(n.links, l)
+		default:
+			return fmt.Errorf("unexpected field %d (wiretype %d) in PBNode", field, wireType)
+		}
+		return nil
+	})
+	return
+}
+
+func decodePBLink(b []byte) (l pbLink, err error) {
+	var hasCid bool
+	err = pbFields(b, func(field, wireType int, vi uint64, ld []byte) error {
+		switch {
+		case field == 1 && wireType == 2:
+			c, cidLen, err := parseCid(ld)
+			if err != nil {
+				return err
+			} else if cidLen != len(ld) {
+				return fmt.Errorf("trailing garbage after link CID")
+			}
+			l.cid = c
+			hasCid = true
+		case field == 2 && wireType == 2:
+			l.name = string(ld)
+		case field == 3 && wireType == 0:
+			l.tSize = vi
+			l.hasTSize = true
+		default:
+			return fmt.Errorf("unexpected field %d (wiretype %d) in PBLink", field, wireType)
+		}
+		return nil
+	})
+	if err == nil && !hasCid {
+		err = fmt.Errorf("PBLink without a Hash")
+	}
+	return
+}
+
+func decodeUnixFS(b []byte) (u unixfsNode, err error) {
+	var hasType bool
+	err = pbFields(b, func(field, wireType int, vi uint64, ld []byte) error {
+		switch {
+		case field == 1 && wireType == 0:
+			u.fsType = vi
+			hasType = true
+		case field == 2 && wireType == 2:
+			u.data = ld
+		case field == 3 && wireType == 0:
+			u.fileSize = vi
+			u.hasFileSize = true
+		case field == 4 && wireType == 0:
+			u.blockSizes = append(u.blockSizes, vi)
+		case field == 4 && wireType == 2:
+			// packed encoding
+			for len(ld) > 0 {
+				v, n := binary.Uvarint(ld)
+				if n <= 0 {
+					return fmt.Errorf("malformed packed blocksizes")
+				}
+				u.blockSizes = append(u.blockSizes, v)
+				ld = ld[n:]
+			}
+		case field >= 5 && field <= 8:
+			// hashType / fanout / mode / mtime: irrelevant for payload reconstruction
+		default:
+			return fmt.Errorf("unexpected field %d (wiretype %d) in UnixFS Data", field, wireType)
+		}
+		return nil
+	})
+	if err == nil && !hasType {
+		err = fmt.Errorf("UnixFS Data without a Type")
+	}
+	return
+}
+
+// Iterates over the fields of a protobuf message, supporting only the varint
+// and length-delimited wire types used by DAG-PB and UnixFS
+func pbFields(b []byte, cb func(field, wireType int, vi uint64, ld []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("malformed protobuf field key")
+		}
+		b = b[n:]
+
+		field, wireType := int(key>>3), int(key&7)
+		var vi uint64
+		var ld []byte
+
+		switch wireType {
+		case 0:
+			if vi, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("malformed protobuf varint in field %d", field)
+			}
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return fmt.Errorf("malformed protobuf length in field %d", field)
+			}
+			ld = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wiretype %d in field %d", wireType, field)
+		}
+
+		if err := cb(field, wireType, vi, ld); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package undagger
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+
+	dgrblock "github.com/ribasushi/DAGger/internal/dagger/block"
+)
+
+type verifier struct {
+	car     *carContents
+	out     io.Writer
+	errors  int
+	hashers map[uint64]hash.Hash
+
+	// nil entries denote nodes whose sizes could not be determined, already
+	// reported as a violation of their own
+	sizes map[string]*nodeSizes
+}
+
+type nodeSizes struct {
+	dag     uint64
+	payload uint64
+}
+
+// Checks every block of the car, reporting each violation as a JSONL line.
+// Payload sizes are only meaningful for raw blocks, UnixFS file/raw nodes and
+// DAG-CBOR nodes linking to either
+func (car *carContents) verify(out io.Writer) (err error) {
+
+	v := &verifier{
+		car:     car,
+		out:     out,
+		hashers: make(map[uint64]hash.Hash),
+		sizes:   make(map[string]*nodeSizes, len(car.blocks)),
+	}
+
+	for _, k := range car.blockOrder {
+		if err = v.verifyBlock(car.blocks[k].cid); err != nil {
+			return
+		}
+	}
+
+	if !isNulRoot(car.roots) {
+		for i, r := range car.roots {
+			if !v.resolvable(r) {
+				if err = v.report("missingRoot", r, fmt.Sprintf("root #%d is not present in the car", i)); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	if _, err = fmt.Fprintf(
+		out,
+		"{\"event\":\"verifySummary\", \"blocks\":%d, \"roots\":%d, \"violations\":%d }\n",
+		len(car.blockOrder),
+		len(car.roots),
+		v.errors,
+	); err != nil {
+		return
+	}
+
+	if v.errors > 0 {
+		return fmt.Errorf("verification failed: %d violations found", v.errors)
+	}
+	return nil
+}
+
+func (v *verifier) report(violation string, c cidInfo, detail string) error {
+	v.errors++
+	_, err := fmt.Fprintf(
+		v.out,
+		"{\"event\":\"verifyError\", \"violation\":%q, \"cid\":\"%s\", \"detail\":%q }\n",
+		violation,
+		c,
+		detail,
+	)
+	return err
+}
+
+func (v *verifier) resolvable(c cidInfo) bool {
+	if c.mhCode == mhIdentity {
+		return true
+	}
+	_, found := v.car.blocks[string(c.multihash)]
+	return found
+}
+
+func (v *verifier) verifyBlock(c cidInfo) (err error) {
+
+	data, err := v.car.blockData(c)
+	if err != nil {
+		return
+	}
+
+	if c.mhCode == mhIdentity {
+		// an identity CID stored as a block: the content must be the digest itself
+		b := v.car.blocks[string(c.multihash)]
+		stored := make([]byte, b.size)
+		if _, err = b.src.ReadAt(stored, b.offset); err != nil {
+			return
+		}
+		if !bytes.Equal(stored, c.digest) {
+			return v.report("hashMismatch", c, "block content does not match its identity CID")
+		}
+	} else {
+		h, known := v.hashers[c.mhCode]
+		if !known {
+			if hm, found := dgrblock.MultihashHasher(uint(c.mhCode)); found {
+				h = hm()
+			}
+			v.hashers[c.mhCode] = h
+		}
+		if h == nil {
+			return v.report("unsupportedHash", c, fmt.Sprintf("multihash 0x%X is not supported", c.mhCode))
+		}
+
+		h.Reset()
+		h.Write(data)
+		if sum := h.Sum(nil); len(c.digest) > len(sum) {
+			return v.report("hashMismatch", c, fmt.Sprintf(
+				"digest length of %d bytes exceeds the %d bytes produced by multihash 0x%X",
+				len(c.digest),
+				len(sum),
+				c.mhCode,
+			))
+		} else if !bytes.Equal(c.digest, sum[:len(c.digest)]) {
+			return v.report("hashMismatch", c, fmt.Sprintf("block content hashes to 0x%X", sum[:len(c.digest)]))
+		}
+	}
+
+	switch c.codec {
+	case codecRaw:
+		return nil
+	case codecCBOR:
+		return v.verifyCBOR(c, data)
+	case codecPB:
+	default:
+		return v.report("unsupportedCodec", c, fmt.Sprintf("codec 0x%X can not be verified past its hash", c.codec))
+	}
+
+	n, err := decodePB(data)
+	if err != nil {
+		return v.report("decodeFailure", c, err.Error())
+	}
+
+	for i, l := range n.links {
+		if !v.resolvable(l.cid) {
+			if err = v.report("missingBlock", c, fmt.Sprintf("link #%d to %s is not present in the car", i, l.cid)); err != nil {
+				return
+			}
+		} else if l.hasTSize {
+			if s := v.nodeSizes(l.cid); s != nil && s.dag != l.tSize {
+				if err = v.report("tsizeMismatch", c, fmt.Sprintf(
+					"link #%d to %s declares a Tsize of %d, actual dag size is %d",
+					i,
+					l.cid,
+					l.tSize,
+					s.dag,
+				)); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	fs, err := decodeUnixFS(n.data)
+	if err != nil {
+		return v.report("decodeFailure", c, err.Error())
+	}
+	if fs.fsType != unixfsRaw && fs.fsType != unixfsFile {
+		return nil
+	}
+
+	if len(fs.blockSizes) > 0 && len(fs.blockSizes) != len(n.links) {
+		return v.report("blocksizesMismatch", c, fmt.Sprintf(
+			"%d blocksizes declared for %d links",
+			len(fs.blockSizes),
+			len(n.links),
+		))
+	}
+
+	payload := uint64(len(fs.data))
+	for i, l := range n.links {
+		s := v.nodeSizes(l.cid)
+		if s == nil {
+			// already reported
+			return nil
+		}
+		payload += s.payload
+
+		if len(fs.blockSizes) > 0 && fs.blockSizes[i] != s.payload {
+			if err = v.report("blocksizesMismatch", c, fmt.Sprintf(
+				"blocksize #%d of %s declared as %d, actual payload size is %d",
+				i,
+				l.cid,
+				fs.blockSizes[i],
+				s.payload,
+			)); err != nil {
+				return
+			}
+		}
+	}
+
+	if fs.hasFileSize && fs.fileSize != payload {
+		return v.report("filesizeMismatch", c, fmt.Sprintf(
+			"filesize declared as %d, actual payload size is %d",
+			fs.fileSize,
+			payload,
+		))
+	}
+
+	return nil
+}
+
+// Links are checked the same way as for DAG-PB, the optional dagSizes and
+// payloadSizes lists of the dagcbor encoder take the place of Tsize/blocksizes
+func (v *verifier) verifyCBOR(c cidInfo, data []byte) (err error) {
+
+	n, err := decodeCBOR(data)
+	if err != nil {
+		return v.report("decodeFailure", c, err.Error())
+	}
+
+	if n.hasDagSizes && len(n.dagSizes) != len(n.links) {
+		if err = v.report("dagSizesMismatch", c, fmt.Sprintf(
+			"%d dagSizes declared for %d links",
+			len(n.dagSizes),
+			len(n.links),
+		)); err != nil {
+			return
+		}
+	}
+	if n.hasPayloadSizes && len(n.payloadSizes) != len(n.links) {
+		if err = v.report("payloadSizesMismatch", c, fmt.Sprintf(
+			"%d payloadSizes declared for %d links",
+			len(n.payloadSizes),
+			len(n.links),
+		)); err != nil {
+			return
+		}
+	}
+
+	for i, l := range n.links {
+		if !v.resolvable(l) {
+			if err = v.report("missingBlock", c, fmt.Sprintf("link #%d to %s is not present in the car", i, l)); err != nil {
+				return
+			}
+			continue
+		}
+
+		s := v.nodeSizes(l)
+		if s == nil {
+			// already reported
+			continue
+		}
+
+		if n.hasDagSizes && i < len(n.dagSizes) && n.dagSizes[i] != s.dag {
+			if err = v.report("dagSizesMismatch", c, fmt.Sprintf(
+				"dagSize #%d of %s declared as %d, actual dag size is %d",
+				i,
+				l,
+				n.dagSizes[i],
+				s.dag,
+			)); err != nil {
+				return
+			}
+		}
+		if n.hasPayloadSizes && i < len(n.payloadSizes) && n.payloadSizes[i] != s.payload {
+			if err = v.report("payloadSizesMismatch", c, fmt.Sprintf(
+				"payloadSize #%d of %s declared as %d, actual payload size is %d",
+				i,
+				l,
+				n.payloadSizes[i],
+				s.payload,
+			)); err != nil {
+				return
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sizes are derived from the actual block contents, disregarding any declared
+// Tsize/filesize values
+func (v *verifier) nodeSizes(c cidInfo) *nodeSizes {
+	k := string(c.raw)
+	if s, seen := v.sizes[k]; seen {
+		return s
+	}
+	// guard against cycles
+	v.sizes[k] = nil
+
+	if !v.resolvable(c) {
+		return nil
+	}
+	data, err := v.car.blockData(c)
+	if err != nil {
+		return nil
+	}
+
+	s := &nodeSizes{dag: uint64(len(data))}
+	if c.codec == codecRaw {
+		s.payload = uint64(len(data))
+	} else if c.codec == codecPB {
+		n, fs, err := decodeUnixFSNode(data)
+		if err != nil {
+			return nil
+		}
+		s.payload = uint64(len(fs.data))
+		for _, l := range n.links {
+			sub := v.nodeSizes(l.cid)
+			if sub == nil {
+				return nil
+			}
+			s.dag += sub.dag
+			s.payload += sub.payload
+		}
+	} else if c.codec == codecCBOR {
+		n, err := decodeCBOR(data)
+		if err != nil {
+			return nil
+		}
+		for _, l := range n.links {
+			sub := v.nodeSizes(l)
+			if sub == nil {
+				return nil
+			}
+			s.dag += sub.dag
+			s.payload += sub.payload
+		}
+	}
+
+	v.sizes[k] = s
+	return s
+}
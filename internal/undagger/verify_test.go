@@ -0,0 +1,93 @@
+package undagger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A car straight out of stream-dagger must verify cleanly, while a single
+// flipped bit in any block, or any block gone missing, must be reported
+func TestVerifyCorruption(t *testing.T) {
+
+	payload := make([]byte, 3<<20+7)
+	rand.New(rand.NewSource(42)).Read(payload)
+
+	for _, chain := range [][]string{
+		{"--ipfs-add-compatible-command=--cid-version=1"},
+		{
+			"--hash=sha2-256",
+			"--inline-max-size=36",
+			"--chunkers=fixed-size_65536",
+			"--collectors=fixed-outdegree_max-outdegree=7",
+			"--node-encoder=dagcbor_link-dag-sizes_link-payload-sizes",
+		},
+	} {
+		fh := testCarFile(t, payload, "car-v1-file", chain...)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		raw, err := ioutil.ReadFile(fh.Name())
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+
+		load := func(b []byte) *carContents {
+			car, err := loadCar(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatalf("%v: unexpected car load error: %s", chain, err)
+			}
+			return car
+		}
+
+		car := load(raw)
+
+		var report bytes.Buffer
+		if err := car.verify(&report); err != nil {
+			t.Fatalf("%v: unexpected verification error: %s\n%s", chain, err, report.Bytes())
+		}
+
+		for _, k := range car.blockOrder {
+			b := car.blocks[k]
+
+			corrupted := append([]byte{}, raw...)
+			corrupted[b.offset+int64(b.size)/2] ^= 0x10
+			expectViolation(t, load(corrupted), "hashMismatch", b.cid)
+
+			missing := load(raw)
+			delete(missing.blocks, k)
+			missing.blockOrder = missing.blockOrder[:0]
+			for _, mk := range car.blockOrder {
+				if mk != k {
+					missing.blockOrder = append(missing.blockOrder, mk)
+				}
+			}
+			if bytes.Equal(b.cid.raw, car.roots[0].raw) {
+				expectViolation(t, missing, "missingRoot", b.cid)
+			} else {
+				expectViolation(t, missing, "missingBlock", b.cid)
+			}
+		}
+	}
+}
+
+func expectViolation(t *testing.T, car *carContents, violation string, c cidInfo) {
+	var report bytes.Buffer
+	if err := car.verify(&report); err == nil {
+		t.Fatalf("Expected a '%s' violation of block %s, yet verification passed", violation, c)
+	}
+
+	var expected string
+	if violation == "missingBlock" {
+		expected = fmt.Sprintf("to %s is not present in the car", c)
+	} else {
+		expected = fmt.Sprintf("\"violation\":%q, \"cid\":\"%s\"", violation, c)
+	}
+	if !strings.Contains(report.String(), expected) {
+		t.Fatalf("Expected a '%s' violation of block %s, instead got:\n%s", violation, c, report.Bytes())
+	}
+}
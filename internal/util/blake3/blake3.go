@@ -0,0 +1,286 @@
+// Package blake3 is a portable implementation of the default 256-bit BLAKE3
+// hash, which spreads large writes across multiple goroutines by hashing
+// independent subtrees concurrently (the "tree mode" of the spec:
+// https://github.com/BLAKE3-team/BLAKE3-specs/blob/master/blake3.pdf )
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+	"sync"
+)
+
+const (
+	Size      = 32
+	BlockSize = 64
+	ChunkSize = 1024
+
+	// Subtrees of this many chunks or fewer are hashed on the current goroutine
+	ParallelMinChunks = 64
+)
+
+const (
+	flagChunkStart = 1 << iota
+	flagChunkEnd
+	flagParent
+	flagRoot
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+// the input of a not-yet-performed compression, kept around so that the
+// final node can still be marked as the root
+type node struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+type hasher struct {
+	stack   [54][8]uint32 // chaining value of a complete subtree at each height
+	counter uint64        // amount of complete chunks, also a bitmap of occupied stack slots
+	buf     [ChunkSize]byte
+	buflen  int
+}
+
+// New returns a hash.Hash computing the 32-byte BLAKE3 digest
+func New() hash.Hash { return new(hasher) }
+
+func (h *hasher) Size() int      { return Size }
+func (h *hasher) BlockSize() int { return BlockSize }
+func (h *hasher) Reset()         { h.counter = 0; h.buflen = 0 }
+
+func (h *hasher) Write(p []byte) (int, error) {
+	lenp := len(p)
+
+	if h.buflen > 0 {
+		n := copy(h.buf[h.buflen:], p)
+		h.buflen += n
+		p = p[n:]
+	}
+
+	// only compress a buffered chunk once it is certain it is not the last one
+	if h.buflen == ChunkSize && len(p) > 0 {
+		h.pushSubtree(chainingValue(chunkNode(h.buf[:], h.counter)), 0)
+		h.buflen = 0
+	}
+
+	if len(p) > ChunkSize {
+		rem := len(p) % ChunkSize
+		if rem == 0 {
+			rem = ChunkSize
+		}
+		full := p[:len(p)-rem]
+		p = p[len(p)-rem:]
+
+		// consume the largest subtrees the current chunk counter is aligned to
+		for len(full) > 0 {
+			height := bits.Len64(uint64(len(full)/ChunkSize)) - 1
+			if h.counter != 0 {
+				if tz := bits.TrailingZeros64(h.counter); tz < height {
+					height = tz
+				}
+			}
+			n := (1 << uint(height)) * ChunkSize
+			h.pushSubtree(subtreeCv(full[:n], h.counter), height)
+			full = full[n:]
+		}
+	}
+
+	h.buflen += copy(h.buf[h.buflen:], p)
+
+	return lenp, nil
+}
+
+func (h *hasher) Sum(b []byte) []byte {
+	n := chunkNode(h.buf[:h.buflen], h.counter)
+	for i := bits.TrailingZeros64(h.counter); i < 64; i++ {
+		if h.counter&(1<<uint(i)) != 0 {
+			n = parentNode(h.stack[i], chainingValue(n))
+		}
+	}
+	n.flags |= flagRoot
+
+	out := compress(&n)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(out[i]), byte(out[i]>>8), byte(out[i]>>16), byte(out[i]>>24))
+	}
+	return b
+}
+
+func (h *hasher) pushSubtree(cv [8]uint32, height int) {
+	i := height
+	for h.counter&(1<<uint(i)) != 0 {
+		cv = chainingValue(parentNode(h.stack[i], cv))
+		i++
+	}
+	h.stack[i] = cv
+	h.counter += 1 << uint(height)
+}
+
+// buf holds a power-of-two amount of complete chunks, which are never the
+// entirety of the input
+func subtreeCv(buf []byte, counter uint64) [8]uint32 {
+	chunks := uint64(len(buf) / ChunkSize)
+	if chunks == 1 {
+		return chainingValue(chunkNode(buf, counter))
+	}
+
+	half := len(buf) / 2
+	var left [8]uint32
+	if chunks > ParallelMinChunks {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			left = subtreeCv(buf[:half], counter)
+		}()
+		right := subtreeCv(buf[half:], counter+chunks/2)
+		wg.Wait()
+		return chainingValue(parentNode(left, right))
+	}
+
+	left = subtreeCv(buf[:half], counter)
+	return chainingValue(parentNode(left, subtreeCv(buf[half:], counter+chunks/2)))
+}
+
+// Compresses all but the last block of a chunk of up to ChunkSize bytes
+func chunkNode(buf []byte, counter uint64) node {
+	n := node{
+		cv:      iv,
+		counter: counter,
+		flags:   flagChunkStart,
+	}
+	for len(buf) > BlockSize {
+		n.blockLen = BlockSize
+		loadBlock(&n.block, buf[:BlockSize])
+		n.cv = chainingValue(n)
+		n.flags &^= flagChunkStart
+		buf = buf[BlockSize:]
+	}
+	n.blockLen = uint32(len(buf))
+	loadBlock(&n.block, buf)
+	n.flags |= flagChunkEnd
+	return n
+}
+
+func parentNode(left, right [8]uint32) node {
+	n := node{
+		cv:       iv,
+		blockLen: BlockSize,
+		flags:    flagParent,
+	}
+	copy(n.block[:8], left[:])
+	copy(n.block[8:], right[:])
+	return n
+}
+
+func loadBlock(dst *[16]uint32, src []byte) {
+	var b [BlockSize]byte
+	copy(b[:], src)
+	for i := range dst {
+		dst[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+}
+
+func chainingValue(n node) (cv [8]uint32) {
+	out := compress(&n)
+	copy(cv[:], out[:8])
+	return
+}
+
+func compress(n *node) [16]uint32 {
+	m := n.block
+	s0, s1, s2, s3, s4, s5, s6, s7 := n.cv[0], n.cv[1], n.cv[2], n.cv[3], n.cv[4], n.cv[5], n.cv[6], n.cv[7]
+	s8, s9, s10, s11 := iv[0], iv[1], iv[2], iv[3]
+	s12, s13, s14, s15 := uint32(n.counter), uint32(n.counter>>32), n.blockLen, n.flags
+
+	for r := 0; r < 7; r++ {
+		// columns
+		s0 += s4 + m[0]
+		s12 = bits.RotateLeft32(s12^s0, -16)
+		s8 += s12
+		s4 = bits.RotateLeft32(s4^s8, -12)
+		s0 += s4 + m[1]
+		s12 = bits.RotateLeft32(s12^s0, -8)
+		s8 += s12
+		s4 = bits.RotateLeft32(s4^s8, -7)
+		s1 += s5 + m[2]
+		s13 = bits.RotateLeft32(s13^s1, -16)
+		s9 += s13
+		s5 = bits.RotateLeft32(s5^s9, -12)
+		s1 += s5 + m[3]
+		s13 = bits.RotateLeft32(s13^s1, -8)
+		s9 += s13
+		s5 = bits.RotateLeft32(s5^s9, -7)
+		s2 += s6 + m[4]
+		s14 = bits.RotateLeft32(s14^s2, -16)
+		s10 += s14
+		s6 = bits.RotateLeft32(s6^s10, -12)
+		s2 += s6 + m[5]
+		s14 = bits.RotateLeft32(s14^s2, -8)
+		s10 += s14
+		s6 = bits.RotateLeft32(s6^s10, -7)
+		s3 += s7 + m[6]
+		s15 = bits.RotateLeft32(s15^s3, -16)
+		s11 += s15
+		s7 = bits.RotateLeft32(s7^s11, -12)
+		s3 += s7 + m[7]
+		s15 = bits.RotateLeft32(s15^s3, -8)
+		s11 += s15
+		s7 = bits.RotateLeft32(s7^s11, -7)
+
+		// diagonals
+		s0 += s5 + m[8]
+		s15 = bits.RotateLeft32(s15^s0, -16)
+		s10 += s15
+		s5 = bits.RotateLeft32(s5^s10, -12)
+		s0 += s5 + m[9]
+		s15 = bits.RotateLeft32(s15^s0, -8)
+		s10 += s15
+		s5 = bits.RotateLeft32(s5^s10, -7)
+		s1 += s6 + m[10]
+		s12 = bits.RotateLeft32(s12^s1, -16)
+		s11 += s12
+		s6 = bits.RotateLeft32(s6^s11, -12)
+		s1 += s6 + m[11]
+		s12 = bits.RotateLeft32(s12^s1, -8)
+		s11 += s12
+		s6 = bits.RotateLeft32(s6^s11, -7)
+		s2 += s7 + m[12]
+		s13 = bits.RotateLeft32(s13^s2, -16)
+		s8 += s13
+		s7 = bits.RotateLeft32(s7^s8, -12)
+		s2 += s7 + m[13]
+		s13 = bits.RotateLeft32(s13^s2, -8)
+		s8 += s13
+		s7 = bits.RotateLeft32(s7^s8, -7)
+		s3 += s4 + m[14]
+		s14 = bits.RotateLeft32(s14^s3, -16)
+		s9 += s14
+		s4 = bits.RotateLeft32(s4^s9, -12)
+		s3 += s4 + m[15]
+		s14 = bits.RotateLeft32(s14^s3, -8)
+		s9 += s14
+		s4 = bits.RotateLeft32(s4^s9, -7)
+
+		// permute the message words for the next round
+		m = [16]uint32{
+			m[2], m[6], m[3], m[10], m[7], m[0], m[4], m[13],
+			m[1], m[11], m[12], m[5], m[9], m[14], m[15], m[8],
+		}
+	}
+
+	return [16]uint32{
+		s0 ^ s8, s1 ^ s9, s2 ^ s10, s3 ^ s11,
+		s4 ^ s12, s5 ^ s13, s6 ^ s14, s7 ^ s15,
+		s8 ^ n.cv[0], s9 ^ n.cv[1], s10 ^ n.cv[2], s11 ^ n.cv[3],
+		s12 ^ n.cv[4], s13 ^ n.cv[5], s14 ^ n.cv[6], s15 ^ n.cv[7],
+	}
+}
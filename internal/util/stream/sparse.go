@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"io"
+	"os"
+)
+
+// Populated by OS-specific init()s where lseek() can locate holes
+var (
+	seekData, seekHole int
+	errNoMoreData      error
+)
+
+// SparseReader serves the content of a regular file with holes, learning the
+// extents of the holes via SEEK_DATA/SEEK_HOLE and zero-filling them instead
+// of reading them. The file offset is kept in sync with what was served
+type SparseReader struct {
+	f       *os.File
+	start   int64
+	size    int64
+	off     int64
+	dataEnd int64 // content known to be data up to here
+	holeEnd int64 // content known to be a hole up to here
+
+	// OnHole is invoked as soon as a hole is located, before any of its zeros
+	// are served. The offset is relative to where reading started
+	OnHole func(offset, length int64)
+}
+
+// NewSparseReader returns nil unless maybeFile is a regular file with at
+// least one hole between its current offset and its end, on an OS and
+// filesystem able to report holes
+func NewSparseReader(maybeFile io.Reader) *SparseReader {
+
+	f, isFile := maybeFile.(*os.File)
+	if !isFile || seekData == 0 {
+		return nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil
+	}
+
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || start >= stat.Size() {
+		return nil
+	}
+
+	// filesystems without hole support report a single hole at EOF
+	firstHole, err := f.Seek(start, seekHole)
+	if _, seekErr := f.Seek(start, io.SeekStart); seekErr != nil || err != nil || firstHole >= stat.Size() {
+		return nil
+	}
+
+	return &SparseReader{
+		f:       f,
+		start:   start,
+		size:    stat.Size(),
+		off:     start,
+		dataEnd: start,
+		holeEnd: start,
+	}
+}
+
+func (s *SparseReader) Read(p []byte) (n int, err error) {
+
+	// whatever follows the size seen at open is read as-is
+	if s.off >= s.size {
+		n, err = s.f.Read(p)
+		s.off += int64(n)
+		return
+	}
+
+	defer func() {
+		if _, seekErr := s.f.Seek(s.off, io.SeekStart); seekErr != nil && err == nil {
+			err = seekErr
+		}
+	}()
+
+	for n < len(p) && s.off < s.size {
+
+		if s.off >= s.holeEnd && s.off >= s.dataEnd {
+			if err = s.locate(); err != nil {
+				return
+			}
+		}
+
+		if s.off < s.holeEnd {
+			fill := p[n:]
+			if int64(len(fill)) > s.holeEnd-s.off {
+				fill = fill[:s.holeEnd-s.off]
+			}
+			for i := range fill {
+				fill[i] = 0
+			}
+			n += len(fill)
+			s.off += int64(len(fill))
+			continue
+		}
+
+		buf := p[n:]
+		if int64(len(buf)) > s.dataEnd-s.off {
+			buf = buf[:s.dataEnd-s.off]
+		}
+		var read int
+		read, err = s.f.ReadAt(buf, s.off)
+		n += read
+		s.off += int64(read)
+
+		// the file shrunk from under us
+		if err == io.EOF {
+			s.size = s.off
+			if n > 0 {
+				err = nil
+			}
+			return
+		} else if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *SparseReader) locate() error {
+
+	data, err := s.f.Seek(s.off, seekData)
+	if pathErr, isPathErr := err.(*os.PathError); isPathErr && pathErr.Err == errNoMoreData {
+		data = s.size
+	} else if err != nil {
+		return err
+	}
+
+	if data > s.off {
+		if data > s.size {
+			data = s.size
+		}
+		s.holeEnd = data
+		if s.OnHole != nil {
+			s.OnHole(s.off-s.start, data-s.off)
+		}
+		return nil
+	}
+
+	if s.dataEnd, err = s.f.Seek(s.off, seekHole); err != nil {
+		return err
+	}
+	if s.dataEnd > s.size || s.dataEnd <= s.off {
+		s.dataEnd = s.size
+	}
+	return nil
+}
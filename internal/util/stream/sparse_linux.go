@@ -0,0 +1,9 @@
+package stream
+
+import "golang.org/x/sys/unix"
+
+func init() {
+	seekData = unix.SEEK_DATA
+	seekHole = unix.SEEK_HOLE
+	errNoMoreData = unix.ENXIO
+}
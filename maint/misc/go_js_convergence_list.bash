@@ -20,6 +20,7 @@ for data_fn in ../testdata/*.zst ; do \
 					for cidver in 0 1 ; do \
 						for use_implementation in go js ; do \
 							[[ "$use_implementation" == "js" ]] && ( [[ "$inline_limit" != "0" ]] || [[ "$use_chunker" == "buzhash" ]] || [[ "$cidver" == "0" ]] ) && continue
+							[[ "$use_implementation" == "js" ]] && [[ $data_fn =~ \.tar\.zst$ ]] && continue
 
 							adder_varname="${use_implementation}_adder"
 
@@ -42,6 +43,16 @@ for data_fn in ../testdata/*.zst ; do \
 								wrapper+=( timeout 10 )
 							fi
 
+							# directory fixtures are tarballs of a single top-level directory
+							if [[ $data_fn =~ \.tar\.zst$ ]] ; then
+								tree_dir="$(mktemp -d)"
+								zstd -qdck $data_fn | tar -x -C "$tree_dir"
+								resultCID="$(${!adder_varname} ${core_opts[@]} add -r --hidden -n --quieter --chunker=$use_chunker --trickle=$use_trickle --raw-leaves=$use_rawleaves ${add_opts[@]} "$tree_dir"/*)"
+								rm -rf "$tree_dir"
+								echo -e "Data:$data_fn\tImpl:$use_implementation\tTrickle:$use_trickle\tRawLeaves:$use_rawleaves\tInlining:$inline_limit\tCidVer:$cidver\tChunker:$use_chunker\tCmd:${core_opts[@]} add -r --hidden --chunker=$use_chunker --trickle=$use_trickle --raw-leaves=$use_rawleaves ${add_opts[@]}\tCID:$resultCID"
+								continue
+							fi
+
 							resultCID="$(zstd -qdck $data_fn | ${wrapper[@]} ${!adder_varname} ${core_opts[@]} add -n --quiet --chunker=$use_chunker --trickle=$use_trickle --raw-leaves=$use_rawleaves ${add_opts[@]})"
 							echo -e "Data:$data_fn\tImpl:$use_implementation\tTrickle:$use_trickle\tRawLeaves:$use_rawleaves\tInlining:$inline_limit\tCidVer:$cidver\tChunker:$use_chunker\tCmd:${core_opts[@]} add --chunker=$use_chunker --trickle=$use_trickle --raw-leaves=$use_rawleaves ${add_opts[@]}\tCID:$resultCID"
 